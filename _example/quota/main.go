@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/thinkgos/go-socks5"
+)
+
+// quota tracks the bytes relayed per user in the current month,
+// the rule set denies the user over the limit, the session end hook counts the bytes.
+// The bytes are counted when the session ends, so the sessions already relaying
+// may overrun the limit.
+type quota struct {
+	mu    sync.Mutex
+	limit int64
+	month time.Month
+	used  map[string]int64
+}
+
+func newQuota(limit int64) *quota {
+	return &quota{limit: limit, month: time.Now().Month(), used: make(map[string]int64)}
+}
+
+// resetIfNewMonth starts counting again on the first connection of a new month, must hold mu.
+func (sf *quota) resetIfNewMonth() {
+	if month := time.Now().Month(); month != sf.month {
+		sf.month, sf.used = month, make(map[string]int64)
+	}
+}
+
+// Allow implement interface socks5.RuleSet, the identity comes from the auth context
+func (sf *quota) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	user := req.AuthContext.Payload[socks5.AuthKeyUsername]
+
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	sf.resetIfNewMonth()
+	return ctx, sf.used[user] < sf.limit
+}
+
+// sessionEnd adds the bytes relayed in both directions to the user's usage
+func (sf *quota) sessionEnd(req *socks5.Request, up, down int64, err error) {
+	user := req.AuthContext.Payload[socks5.AuthKeyUsername]
+
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	sf.resetIfNewMonth()
+	sf.used[user] += up + down
+	log.Printf("quota: %s used %d of %d bytes", user, sf.used[user], sf.limit)
+}
+
+func main() {
+	// 10 GiB per user per month
+	q := newQuota(10 << 30)
+
+	// Create a SOCKS5 server
+	server := socks5.NewServer(
+		socks5.WithLogger(socks5.NewLogger(log.New(os.Stdout, "socks5: ", log.LstdFlags))),
+		socks5.WithCredential(socks5.StaticCredentials{"foo": "bar"}),
+		socks5.WithRule(q),
+		socks5.WithSessionEnd(q.sessionEnd),
+	)
+
+	// Create SOCKS5 proxy on localhost port 10800
+	if err := server.ListenAndServe("tcp", ":10800"); err != nil {
+		panic(err)
+	}
+}
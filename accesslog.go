@@ -0,0 +1,48 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// AccessLogEntry is the audit record of a request, which is populated
+// at the end of the request handling, see WithAccessLogger.
+type AccessLogEntry struct {
+	// Time the request handling started
+	Time time.Time
+	// Duration of the request handling, including the relay
+	Duration time.Duration
+	// ConnID the unique id of the client connection, see Request.ConnID
+	ConnID string
+	// RemoteAddr the client address
+	RemoteAddr net.Addr
+	// Username the authenticated user, "" if none
+	Username string
+	// Command the request command, after rewritten if any
+	Command uint8
+	// Destination the requested destination address
+	Destination string
+	// OutboundAddr the local address of the outbound socket, nil if not dialed
+	OutboundAddr net.Addr
+	// Replied reports whether a reply has been sent to the client
+	Replied bool
+	// Reply the reply code sent to the client
+	Reply uint8
+	// BytesUp the bytes relayed from the client to the target
+	BytesUp int64
+	// BytesDown the bytes relayed from the target to the client
+	BytesDown int64
+	// Err the failure reason, nil if succeed
+	Err error
+}
+
+// accessLogCtxKey is the context key of the access log entry in progress
+type accessLogCtxKey struct{}
+
+// recordRelayBytes records the bytes relayed on the access log entry in ctx if any
+func recordRelayBytes(ctx context.Context, up, down int64) {
+	if entry, ok := ctx.Value(accessLogCtxKey{}).(*AccessLogEntry); ok {
+		entry.BytesUp, entry.BytesDown = up, down
+	}
+}
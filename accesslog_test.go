@@ -0,0 +1,80 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+
+	"github.com/thinkgos/go-socks5/statute"
+)
+
+func TestAccessLogger(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	outbound := make(chan net.Addr, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		outbound <- conn.RemoteAddr()
+		io.Copy(conn, conn) // nolint: errcheck
+	}()
+
+	entries := make(chan AccessLogEntry, 2)
+	srv := NewServer(
+		WithCredential(StaticCredentials{"foo": "bar"}),
+		WithAccessLogger(func(entry AccessLogEntry) { entries <- entry }),
+	)
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	dial, err := proxy.SOCKS5("tcp", srvLn.Addr().String(), &proxy.Auth{User: "foo", Password: "bar"}, proxy.Direct)
+	require.NoError(t, err)
+	conn, err := dial.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 4))
+	require.NoError(t, err)
+	conn.Close()
+
+	var entry AccessLogEntry
+	select {
+	case entry = <-entries:
+	case <-time.After(time.Second):
+		t.Fatal("no access log entry")
+	}
+	require.Equal(t, "foo", entry.Username)
+	require.Equal(t, conn.LocalAddr().String(), entry.RemoteAddr.String())
+	require.Equal(t, statute.CommandConnect, entry.Command)
+	require.Equal(t, l.Addr().String(), entry.Destination)
+	require.Equal(t, (<-outbound).String(), entry.OutboundAddr.String())
+	require.True(t, entry.Replied)
+	require.Equal(t, statute.RepSuccess, entry.Reply)
+	require.Equal(t, int64(4), entry.BytesUp)
+	require.Equal(t, int64(4), entry.BytesDown)
+	require.False(t, entry.Time.IsZero())
+
+	// failed
+	_, err = dial.Dial("tcp", "127.0.0.1:1")
+	require.Error(t, err)
+	select {
+	case entry = <-entries:
+	case <-time.After(time.Second):
+		t.Fatal("no access log entry")
+	}
+	require.Equal(t, "127.0.0.1:1", entry.Destination)
+	require.Equal(t, statute.RepConnectionRefused, entry.Reply)
+	require.Error(t, entry.Err)
+	require.Zero(t, entry.BytesUp)
+	require.Nil(t, entry.OutboundAddr)
+}
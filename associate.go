@@ -0,0 +1,383 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thinkgos/go-socks5/statute"
+)
+
+// fragReassemblyTimeout the reassembly timer of the fragmented datagrams,
+// rfc1928 section 7 said it must be no less than 5 seconds.
+const fragReassemblyTimeout = 5 * time.Second
+
+// udpResolveTTL the duration the association memoizes the resolved datagram destination,
+// include the failure, so that the datagrams don't resolve at the packet rate.
+const udpResolveTTL = 30 * time.Second
+
+// udpMaxResolved the max number of the destinations memoized per association
+const udpMaxResolved = 256
+
+// errDatagramResolve is wrapped by the failure of resolving the datagram destination,
+// which is logged once per memo rather than per datagram.
+var errDatagramResolve = errors.New("resolve datagram destination failed")
+
+// errDatagramDenied is wrapped by the datagram dropped by the policy, such as not the declared
+// destination or blocked by the rules, which is logged at debug level as it is at the packet rate.
+var errDatagramDenied = errors.New("datagram denied by policy")
+
+// DefaultAssociateHandler is the built-in handler of the associate command,
+// a handler set by WithAssociateHandle can call it to keep the default behavior.
+func (sf *Server) DefaultAssociateHandler(ctx context.Context, writer io.Writer, request *Request) error {
+	// the udp relay socket which the client sends datagrams to
+	bindLn, err := request.ListenUDP()
+	if err != nil {
+		if err := SendReply(writer, statute.RepServerFailure, nil); err != nil {
+			return fmt.Errorf("failed to send reply, %v", err)
+		}
+		return fmt.Errorf("listen udp failed, %v", err)
+	}
+	defer bindLn.Close()
+
+	// the outbound socket which relays datagrams to the remote servers
+	target, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		if err := SendReply(writer, statute.RepServerFailure, nil); err != nil {
+			return fmt.Errorf("failed to send reply, %v", err)
+		}
+		return fmt.Errorf("listen udp failed, %v", err)
+	}
+	defer target.Close()
+	request.OutboundAddr = target.LocalAddr()
+
+	// send BND.ADDR and BND.PORT, client used
+	var bndAddr net.Addr = bindLn.LocalAddr()
+	if sf.udpAdvertisedIP != nil {
+		bndAddr = &net.UDPAddr{IP: sf.udpAdvertisedIP, Port: bindLn.LocalAddr().(*net.UDPAddr).Port}
+	}
+	if err = SendReply(writer, statute.RepSuccess, bndAddr); err != nil {
+		return fmt.Errorf("failed to send reply, %v", err)
+	}
+	enterPhase(ctx, &sf.stats.relaying)
+
+	ass := &udpAssociation{
+		sf:      sf,
+		ctx:     ctx,
+		request: request,
+		bindLn:  bindLn,
+		target:  target,
+	}
+	idle := make(chan struct{})
+	if sf.udpTimeout > 0 {
+		ass.timer = newIdleTimer(sf.udpTimeout, func() { close(idle) })
+		defer ass.timer.stop()
+	}
+	var lifetime <-chan time.Time
+	if sf.udpMaxLifetime > 0 {
+		t := time.NewTimer(sf.udpMaxLifetime)
+		defer t.Stop()
+		lifetime = t.C
+	}
+	sf.goFunc(ass.upstream)
+	sf.goFunc(ass.downstream)
+
+	// the association terminates when the tcp connection terminates,
+	// returning closes the udp relay and the tcp connection.
+	done := make(chan error, 1)
+	sf.goFunc(func() {
+		_, err := io.Copy(ioutil.Discard, request.Reader)
+		done <- err
+	})
+	select {
+	case err = <-done:
+		return err
+	case <-idle:
+		return fmt.Errorf("udp associate idle timeout after %v", sf.udpTimeout)
+	case <-lifetime:
+		return fmt.Errorf("udp associate max lifetime %v exceeded", sf.udpMaxLifetime)
+	}
+}
+
+// udpAssociation a udp relay of the associate command
+type udpAssociation struct {
+	sf      *Server
+	ctx     context.Context
+	request *Request
+	bindLn  *net.UDPConn
+	target  *net.UDPConn
+
+	timer *idleTimer // optional, touched by the datagrams in both directions
+
+	mu     sync.Mutex
+	client net.Addr // the client address, which is the source of the first datagram
+	frag   reassembler
+
+	resolved map[string]udpResolved // the memo of the destinations resolved, used by upstream only
+}
+
+type udpResolved struct {
+	ctx    context.Context
+	ip     net.IP
+	err    error
+	expire time.Time
+}
+
+// touch reports the datagram activity
+func (sf *udpAssociation) touch() {
+	if sf.timer != nil {
+		sf.timer.touch()
+	}
+}
+
+// upstream read datagrams from the client, and write to the remote servers
+func (sf *udpAssociation) upstream() {
+	bufPool := sf.sf.bufferPool.Get()
+	defer func() {
+		sf.target.Close()
+		sf.sf.bufferPool.Put(bufPool)
+	}()
+
+	for {
+		n, srcAddr, err := sf.bindLn.ReadFrom(bufPool[:cap(bufPool)])
+		if err != nil {
+			if isClosedErr(err) {
+				return
+			}
+			continue
+		}
+		if !sf.validSource(srcAddr) {
+			continue
+		}
+
+		pk, err := statute.ParseDatagram(bufPool[:n])
+		if err != nil {
+			continue
+		}
+		if pk.Frag != 0 {
+			if !sf.sf.udpFragReassembly {
+				continue // drop the fragment
+			}
+			var ok bool
+			if pk, ok = sf.frag.push(pk); !ok {
+				continue
+			}
+		}
+
+		dst, err := sf.resolve(pk.DstAddr)
+		if err != nil {
+			// the resolve failure is logged once by lookup
+			if errors.Is(err, errDatagramDenied) {
+				sf.sf.debugf("[%s] datagram to %s dropped, %v", sf.request.ConnID, pk.DstAddr.String(), err)
+			}
+			continue
+		}
+		if sf.sf.udpPacketFilter != nil {
+			spec := pk.DstAddr
+			spec.IP = dst.IP
+			if !sf.sf.udpPacketFilter(srcAddr, &spec, pk.Data) {
+				continue
+			}
+		}
+		sf.touch()
+		if _, err := sf.target.WriteTo(pk.Data, dst); err != nil {
+			sf.sf.logger.Errorf("[%s] write data to remote %s failed, %v", sf.request.ConnID, dst, err)
+			if isClosedErr(err) {
+				return
+			}
+		}
+	}
+}
+
+// downstream read datagrams from the remote servers, and write to the client
+func (sf *udpAssociation) downstream() {
+	bufPool := sf.sf.bufferPool.Get()
+	defer func() {
+		sf.bindLn.Close()
+		sf.sf.bufferPool.Put(bufPool)
+	}()
+
+	for {
+		buf := bufPool[:cap(bufPool)]
+		n, remote, err := sf.target.ReadFrom(buf)
+		if err != nil {
+			if isClosedErr(err) {
+				return
+			}
+			continue
+		}
+		client := sf.clientAddr()
+		if client == nil {
+			continue
+		}
+		if sf.sf.udpPacketFilter != nil {
+			spec, err := statute.ParseAddrSpec(client.String())
+			if err != nil || !sf.sf.udpPacketFilter(remote, &spec, buf[:n]) {
+				continue
+			}
+		}
+		sf.touch()
+
+		pkb, err := statute.NewDatagram(remote.String(), buf[:n])
+		if err != nil {
+			continue
+		}
+		if _, err := sf.bindLn.WriteTo(pkb.Bytes(), client); err != nil {
+			sf.sf.logger.Errorf("[%s] write data to client %s failed, %v", sf.request.ConnID, client, err)
+			if isClosedErr(err) {
+				return
+			}
+		}
+	}
+}
+
+// UDPSourceCheck the strictness of the source validation of the udp associate datagrams
+type UDPSourceCheck int
+
+// UDPSourceCheck strictness
+const (
+	// UDPSourceIPPort the source ip must match the client ip of the control tcp connection,
+	// and the port must match the first datagram's. This is the default.
+	UDPSourceIPPort UDPSourceCheck = iota
+	// UDPSourceIP the source ip must match the client ip of the control tcp connection, any port.
+	UDPSourceIP
+	// UDPSourceAny allow any source.
+	UDPSourceAny
+)
+
+// validSource reports whether the datagram comes from the client,
+// the replies are sent to the last valid source.
+func (sf *udpAssociation) validSource(src net.Addr) bool {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	valid := true
+	switch sf.sf.udpSourceCheck {
+	case UDPSourceAny:
+	case UDPSourceIP:
+		valid = sf.matchClientIP(src)
+	default:
+		if sf.client != nil {
+			valid = sf.client.String() == src.String()
+		} else {
+			valid = sf.matchClientIP(src)
+		}
+	}
+	if !valid {
+		sf.sf.debugf("[%s] drop datagram from %v, not the associated client %v", sf.request.ConnID, src, sf.request.RemoteAddr)
+		return false
+	}
+	sf.client = src
+	return true
+}
+
+// matchClientIP reports whether the src ip matches the client ip of the control tcp connection,
+// true if the client ip unknown.
+func (sf *udpAssociation) matchClientIP(src net.Addr) bool {
+	clientIP, _, ok := splitAddr(sf.request.RemoteAddr)
+	if !ok || clientIP == nil {
+		return true
+	}
+	srcIP, _, ok := splitAddr(src)
+	return ok && clientIP.Equal(srcIP)
+}
+
+func (sf *udpAssociation) clientAddr() net.Addr {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	return sf.client
+}
+
+// resolve the datagram's destination, and check whether it is allowed by the rules.
+func (sf *udpAssociation) resolve(dst statute.AddrSpec) (*net.UDPAddr, error) {
+	ctx := sf.ctx
+	if dst.FQDN != "" && !scopedLiteral(&dst) {
+		var err error
+		if ctx, dst.IP, err = sf.lookup(dst.FQDN); err != nil {
+			return nil, err
+		}
+	}
+	dst.NormalizeIPv4Mapped()
+
+	if !sf.declaredDest(dst) {
+		return nil, fmt.Errorf("%w, %v not the declared destination %v", errDatagramDenied, dst.Address(), sf.request.DestAddr)
+	}
+	req := *sf.request
+	req.DestAddr = &dst
+	if _, ok := sf.sf.rules.Allow(ctx, &req); !ok {
+		return nil, fmt.Errorf("%w, %v blocked by rules", errDatagramDenied, dst.Address())
+	}
+	return &net.UDPAddr{IP: dst.IP, Port: dst.Port, Zone: dst.Zone}, nil
+}
+
+// lookup resolves the fqdn through the resolver, the result is memoized for udpResolveTTL,
+// the failure is logged when the resolver fails rather than per datagram.
+func (sf *udpAssociation) lookup(fqdn string) (context.Context, net.IP, error) {
+	now := time.Now()
+	if r, ok := sf.resolved[fqdn]; ok && now.Before(r.expire) {
+		return r.ctx, r.ip, r.err
+	}
+	ctx, ip, err := sf.sf.resolver.Resolve(sf.ctx, fqdn)
+	if err != nil {
+		sf.sf.logger.Errorf("[%s] resolve datagram destination %s failed, %v", sf.request.ConnID, fqdn, err)
+		ctx, err = sf.ctx, fmt.Errorf("%w %s, %v", errDatagramResolve, fqdn, err)
+	}
+	if sf.resolved == nil || len(sf.resolved) >= udpMaxResolved {
+		sf.resolved = make(map[string]udpResolved)
+	}
+	sf.resolved[fqdn] = udpResolved{ctx, ip, err, now.Add(udpResolveTTL)}
+	return ctx, ip, err
+}
+
+// declaredDest reports whether the resolved dst matches the destination declared in the
+// associate request, the zero ip or port declared matches any.
+func (sf *udpAssociation) declaredDest(dst statute.AddrSpec) bool {
+	declared := sf.request.DestAddr
+	if !sf.sf.udpDestRestrict || declared == nil {
+		return true
+	}
+	if len(declared.IP) != 0 && !declared.IP.IsUnspecified() && !declared.IP.Equal(dst.IP) {
+		return false
+	}
+	return declared.Port == 0 || declared.Port == dst.Port
+}
+
+// reassembler reassembles the fragmented datagrams, see rfc1928 section 7
+type reassembler struct {
+	position byte // the position of the last fragment received
+	data     []byte
+	expire   time.Time
+}
+
+// push a fragment, returns the complete datagram at the end of the fragment sequence.
+func (sf *reassembler) push(pk statute.Datagram) (statute.Datagram, bool) {
+	position := pk.Frag & 0x7f
+	if position == 1 {
+		sf.position, sf.data, sf.expire = 0, sf.data[:0], time.Now().Add(fragReassemblyTimeout)
+	}
+	if position != sf.position+1 || time.Now().After(sf.expire) {
+		// out of order or expired, abandon the queue
+		sf.position, sf.data = 0, sf.data[:0]
+		return pk, false
+	}
+	sf.position = position
+	sf.data = append(sf.data, pk.Data...)
+	if pk.Frag&0x80 == 0 {
+		return pk, false
+	}
+
+	pk.Frag, pk.Data = 0, append([]byte(nil), sf.data...)
+	sf.position, sf.data = 0, sf.data[:0]
+	return pk, true
+}
+
+// isClosedErr reports whether the error is caused by use of closed network connection
+func isClosedErr(err error) bool {
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
@@ -0,0 +1,251 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thinkgos/go-socks5/statute"
+)
+
+func TestReassembler(t *testing.T) {
+	dst := statute.AddrSpec{FQDN: "localhost", Port: 8080, AddrType: statute.ATYPDomain}
+	r := reassembler{}
+
+	_, ok := r.push(statute.Datagram{Frag: 1, DstAddr: dst, Data: []byte("pi")})
+	require.False(t, ok)
+	pk, ok := r.push(statute.Datagram{Frag: 0x80 | 2, DstAddr: dst, Data: []byte("ng")})
+	require.True(t, ok)
+	assert.Equal(t, statute.Datagram{DstAddr: dst, Data: []byte("ping")}, pk)
+
+	// out of order, the queue is abandoned
+	_, ok = r.push(statute.Datagram{Frag: 1, DstAddr: dst, Data: []byte("pi")})
+	require.False(t, ok)
+	_, ok = r.push(statute.Datagram{Frag: 3, DstAddr: dst, Data: []byte("ng")})
+	require.False(t, ok)
+	_, ok = r.push(statute.Datagram{Frag: 0x80 | 2, DstAddr: dst, Data: []byte("ng")})
+	require.False(t, ok)
+}
+
+// associate performs the no auth associate handshake, returns the control connection
+func associate(t *testing.T, srvAddr string) net.Conn {
+	conn, _ := associateReply(t, srvAddr)
+	return conn
+}
+
+// associateReply performs the no auth associate handshake,
+// returns the control connection and the reply.
+func associateReply(t *testing.T, srvAddr string) (net.Conn, statute.Reply) {
+	conn, err := net.Dial("tcp", srvAddr)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte{statute.VersionSocks5, 1, statute.MethodNoAuth})
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 2))
+	require.NoError(t, err)
+	req := statute.Request{
+		Version: statute.VersionSocks5,
+		Command: statute.CommandAssociate,
+		DstAddr: statute.AddrSpec{IP: net.IPv4zero, AddrType: statute.ATYPIPv4},
+	}
+	_, err = conn.Write(req.Bytes())
+	require.NoError(t, err)
+	rep, err := statute.ParseReply(conn)
+	require.NoError(t, err)
+	require.Equal(t, statute.RepSuccess, rep.Response)
+	return conn, rep
+}
+
+func TestSOCKS5_Associate_Timeout(t *testing.T) {
+	for _, opt := range []Option{
+		WithUDPTimeout(50 * time.Millisecond),
+		WithUDPMaxLifetime(50 * time.Millisecond),
+	} {
+		srv := NewServer(opt)
+		srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		go srv.Serve(srvLn) // nolint: errcheck
+
+		conn := associate(t, srvLn.Addr().String())
+		// the control connection is closed by the server
+		conn.SetDeadline(time.Now().Add(time.Second)) // nolint: errcheck
+		_, err = conn.Read(make([]byte, 1))
+		require.Equal(t, io.EOF, err)
+		conn.Close()
+		srv.Close()
+	}
+}
+
+func TestSOCKS5_Associate_AdvertisedAddr(t *testing.T) {
+	public := net.ParseIP("203.0.113.7")
+	srv := NewServer(WithUDPAdvertisedAddr(public))
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	conn, rep := associateReply(t, srvLn.Addr().String())
+	defer conn.Close()
+	// the reply carries the public address with the relay port
+	require.True(t, public.Equal(rep.BndAddr.IP))
+	require.NotZero(t, rep.BndAddr.Port)
+}
+
+func TestUDPAssociation_ValidSource(t *testing.T) {
+	client := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+	src := func(ip string, port int) net.Addr {
+		return &net.UDPAddr{IP: net.ParseIP(ip), Port: port}
+	}
+	newAss := func(check UDPSourceCheck) *udpAssociation {
+		return &udpAssociation{
+			sf:      &Server{udpSourceCheck: check, logger: NewLogger(nil)},
+			request: &Request{RemoteAddr: client},
+		}
+	}
+
+	ass := newAss(UDPSourceIPPort)
+	require.False(t, ass.validSource(src("10.0.0.2", 6000)))
+	require.True(t, ass.validSource(src("10.0.0.1", 6000)))
+	require.True(t, ass.validSource(src("10.0.0.1", 6000)))
+	require.False(t, ass.validSource(src("10.0.0.1", 6001)))
+
+	ass = newAss(UDPSourceIP)
+	require.False(t, ass.validSource(src("10.0.0.2", 6000)))
+	require.True(t, ass.validSource(src("10.0.0.1", 6000)))
+	require.True(t, ass.validSource(src("10.0.0.1", 6001)))
+	require.Equal(t, src("10.0.0.1", 6001), ass.clientAddr())
+
+	ass = newAss(UDPSourceAny)
+	require.True(t, ass.validSource(src("10.0.0.2", 6000)))
+	require.True(t, ass.validSource(src("10.0.0.3", 6000)))
+	require.Equal(t, src("10.0.0.3", 6000), ass.clientAddr())
+}
+
+func TestUDPAssociation_DeclaredDest(t *testing.T) {
+	newAss := func(restrict bool, declared statute.AddrSpec) *udpAssociation {
+		return &udpAssociation{
+			sf:      &Server{rules: NewPermitAll(), udpDestRestrict: restrict, logger: NewLogger(nil)},
+			ctx:     context.Background(),
+			request: &Request{Request: statute.Request{Command: statute.CommandAssociate}, DestAddr: &declared},
+		}
+	}
+	dst := func(ip string, port int) statute.AddrSpec {
+		return statute.AddrSpec{IP: net.ParseIP(ip), Port: port, AddrType: statute.ATYPIPv4}
+	}
+
+	ass := newAss(true, dst("10.0.0.1", 53))
+	_, err := ass.resolve(dst("10.0.0.1", 53))
+	require.NoError(t, err)
+	_, err = ass.resolve(dst("10.0.0.2", 53))
+	require.True(t, errors.Is(err, errDatagramDenied))
+	_, err = ass.resolve(dst("10.0.0.1", 54))
+	require.True(t, errors.Is(err, errDatagramDenied))
+
+	// zero port matches any
+	ass = newAss(true, dst("10.0.0.1", 0))
+	_, err = ass.resolve(dst("10.0.0.1", 54))
+	require.NoError(t, err)
+
+	// zero address matches any
+	ass = newAss(true, dst("0.0.0.0", 0))
+	_, err = ass.resolve(dst("10.0.0.2", 54))
+	require.NoError(t, err)
+
+	// not restricted
+	ass = newAss(false, dst("10.0.0.1", 53))
+	_, err = ass.resolve(dst("10.0.0.2", 54))
+	require.NoError(t, err)
+
+	// the scoped literal keeps the zone
+	addr, err := ass.resolve(statute.AddrSpec{FQDN: "fe80::1%eth0", Port: 53, AddrType: statute.ATYPDomain})
+	require.NoError(t, err)
+	require.Equal(t, "[fe80::1%eth0]:53", addr.String())
+
+	// blocked by the rules
+	ass.sf.rules = NewPermitNone()
+	_, err = ass.resolve(dst("10.0.0.2", 54))
+	require.True(t, errors.Is(err, errDatagramDenied))
+}
+
+func TestUDPAssociation_ResolveMemo(t *testing.T) {
+	resolver := &countResolver{}
+	ass := &udpAssociation{
+		sf:      &Server{rules: NewPermitAll(), resolver: resolver, logger: NewLogger(log.New(ioutil.Discard, "", 0))},
+		ctx:     context.Background(),
+		request: &Request{Request: statute.Request{Command: statute.CommandAssociate}},
+	}
+	fqdn := func(name string) statute.AddrSpec {
+		return statute.AddrSpec{FQDN: name, Port: 53, AddrType: statute.ATYPDomain}
+	}
+
+	for i := 0; i < 3; i++ {
+		addr, err := ass.resolve(fqdn("a.test"))
+		require.NoError(t, err)
+		require.Equal(t, "127.0.0.1:53", addr.String())
+		// the failure is memoized too
+		_, err = ass.resolve(fqdn("nxdomain"))
+		require.True(t, errors.Is(err, errDatagramResolve))
+	}
+	require.Equal(t, 2, resolver.count)
+}
+
+func TestSOCKS5_Associate_PacketFilter(t *testing.T) {
+	// udp echo server
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, remote, err := l.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			l.WriteTo(buf[:n], remote) // nolint: errcheck
+		}
+	}()
+	lAddr := l.LocalAddr().(*net.UDPAddr)
+
+	downstream := make(chan string, 2)
+	srv := NewServer(WithUDPPacketFilter(func(from net.Addr, dst *statute.AddrSpec, payload []byte) bool {
+		if from.String() == lAddr.String() {
+			downstream <- string(payload)
+			return true
+		}
+		assert.Equal(t, lAddr.String(), dst.String())
+		return string(payload) != "drop"
+	}))
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	conn, rep := associateReply(t, srvLn.Addr().String())
+	defer conn.Close()
+	udpConn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: rep.BndAddr.Port})
+	require.NoError(t, err)
+	defer udpConn.Close()
+
+	for _, payload := range []string{"drop", "ping"} {
+		pk, err := statute.NewDatagram(lAddr.String(), []byte(payload))
+		require.NoError(t, err)
+		_, err = udpConn.Write(pk.Bytes())
+		require.NoError(t, err)
+	}
+	buf := make([]byte, 1024)
+	udpConn.SetDeadline(time.Now().Add(time.Second)) // nolint: errcheck
+	n, err := udpConn.Read(buf)
+	require.NoError(t, err)
+	pk, err := statute.ParseDatagram(buf[:n])
+	require.NoError(t, err)
+	// the dropped datagram never reaches the remote
+	require.Equal(t, []byte("ping"), pk.Data)
+	require.Equal(t, "ping", <-downstream)
+}
@@ -2,19 +2,60 @@ package socks5
 
 import (
 	"io"
+	"net"
 
 	"github.com/thinkgos/go-socks5/statute"
 )
 
+// The well-known keys of the AuthContext payload
+const (
+	// AuthKeyUsername the username of the username/password auth
+	AuthKeyUsername = "username"
+	// AuthKeyPassword the password of the username/password auth
+	AuthKeyPassword = "password"
+	// AuthKeyPrincipal the peer principal name of the GSSAPI auth,
+	// or the subject common name of the TLS client certificate
+	AuthKeyPrincipal = "principal"
+	// AuthKeyCertSubject the subject of the TLS client certificate
+	AuthKeyCertSubject = "cert_subject"
+	// AuthKeyUserID the unauthenticated userid of the SOCKS4 request
+	AuthKeyUserID = "userid"
+)
+
 // AuthContext A Request encapsulates authentication state provided
 // during negotiation
 type AuthContext struct {
-	// Provided auth method
+	// Provided auth method, always populated
 	Method uint8
-	// Payload provided during negotiation.
+	// Payload provided during negotiation, never nil for the builtin authenticators.
 	// Keys depend on the used auth method.
-	// For UserPass auth contains username/password
+	// For UserPass auth contains AuthKeyUsername/AuthKeyPassword
+	// For GSSAPI auth contains AuthKeyPrincipal
+	// For TLS client certificate auth contains AuthKeyPrincipal/AuthKeyCertSubject
+	// For SOCKS4 contains AuthKeyUserID
 	Payload map[string]string
+	// Encapsulator optional, protect the subsequent traffic after the negotiation.
+	Encapsulator Encapsulator
+}
+
+// Username returns the authenticated identity, the username of the username/password auth
+// or the principal of the GSSAPI and the TLS client certificate auth, empty if unauthenticated.
+// It is nil safe.
+func (a *AuthContext) Username() string {
+	if a == nil {
+		return ""
+	}
+	if username, ok := a.Payload[AuthKeyUsername]; ok {
+		return username
+	}
+	return a.Payload[AuthKeyPrincipal]
+}
+
+// Encapsulator is used to protect the traffic following the method negotiation,
+// such as the GSS-API per-message protection.
+type Encapsulator interface {
+	Reader(r io.Reader) io.Reader
+	Writer(w io.Writer) io.Writer
 }
 
 // Authenticator provide auth
@@ -23,6 +64,14 @@ type Authenticator interface {
 	GetCode() uint8
 }
 
+// ConnAuthenticator is an Authenticator which authenticates by the raw client connection,
+// such as the TLS client certificate, AuthenticateConn is used instead of Authenticate
+// if the server knows the connection.
+type ConnAuthenticator interface {
+	Authenticator
+	AuthenticateConn(conn net.Conn, reader io.Reader, writer io.Writer, userAddr string) (*AuthContext, error)
+}
+
 // NoAuthAuthenticator is used to handle the "No Authentication" mode
 type NoAuthAuthenticator struct{}
 
@@ -32,26 +81,57 @@ func (a NoAuthAuthenticator) GetCode() uint8 { return statute.MethodNoAuth }
 // Authenticate implement interface Authenticator
 func (a NoAuthAuthenticator) Authenticate(_ io.Reader, writer io.Writer, _ string) (*AuthContext, error) {
 	_, err := writer.Write([]byte{statute.VersionSocks5, statute.MethodNoAuth})
-	return &AuthContext{statute.MethodNoAuth, make(map[string]string)}, err
+	return &AuthContext{Method: statute.MethodNoAuth, Payload: make(map[string]string)}, err
 }
 
+// authAttemptError is the failure of the authentication attempt with the method selected,
+// and the user if known, such as the username of the password auth.
+type authAttemptError struct {
+	method uint8
+	user   string
+	err    error
+}
+
+func (e *authAttemptError) Error() string { return e.err.Error() }
+
+func (e *authAttemptError) Unwrap() error { return e.err }
+
 // UserPassAuthenticator is used to handle username/password based
 // authentication
 type UserPassAuthenticator struct {
 	Credentials CredentialStore
 }
 
+// userPassAuthenticator returns the UserPassAuthenticator of the cator, either value or pointer
+func userPassAuthenticator(cator Authenticator) (UserPassAuthenticator, bool) {
+	switch a := cator.(type) {
+	case UserPassAuthenticator:
+		return a, true
+	case *UserPassAuthenticator:
+		if a != nil {
+			return *a, true
+		}
+	}
+	return UserPassAuthenticator{}, false
+}
+
 // GetCode implement interface Authenticator
 func (a UserPassAuthenticator) GetCode() uint8 { return statute.MethodUserPassAuth }
 
 // Authenticate implement interface Authenticator
 func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer, userAddr string) (*AuthContext, error) {
+	return a.authenticate(reader, writer, userAddr, 0, 0)
+}
+
+// authenticate is Authenticate with the username and password length limits of the server
+func (a UserPassAuthenticator) authenticate(reader io.Reader, writer io.Writer, userAddr string,
+	maxUserLen, maxPassLen int) (*AuthContext, error) {
 	// reply the client to use user/pass auth
 	if _, err := writer.Write([]byte{statute.VersionSocks5, statute.MethodUserPassAuth}); err != nil {
 		return nil, err
 	}
 	// get user and user's password
-	nup, err := statute.ParseUserPassRequest(reader)
+	nup, err := statute.ParseUserPassRequestLimit(reader, maxUserLen, maxPassLen)
 	if err != nil {
 		return nil, err
 	}
@@ -61,7 +141,7 @@ func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer,
 		if _, err := writer.Write([]byte{statute.UserPassAuthVersion, statute.AuthFailure}); err != nil {
 			return nil, err
 		}
-		return nil, statute.ErrUserAuthFailed
+		return nil, &authAttemptError{statute.MethodUserPassAuth, string(nup.User), statute.ErrUserAuthFailed}
 	}
 
 	if _, err := writer.Write([]byte{statute.UserPassAuthVersion, statute.AuthSuccess}); err != nil {
@@ -69,10 +149,10 @@ func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer,
 	}
 	// Done
 	return &AuthContext{
-		statute.MethodUserPassAuth,
-		map[string]string{
-			"username": string(nup.User),
-			"password": string(nup.Pass),
+		Method: statute.MethodUserPassAuth,
+		Payload: map[string]string{
+			AuthKeyUsername: string(nup.User),
+			AuthKeyPassword: string(nup.Pass),
 		},
 	}, nil
 }
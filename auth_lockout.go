@@ -0,0 +1,127 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/thinkgos/go-socks5/statute"
+)
+
+// ErrAuthLockedOut is returned by LockoutAuthenticator when the source ip is locked out
+var ErrAuthLockedOut = errors.New("socks5: authentication locked out")
+
+// lockoutGCInterval the interval to collect the expired lockout entries
+const lockoutGCInterval = time.Minute
+
+// LockoutAuthenticator wraps any Authenticator, locks out the source ip temporarily
+// after maxFailures failed authentications within the window. The locked out client
+// is replied with MethodNoAcceptable without invoking the wrapped Authenticator.
+// It is safe for concurrent use.
+type LockoutAuthenticator struct {
+	Authenticator
+	maxFailures int
+	window      time.Duration
+	lockout     time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*lockoutEntry
+	lastGC  time.Time
+	now     func() time.Time
+}
+
+type lockoutEntry struct {
+	failures    int
+	windowStart time.Time
+	lockedUntil time.Time
+}
+
+// NewLockoutAuthenticator new lockout authenticator wraps the authenticator,
+// the source ip is locked out for the lockout duration after maxFailures failures within window.
+func NewLockoutAuthenticator(cator Authenticator, maxFailures int, window, lockout time.Duration) *LockoutAuthenticator {
+	return &LockoutAuthenticator{
+		Authenticator: cator,
+		maxFailures:   maxFailures,
+		window:        window,
+		lockout:       lockout,
+		entries:       make(map[string]*lockoutEntry),
+		now:           time.Now,
+	}
+}
+
+// Authenticate implement interface Authenticator
+func (sf *LockoutAuthenticator) Authenticate(reader io.Reader, writer io.Writer, userAddr string) (*AuthContext, error) {
+	ip := lockoutKey(userAddr)
+	if _, locked := sf.LockedUntil(ip); locked {
+		writer.Write([]byte{statute.VersionSocks5, statute.MethodNoAcceptable}) // nolint: errcheck
+		return nil, ErrAuthLockedOut
+	}
+	authContext, err := sf.Authenticator.Authenticate(reader, writer, userAddr)
+	sf.record(ip, err == nil)
+	return authContext, err
+}
+
+// LockedUntil returns the time until which the ip is locked out, and whether it is locked out now.
+func (sf *LockoutAuthenticator) LockedUntil(ip string) (time.Time, bool) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	if e, ok := sf.entries[ip]; ok && sf.now().Before(e.lockedUntil) {
+		return e.lockedUntil, true
+	}
+	return time.Time{}, false
+}
+
+// Lockouts returns the ips locked out now and the time until which they are locked out.
+func (sf *LockoutAuthenticator) Lockouts() map[string]time.Time {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	now := sf.now()
+	lockouts := make(map[string]time.Time)
+	for ip, e := range sf.entries {
+		if now.Before(e.lockedUntil) {
+			lockouts[ip] = e.lockedUntil
+		}
+	}
+	return lockouts
+}
+
+// record records the authentication result of the ip
+func (sf *LockoutAuthenticator) record(ip string, ok bool) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	now := sf.now()
+	if now.Sub(sf.lastGC) >= lockoutGCInterval {
+		sf.lastGC = now
+		for k, e := range sf.entries {
+			if now.Sub(e.windowStart) >= sf.window && !now.Before(e.lockedUntil) {
+				delete(sf.entries, k)
+			}
+		}
+	}
+
+	if ok {
+		delete(sf.entries, ip)
+		return
+	}
+	e, found := sf.entries[ip]
+	if !found || now.Sub(e.windowStart) >= sf.window {
+		e = &lockoutEntry{windowStart: now}
+		sf.entries[ip] = e
+	}
+	e.failures++
+	if e.failures >= sf.maxFailures {
+		e.lockedUntil = now.Add(sf.lockout)
+		e.failures, e.windowStart = 0, now
+	}
+}
+
+// lockoutKey returns the ip of the user address
+func lockoutKey(userAddr string) string {
+	if host, _, err := net.SplitHostPort(userAddr); err == nil {
+		return host
+	}
+	return userAddr
+}
@@ -0,0 +1,58 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/thinkgos/go-socks5/statute"
+)
+
+func TestLockoutAuthenticator(t *testing.T) {
+	now := time.Unix(1000, 0)
+	cator := NewLockoutAuthenticator(UserPassAuthenticator{StaticCredentials{"foo": "bar"}},
+		2, time.Minute, 10*time.Minute)
+	cator.now = func() time.Time { return now }
+	require.Equal(t, statute.MethodUserPassAuth, cator.GetCode())
+
+	auth := func(addr, pass string) (*bytes.Buffer, error) {
+		req := bytes.NewBuffer(statute.NewUserPassRequest(statute.UserPassAuthVersion, []byte("foo"), []byte(pass)).Bytes())
+		rsp := new(bytes.Buffer)
+		_, err := cator.Authenticate(req, rsp, addr)
+		return rsp, err
+	}
+
+	_, err := auth("10.0.0.1:1000", "wrong")
+	require.True(t, errors.Is(err, statute.ErrUserAuthFailed))
+	_, err = auth("10.0.0.1:1001", "bar")
+	require.NoError(t, err)
+	// the success resets the failures
+	_, err = auth("10.0.0.1:1002", "wrong")
+	require.Error(t, err)
+	_, locked := cator.LockedUntil("10.0.0.1")
+	require.False(t, locked)
+
+	// locked out after 2 failures within the window
+	_, err = auth("10.0.0.1:1003", "wrong")
+	require.Error(t, err)
+	until, locked := cator.LockedUntil("10.0.0.1")
+	require.True(t, locked)
+	require.Equal(t, now.Add(10*time.Minute), until)
+	require.Equal(t, map[string]time.Time{"10.0.0.1": until}, cator.Lockouts())
+
+	rsp, err := auth("10.0.0.1:1004", "bar")
+	require.Equal(t, ErrAuthLockedOut, err)
+	require.Equal(t, []byte{statute.VersionSocks5, statute.MethodNoAcceptable}, rsp.Bytes())
+	// other ip is not affected
+	_, err = auth("10.0.0.2:1000", "bar")
+	require.NoError(t, err)
+
+	// the lockout expires
+	now = now.Add(10 * time.Minute)
+	_, err = auth("10.0.0.1:1005", "bar")
+	require.NoError(t, err)
+	require.Empty(t, cator.Lockouts())
+}
@@ -19,6 +19,8 @@ func TestNoAuth(t *testing.T) {
 	ctx, err := cator.Authenticate(req, rsp, "")
 	require.NoError(t, err)
 	assert.Equal(t, statute.MethodNoAuth, ctx.Method)
+	assert.NotNil(t, ctx.Payload)
+	assert.Empty(t, ctx.Username())
 	assert.Equal(t, []byte{statute.VersionSocks5, statute.MethodNoAuth}, rsp.Bytes())
 }
 
@@ -42,6 +44,7 @@ func TestPasswordAuth_Valid(t *testing.T) {
 	val, ok = ctx.Payload["password"]
 	require.True(t, ok)
 	require.Equal(t, "bar", val)
+	require.Equal(t, "foo", ctx.Username())
 
 	assert.Equal(t, []byte{statute.VersionSocks5, statute.MethodUserPassAuth, 1, statute.AuthSuccess}, rsp.Bytes())
 }
@@ -61,3 +64,13 @@ func TestPasswordAuth_Invalid(t *testing.T) {
 
 	assert.Equal(t, []byte{statute.VersionSocks5, statute.MethodUserPassAuth, 1, statute.AuthFailure}, rsp.Bytes())
 }
+
+func TestAuthContext_Username(t *testing.T) {
+	var nilCtx *AuthContext
+	require.Empty(t, nilCtx.Username())
+	require.Empty(t, (&AuthContext{}).Username())
+	require.Equal(t, "alice@EXAMPLE.COM",
+		(&AuthContext{Payload: map[string]string{AuthKeyPrincipal: "alice@EXAMPLE.COM"}}).Username())
+	// the unauthenticated SOCKS4 userid is not an identity
+	require.Empty(t, (&AuthContext{Payload: map[string]string{AuthKeyUserID: "bob"}}).Username())
+}
@@ -0,0 +1,55 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/thinkgos/go-socks5/statute"
+)
+
+// ErrNoVerifiedCert the client has no verified TLS client certificate
+var ErrNoVerifiedCert = errors.New("no verified tls client certificate")
+
+// TLSClientCertAuthenticator authenticates the clients of the SOCKS5-over-TLS by their
+// TLS client certificate, which is verified by the tls.Config of the listener, such as
+// tls.RequireAndVerifyClientCert with the ClientCAs. The "No Authentication" method is
+// selected on the wire, the subject common name of the certificate is the identity.
+type TLSClientCertAuthenticator struct{}
+
+// GetCode implement interface Authenticator
+func (a TLSClientCertAuthenticator) GetCode() uint8 { return statute.MethodNoAuth }
+
+// Authenticate implement interface Authenticator, always fails without the connection.
+func (a TLSClientCertAuthenticator) Authenticate(_ io.Reader, writer io.Writer, _ string) (*AuthContext, error) {
+	writer.Write([]byte{statute.VersionSocks5, statute.MethodNoAcceptable}) // nolint: errcheck
+	return nil, ErrNoVerifiedCert
+}
+
+// AuthenticateConn implement interface ConnAuthenticator
+func (a TLSClientCertAuthenticator) AuthenticateConn(conn net.Conn, reader io.Reader, writer io.Writer, userAddr string) (*AuthContext, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return a.Authenticate(reader, writer, userAddr)
+	}
+	// the handshake has been completed by reading the method request usually
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return a.Authenticate(reader, writer, userAddr)
+	}
+	cert := state.VerifiedChains[0][0]
+	if _, err := writer.Write([]byte{statute.VersionSocks5, statute.MethodNoAuth}); err != nil {
+		return nil, err
+	}
+	return &AuthContext{
+		Method: statute.MethodNoAuth,
+		Payload: map[string]string{
+			AuthKeyPrincipal:   cert.Subject.CommonName,
+			AuthKeyCertSubject: cert.Subject.String(),
+		},
+	}, nil
+}
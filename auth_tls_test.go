@@ -0,0 +1,96 @@
+package socks5
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+)
+
+// clientCert returns a self-signed client certificate with the common name
+func clientCert(t *testing.T, cn string) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"socks5"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+func TestTLSClientCertAuthenticator(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn) // nolint: errcheck
+			}()
+		}
+	}()
+
+	tlsCert, cert := clientCert(t, "alice")
+	cfg := selfSignedTLSConfig(t)
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	cfg.ClientCAs = x509.NewCertPool()
+	cfg.ClientCAs.AddCert(cert)
+
+	entries := make(chan AccessLogEntry, 1)
+	srv := NewServer(
+		WithAuthMethods([]Authenticator{TLSClientCertAuthenticator{}}),
+		WithRequireAuth(true),
+		WithAccessLogger(func(entry AccessLogEntry) { entries <- entry }),
+	)
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(tls.NewListener(srvLn, cfg)) // nolint: errcheck
+	defer srv.Close()
+
+	// the certificate subject is the identity
+	dial, err := proxy.SOCKS5("tcp", srvLn.Addr().String(), nil,
+		tlsDialer{&tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{tlsCert}}}) // nolint: gosec
+	require.NoError(t, err)
+	conn, err := dial.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 4))
+	require.NoError(t, err)
+	conn.Close()
+	select {
+	case entry := <-entries:
+		require.Equal(t, "alice", entry.Username)
+	case <-time.After(time.Second):
+		t.Fatal("no access log entry")
+	}
+
+	// no client certificate
+	dial, err = proxy.SOCKS5("tcp", srvLn.Addr().String(), nil,
+		tlsDialer{&tls.Config{InsecureSkipVerify: true}}) // nolint: gosec
+	require.NoError(t, err)
+	_, err = dial.Dial("tcp", l.Addr().String())
+	require.Error(t, err)
+}
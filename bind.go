@@ -0,0 +1,107 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/thinkgos/go-socks5/statute"
+)
+
+// DefaultBindHandler is the built-in handler of the bind command,
+// a handler set by WithBindHandle can call it to keep the default behavior.
+func (sf *Server) DefaultBindHandler(ctx context.Context, writer io.Writer, request *Request) error {
+	ln, err := request.ListenTCP()
+	if err != nil {
+		if err := SendReply(writer, statute.RepServerFailure, nil); err != nil {
+			return fmt.Errorf("failed to send reply, %v", err)
+		}
+		return fmt.Errorf("listen tcp failed, %v", err)
+	}
+	defer ln.Close()
+
+	// the first reply with the address the server listen on
+	if err = SendReply(writer, statute.RepSuccess, ln.Addr()); err != nil {
+		return fmt.Errorf("failed to send reply, %v", err)
+	}
+
+	// wait for the inbound connection
+	if sf.bindAcceptTimeout > 0 {
+		ln.SetDeadline(time.Now().Add(sf.bindAcceptTimeout)) // nolint: errcheck
+	}
+	// the client disconnected while waiting closes the listener too
+	wctx, stop := watchClient(ctx, request)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-wctx.Done():
+			ln.Close()
+		case <-done:
+		}
+	}()
+	target, err := sf.acceptBindPeer(ln, request)
+	close(done)
+	stop()
+	if err != nil && wctx.Err() != nil && ctx.Err() == nil {
+		return fmt.Errorf("%w, bind accept aborted", ErrClientGone)
+	}
+	if err != nil {
+		resp := statute.RepServerFailure
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			resp = statute.RepTTLExpired
+		}
+		sf.delayReply()
+		if err := SendReply(writer, resp, nil); err != nil {
+			return fmt.Errorf("failed to send reply, %v", err)
+		}
+		return fmt.Errorf("bind accept failed, %v", err)
+	}
+	defer target.Close()
+	ln.Close()
+	if sf.connTuner != nil {
+		sf.connTuner(target, SideUpstream)
+	}
+
+	// the second reply with the address of the connecting host
+	sf.delayReply()
+	if err = SendReply(writer, statute.RepSuccess, target.RemoteAddr()); err != nil {
+		return fmt.Errorf("failed to send reply, %v", err)
+	}
+	enterPhase(ctx, &sf.stats.relaying)
+	return sf.relay(ctx, writer, request, target)
+}
+
+// acceptBindPeer accept exactly one inbound connection, if bindPeerCheck enabled,
+// the connections not from the requested peer ip are refused.
+func (sf *Server) acceptBindPeer(ln *net.TCPListener, request *Request) (net.Conn, error) {
+	for {
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			return nil, err
+		}
+		peerIP := request.DestAddr.IP
+		if !sf.bindPeerCheck || len(peerIP) == 0 || peerIP.IsUnspecified() ||
+			peerIP.Equal(conn.RemoteAddr().(*net.TCPAddr).IP) {
+			return conn, nil
+		}
+		sf.logger.Errorf("[%s] bind: refuse connection from %s, expect %s", request.ConnID, conn.RemoteAddr(), peerIP)
+		conn.Close()
+	}
+}
+
+// listenIP returns the ip which the bind or udp associate listen on,
+// use the bind address selector or bindIP if provided, otherwise the local ip of the tcp connection.
+func (sf *Server) listenIP(request *Request) net.IP {
+	if ip := sf.bindAddr(request); ip != nil {
+		return ip
+	}
+	if len(sf.bindIP) != 0 {
+		return sf.bindIP
+	}
+	if tcpAddr, ok := request.LocalAddr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thinkgos/go-socks5/statute"
+)
+
+func bindRequest(t *testing.T, srv *Server) net.Conn {
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+
+	conn, err := net.Dial("tcp", srvLn.Addr().String())
+	require.NoError(t, err)
+
+	req := statute.Request{
+		Version: statute.VersionSocks5,
+		Command: statute.CommandBind,
+		DstAddr: statute.AddrSpec{IP: net.IPv4(127, 0, 0, 1), Port: 0, AddrType: statute.ATYPIPv4},
+	}
+	conn.Write(append([]byte{statute.VersionSocks5, 1, statute.MethodNoAuth}, req.Bytes()...)) // nolint: errcheck
+	conn.SetDeadline(time.Now().Add(time.Second))                                              // nolint: errcheck
+
+	mr, err := statute.ParseMethodReply(conn)
+	require.NoError(t, err)
+	require.Equal(t, statute.MethodNoAuth, mr.Method)
+	return conn
+}
+
+func TestSOCKS5_Bind(t *testing.T) {
+	srv := NewServer(WithBindPeerCheck(true))
+	defer srv.Close()
+	conn := bindRequest(t, srv)
+	defer conn.Close()
+
+	// first reply with the listen address
+	rsp, err := statute.ParseReply(conn)
+	require.NoError(t, err)
+	require.Equal(t, statute.RepSuccess, rsp.Response)
+
+	// the remote host connects to the listen address
+	peer, err := net.Dial("tcp", rsp.BndAddr.String())
+	require.NoError(t, err)
+	defer peer.Close()
+
+	// second reply with the remote host address
+	rsp, err = statute.ParseReply(conn)
+	require.NoError(t, err)
+	require.Equal(t, statute.RepSuccess, rsp.Response)
+	assert.Equal(t, peer.LocalAddr().String(), rsp.BndAddr.String())
+
+	// relay
+	peer.Write([]byte("ping")) // nolint: errcheck
+	out := make([]byte, 4)
+	_, err = io.ReadFull(conn, out)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("ping"), out)
+
+	conn.Write([]byte("pong"))                    // nolint: errcheck
+	peer.SetDeadline(time.Now().Add(time.Second)) // nolint: errcheck
+	_, err = io.ReadFull(peer, out)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("pong"), out)
+}
+
+func TestSOCKS5_Bind_Timeout(t *testing.T) {
+	srv := NewServer(WithBindAcceptTimeout(50 * time.Millisecond))
+	defer srv.Close()
+	conn := bindRequest(t, srv)
+	defer conn.Close()
+
+	rsp, err := statute.ParseReply(conn)
+	require.NoError(t, err)
+	require.Equal(t, statute.RepSuccess, rsp.Response)
+
+	// nothing connects in time
+	rsp, err = statute.ParseReply(conn)
+	require.NoError(t, err)
+	require.Equal(t, statute.RepTTLExpired, rsp.Response)
+}
+
+func TestSOCKS5_Bind_ClientGone(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	conn := bindRequest(t, srv)
+
+	rsp, err := statute.ParseReply(conn)
+	require.NoError(t, err)
+	require.Equal(t, statute.RepSuccess, rsp.Response)
+	require.Equal(t, int64(1), srv.ActiveConns())
+
+	// the client disconnects while waiting for the peer, the handler returns
+	conn.Close()
+	require.Eventually(t, func() bool {
+		return srv.ActiveConns() == 0
+	}, time.Second, 10*time.Millisecond)
+	// the listener is closed
+	_, err = net.DialTimeout("tcp", rsp.BndAddr.String(), time.Second)
+	require.Error(t, err)
+}
+
+func TestSOCKS5_Bind_UserHandle(t *testing.T) {
+	srv := NewServer(
+		WithBindIP(net.IPv4(127, 0, 0, 1)),
+		WithBindHandle(func(ctx context.Context, writer io.Writer, request *Request) error {
+			ln, err := request.ListenTCP()
+			if err != nil {
+				return ReplyError{statute.RepServerFailure, err}
+			}
+			defer ln.Close()
+			return SendReply(writer, statute.RepSuccess, ln.Addr())
+		}),
+	)
+	defer srv.Close()
+	conn := bindRequest(t, srv)
+	defer conn.Close()
+
+	// the user's handler listens on the bind ip
+	rsp, err := statute.ParseReply(conn)
+	require.NoError(t, err)
+	require.Equal(t, statute.RepSuccess, rsp.Response)
+	assert.Equal(t, "127.0.0.1", rsp.BndAddr.IP.String())
+	assert.NotZero(t, rsp.BndAddr.Port)
+}
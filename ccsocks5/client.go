@@ -1,6 +1,7 @@
 package ccsocks5
 
 import (
+	"context"
 	"errors"
 	"net"
 	"time"
@@ -48,29 +49,40 @@ func (sf *Client) Close() (err error) {
 
 // Dial connects to the address on the named network through proxy , with socks5 handshake.
 func (sf *Client) Dial(network, addr string) (net.Conn, error) {
-	if network == "tcp" {
-		return sf.DialTCP(network, addr)
-	}
-	if network == "udp" {
-		return sf.DialUDP(network, nil, addr)
+	return sf.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to the address on the named network through proxy , with socks5 handshake.
+// The ctx bounds the connection to the proxy and the handshake, not the established connection.
+func (sf *Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return sf.dialTCP(ctx, network, addr)
+	case "udp", "udp4", "udp6":
+		return sf.dialUDP(ctx, network, nil, addr)
 	}
 	return nil, errors.New("not support network")
 }
 
 // DialTCP connects to the address on the named network through proxy , with socks5 handshake.
 func (sf *Client) DialTCP(network, addr string) (net.Conn, error) {
+	return sf.dialTCP(context.Background(), network, addr)
+}
+
+func (sf *Client) dialTCP(ctx context.Context, network, addr string) (net.Conn, error) {
 	conn := *sf // clone a client
 
 	remoteAddress, err := net.ResolveTCPAddr(network, addr)
 	if err != nil {
 		return nil, err
 	}
-	conn.proxyConn, err = net.Dial(network, sf.proxyAddr)
+	var d net.Dialer
+	conn.proxyConn, err = d.DialContext(ctx, "tcp", sf.proxyAddr)
 	if err != nil {
 		return nil, err
 	}
 
-	if _, err := conn.handshake(statute.CommandConnect, addr); err != nil {
+	if _, err := conn.handshakeContext(ctx, statute.CommandConnect, addr); err != nil {
 		conn.Close()
 		return nil, err
 	}
@@ -83,18 +95,24 @@ func (sf *Client) DialTCP(network, addr string) (net.Conn, error) {
 
 // DialUDP connects to the address on the named network through proxy , with socks5 handshake.
 func (sf *Client) DialUDP(network string, laddr *net.UDPAddr, raddr string) (net.Conn, error) {
+	return sf.dialUDP(context.Background(), network, laddr, raddr)
+}
+
+func (sf *Client) dialUDP(ctx context.Context, network string, laddr *net.UDPAddr, raddr string) (net.Conn, error) {
 	conn := *sf // clone a client
 
 	remoteAddress, err := net.ResolveUDPAddr(network, raddr)
 	if err != nil {
 		return nil, err
 	}
-	conn.proxyConn, err = net.Dial("tcp", sf.proxyAddr)
+	var d net.Dialer
+	conn.proxyConn, err = d.DialContext(ctx, "tcp", sf.proxyAddr)
 	if err != nil {
 		return nil, err
 	}
-	bndAddress, err := conn.handshake(statute.CommandAssociate, raddr)
+	bndAddress, err := conn.handshakeContext(ctx, statute.CommandAssociate, raddr)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
@@ -126,6 +144,30 @@ func (sf *Client) DialUDP(network string, laddr *net.UDPAddr, raddr string) (net
 	return &Associate{&conn}, nil
 }
 
+// handshakeContext the handshake is interrupted when ctx is done
+func (sf *Client) handshakeContext(ctx context.Context, command byte, addr string) (string, error) {
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			sf.proxyConn.SetDeadline(time.Now()) // nolint: errcheck
+		case <-done:
+		}
+	}()
+	bndAddress, err := sf.handshake(command, addr)
+	close(done)
+	<-stopped
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", err
+	}
+	sf.proxyConn.SetDeadline(time.Time{}) // nolint: errcheck
+	return bndAddress, nil
+}
+
 func (sf *Client) handshake(command byte, addr string) (string, error) {
 	methods := statute.MethodNoAuth
 	if sf.auth != nil {
@@ -0,0 +1,147 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ConnPool provides the reused connections to the destinations of the connect command.
+// It is only safe for the protocols the user knows are poolable, such as the idempotent
+// request/response protocols with keep-alive, so it is opt-in per destination by Poolable.
+// The relay of a pooled connection finishes once the client finished, the target is
+// never half-closed. If the target had not answered the last bytes of the client by then,
+// the connection is given back with a non-nil error, so its late response never reaches
+// the next client.
+type ConnPool interface {
+	// Poolable reports whether the connections to the address can be reused
+	Poolable(network, addr string) bool
+	// Get returns a healthy idle connection to the address,
+	// false to let the server dial a fresh one.
+	Get(network, addr string) (net.Conn, bool)
+	// Put gives back the connection of a poolable destination once the relay finished,
+	// err is the error ends the relay or the response outstanding, the pool keeps it for
+	// reuse or closes it, the connection with a non-nil err must be closed.
+	Put(conn net.Conn, err error)
+}
+
+// IdleConnPool is a ConnPool keeps the idle connections per destination address,
+// the connection is checked healthy before handed back. It is safe for concurrent use.
+type IdleConnPool struct {
+	addrs       map[string]bool
+	maxIdle     int
+	idleTimeout time.Duration
+
+	mu   sync.Mutex
+	idle map[string][]idleConn
+}
+
+type idleConn struct {
+	net.Conn
+	since time.Time
+}
+
+// NewIdleConnPool returns a IdleConnPool pools the connections to the addrs("ip:port" dialed),
+// keeps at most maxIdle idle connections per address, and closes the connections idle
+// longer than idleTimeout, zero means no timeout.
+func NewIdleConnPool(maxIdle int, idleTimeout time.Duration, addrs ...string) *IdleConnPool {
+	m := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		m[addr] = true
+	}
+	return &IdleConnPool{
+		addrs:       m,
+		maxIdle:     maxIdle,
+		idleTimeout: idleTimeout,
+		idle:        make(map[string][]idleConn),
+	}
+}
+
+// Poolable implement interface ConnPool
+func (sf *IdleConnPool) Poolable(network, addr string) bool {
+	return network == "tcp" && sf.addrs[addr]
+}
+
+// Get implement interface ConnPool
+func (sf *IdleConnPool) Get(_, addr string) (net.Conn, bool) {
+	for {
+		sf.mu.Lock()
+		conns := sf.idle[addr]
+		if len(conns) == 0 {
+			sf.mu.Unlock()
+			return nil, false
+		}
+		// the most recently used first
+		c := conns[len(conns)-1]
+		sf.idle[addr] = conns[:len(conns)-1]
+		sf.mu.Unlock()
+
+		if (sf.idleTimeout > 0 && time.Since(c.since) > sf.idleTimeout) || !healthy(c.Conn) {
+			c.Close()
+			continue
+		}
+		return c.Conn, true
+	}
+}
+
+// Put implement interface ConnPool
+func (sf *IdleConnPool) Put(conn net.Conn, err error) {
+	addr := conn.RemoteAddr().String()
+	if err != nil || !sf.addrs[addr] {
+		conn.Close()
+		return
+	}
+	sf.mu.Lock()
+	if len(sf.idle[addr]) >= sf.maxIdle {
+		sf.mu.Unlock()
+		conn.Close()
+		return
+	}
+	sf.idle[addr] = append(sf.idle[addr], idleConn{conn, time.Now()})
+	sf.mu.Unlock()
+}
+
+// Close closes all the idle connections
+func (sf *IdleConnPool) Close() error {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	for addr, conns := range sf.idle {
+		for _, c := range conns {
+			c.Close()
+		}
+		delete(sf.idle, addr)
+	}
+	return nil
+}
+
+// errResponseOutstanding is given back to the ConnPool with the connection whose response
+// may still be in flight, it must not be reused.
+var errResponseOutstanding = errors.New("socks5: pooled connection response outstanding")
+
+// activityReader calls onRead on every successful read
+type activityReader struct {
+	io.Reader
+	onRead func()
+}
+
+func (sf *activityReader) Read(b []byte) (int, error) {
+	n, err := sf.Reader.Read(b)
+	if n > 0 {
+		sf.onRead()
+	}
+	return n, err
+}
+
+// healthy reports whether the idle connection is still usable, that is
+// neither closed by the peer nor any unsolicited data pending.
+func healthy(conn net.Conn) bool {
+	if err := conn.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return false
+	}
+	_, err := conn.Read(make([]byte, 1))
+	conn.SetReadDeadline(time.Time{}) // nolint: errcheck
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
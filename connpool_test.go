@@ -0,0 +1,140 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+)
+
+func TestIdleConnPool(t *testing.T) {
+	// the backend answers each "ping" with "pong" on a keep-alive connection
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	var accepted int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 4)
+				for {
+					if _, err := io.ReadFull(conn, buf); err != nil {
+						return
+					}
+					conn.Write([]byte("pong")) // nolint: errcheck
+				}
+			}()
+		}
+	}()
+
+	pool := NewIdleConnPool(1, time.Minute, l.Addr().String())
+	defer pool.Close()
+	srv := NewServer(WithConnPool(pool))
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	dial, err := proxy.SOCKS5("tcp", srvLn.Addr().String(), nil, proxy.Direct)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		conn, err := dial.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		_, err = conn.Write([]byte("ping"))
+		require.NoError(t, err)
+		out := make([]byte, 4)
+		_, err = io.ReadFull(conn, out)
+		require.NoError(t, err)
+		require.Equal(t, []byte("pong"), out)
+		conn.Close()
+
+		// the connection is given back to the pool
+		require.Eventually(t, func() bool {
+			pool.mu.Lock()
+			defer pool.mu.Unlock()
+			return len(pool.idle[l.Addr().String()]) == 1
+		}, time.Second, 10*time.Millisecond)
+	}
+	require.Equal(t, int32(1), atomic.LoadInt32(&accepted))
+
+	// the closed connection is not handed back
+	c, ok := pool.Get("tcp", l.Addr().String())
+	require.True(t, ok)
+	c.Close()
+	pool.Put(c, nil)
+	_, ok = pool.Get("tcp", l.Addr().String())
+	require.False(t, ok)
+}
+
+func TestIdleConnPool_LateResponse(t *testing.T) {
+	// the backend answers each "ping" with "pong" late, after the client closed
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	var accepted int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 4)
+				for {
+					if _, err := io.ReadFull(conn, buf); err != nil {
+						return
+					}
+					time.Sleep(100 * time.Millisecond)
+					conn.Write([]byte("pong")) // nolint: errcheck
+				}
+			}()
+		}
+	}()
+
+	pool := NewIdleConnPool(1, time.Minute, l.Addr().String())
+	defer pool.Close()
+	srv := NewServer(WithConnPool(pool))
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	dial, err := proxy.SOCKS5("tcp", srvLn.Addr().String(), nil, proxy.Direct)
+	require.NoError(t, err)
+
+	// the client closes before the response
+	conn, err := dial.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	conn.Close()
+	require.Eventually(t, func() bool {
+		return srv.ActiveConns() == 0
+	}, time.Second, 10*time.Millisecond)
+
+	// the connection with the response outstanding is not pooled
+	pool.mu.Lock()
+	require.Empty(t, pool.idle[l.Addr().String()])
+	pool.mu.Unlock()
+
+	// the next client never reads the late response of the previous one
+	conn, err = dial.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond)) // nolint: errcheck
+	_, err = conn.Read(make([]byte, 4))
+	require.Error(t, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(&accepted))
+}
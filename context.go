@@ -0,0 +1,75 @@
+package socks5
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"time"
+)
+
+// contextKey is a value for use with context.WithValue
+type contextKey struct {
+	name string
+}
+
+func (k *contextKey) String() string { return "socks5 context value " + k.name }
+
+// The well-known context keys, the values are always set before the RuleSet
+// and the handlers of the command (including the user's) run.
+var (
+	// RequestContextKey the associated value type is *Request
+	RequestContextKey = &contextKey{"request"}
+	// RemoteAddrContextKey the associated value type is net.Addr, the client address
+	RemoteAddrContextKey = &contextKey{"remote-addr"}
+	// AuthContextKey the associated value type is *AuthContext,
+	// which is nil if the request is not authenticated
+	AuthContextKey = &contextKey{"auth-context"}
+	// ConnIDContextKey the associated value type is string, the unique id of the connection,
+	// set from the start of ServeConn, see Request.ConnID.
+	ConnIDContextKey = &contextKey{"conn-id"}
+)
+
+// newConnID returns a short random id to tell the connection in the logs
+func newConnID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// withRequest returns a copy of ctx carries the request values
+func withRequest(ctx context.Context, req *Request) context.Context {
+	ctx = context.WithValue(ctx, RequestContextKey, req)
+	ctx = context.WithValue(ctx, RemoteAddrContextKey, req.RemoteAddr)
+	if req.ConnID != "" {
+		ctx = context.WithValue(ctx, ConnIDContextKey, req.ConnID)
+	}
+	return context.WithValue(ctx, AuthContextKey, req.AuthContext)
+}
+
+// RequestFromContext returns the request in ctx if any
+func RequestFromContext(ctx context.Context) (*Request, bool) {
+	req, ok := ctx.Value(RequestContextKey).(*Request)
+	return req, ok && req != nil
+}
+
+// RemoteAddrFromContext returns the client address in ctx if any
+func RemoteAddrFromContext(ctx context.Context) (net.Addr, bool) {
+	addr, ok := ctx.Value(RemoteAddrContextKey).(net.Addr)
+	return addr, ok && addr != nil
+}
+
+// ConnIDFromContext returns the id of the connection in ctx if any
+func ConnIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(ConnIDContextKey).(string)
+	return id, ok && id != ""
+}
+
+// AuthContextFromContext returns the auth context in ctx if any
+func AuthContextFromContext(ctx context.Context) (*AuthContext, bool) {
+	authContext, ok := ctx.Value(AuthContextKey).(*AuthContext)
+	return authContext, ok && authContext != nil
+}
@@ -0,0 +1,98 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+
+	"github.com/thinkgos/go-socks5/statute"
+)
+
+func TestContextValues(t *testing.T) {
+	got := make(chan context.Context, 1)
+	srv := NewServer(
+		WithCredential(StaticCredentials{"foo": "bar"}),
+		WithConnectHandle(func(ctx context.Context, writer io.Writer, request *Request) error {
+			got <- ctx
+			return SendReply(writer, statute.RepSuccess, &net.TCPAddr{IP: net.IPv4zero})
+		}),
+	)
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	dial, err := proxy.SOCKS5("tcp", srvLn.Addr().String(), &proxy.Auth{User: "foo", Password: "bar"}, proxy.Direct)
+	require.NoError(t, err)
+	conn, err := dial.Dial("tcp", "127.0.0.1:80")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx := <-got
+	req, ok := RequestFromContext(ctx)
+	require.True(t, ok)
+	require.Equal(t, "127.0.0.1:80", req.DestAddr.String())
+	remote, ok := RemoteAddrFromContext(ctx)
+	require.True(t, ok)
+	require.Equal(t, conn.LocalAddr().String(), remote.String())
+	authContext, ok := AuthContextFromContext(ctx)
+	require.True(t, ok)
+	require.Equal(t, "foo", authContext.Username())
+	id, ok := ConnIDFromContext(ctx)
+	require.True(t, ok)
+	require.Equal(t, req.ConnID, id)
+
+	_, ok = RequestFromContext(context.Background())
+	require.False(t, ok)
+	_, ok = RemoteAddrFromContext(context.Background())
+	require.False(t, ok)
+	_, ok = AuthContextFromContext(context.Background())
+	require.False(t, ok)
+	_, ok = ConnIDFromContext(context.Background())
+	require.False(t, ok)
+}
+
+// lineLogger sends the error lines
+type lineLogger chan string
+
+func (sf lineLogger) Errorf(format string, args ...interface{}) { sf <- fmt.Sprintf(format, args...) }
+
+func TestServer_ConnID(t *testing.T) {
+	ids := make(chan string, 2)
+	entries := make(chan AccessLogEntry, 2)
+	logs := make(lineLogger, 2)
+	srv := NewServer(
+		WithLogger(logs),
+		WithAccessLogger(func(entry AccessLogEntry) { entries <- entry }),
+		WithConnectHandle(func(ctx context.Context, writer io.Writer, request *Request) error {
+			ids <- request.ConnID
+			return ReplyError{statute.RepHostUnreachable, errors.New("unreachable")}
+		}),
+	)
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	dial, err := proxy.SOCKS5("tcp", srvLn.Addr().String(), nil, proxy.Direct)
+	require.NoError(t, err)
+	var seen []string
+	for i := 0; i < 2; i++ {
+		_, err = dial.Dial("tcp", "127.0.0.1:80")
+		require.Error(t, err)
+
+		id := <-ids
+		require.NotEmpty(t, id)
+		require.NotContains(t, seen, id)
+		seen = append(seen, id)
+		// the access log and the log lines of the connection carry its id
+		require.Equal(t, id, (<-entries).ConnID)
+		require.Contains(t, <-logs, "["+id+"]")
+	}
+}
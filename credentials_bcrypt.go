@@ -0,0 +1,72 @@
+package socks5
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyBcryptHash is compared for the unknown user, so the response time
+// does not reveal whether the user exists. It is generated lazily.
+var (
+	dummyBcryptHash     []byte
+	dummyBcryptHashOnce sync.Once
+)
+
+// BcryptCredentialStore is a CredentialStore which compares the password
+// against the bcrypt hashes. bcrypt is intentionally slow, so the concurrent
+// comparisons can be bounded to avoid the CPU exhausted by the auth attempts,
+// see also WithPerIPRateLimit.
+type BcryptCredentialStore struct {
+	hashes map[string][]byte
+	sem    chan struct{}
+}
+
+// NewBcryptCredentialStore new bcrypt credential store with the user to bcrypt hash map,
+// at most maxConcurrent comparisons run at the same time, <= 0 means unlimited.
+func NewBcryptCredentialStore(hashes map[string]string, maxConcurrent int) *BcryptCredentialStore {
+	sf := &BcryptCredentialStore{
+		hashes: make(map[string][]byte, len(hashes)),
+	}
+	for user, hash := range hashes {
+		sf.hashes[user] = []byte(hash)
+	}
+	if maxConcurrent > 0 {
+		sf.sem = make(chan struct{}, maxConcurrent)
+	}
+	return sf
+}
+
+// LoadBcryptCredentialStore loads the bcrypt credential store from the htpasswd-style file,
+// one "user:bcrypt-hash" per line, see NewBcryptCredentialStore.
+func LoadBcryptCredentialStore(path string, maxConcurrent int) (*BcryptCredentialStore, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hashes, err := parseCredentials(f)
+	if err != nil {
+		return nil, fmt.Errorf("credential file %s: %v", path, err)
+	}
+	return NewBcryptCredentialStore(hashes, maxConcurrent), nil
+}
+
+// Valid implement interface CredentialStore
+func (sf *BcryptCredentialStore) Valid(user, password, _ string) bool {
+	if sf.sem != nil {
+		sf.sem <- struct{}{}
+		defer func() { <-sf.sem }()
+	}
+	hash, ok := sf.hashes[user]
+	if !ok {
+		dummyBcryptHashOnce.Do(func() {
+			dummyBcryptHash, _ = bcrypt.GenerateFromPassword([]byte("socks5"), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(dummyBcryptHash, []byte(password)) // nolint: errcheck
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
@@ -0,0 +1,32 @@
+package socks5
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestBcryptCredentialStore(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("bar"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	store := NewBcryptCredentialStore(map[string]string{"foo": string(hash)}, 1)
+	require.True(t, store.Valid("foo", "bar", ""))
+	require.False(t, store.Valid("foo", "baz", ""))
+	require.False(t, store.Valid("unknown", "bar", ""))
+
+	dir, err := ioutil.TempDir("", "socks5")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "passwd")
+	require.NoError(t, ioutil.WriteFile(path, []byte("foo:"+string(hash)+"\n"), 0600))
+
+	store, err = LoadBcryptCredentialStore(path, 0)
+	require.NoError(t, err)
+	require.True(t, store.Valid("foo", "bar", ""))
+	require.False(t, store.Valid("foo", "baz", ""))
+}
@@ -0,0 +1,124 @@
+package socks5
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileCredentialStore is a CredentialStore backed by an htpasswd-style file,
+// one "user:password" per line, the empty lines and the lines start with '#' are ignored.
+// The file is reloaded atomically once it changed, checked periodically,
+// so the revoked users are rejected on their next connection. Replace the file
+// by rename to avoid loading a partially written file. It is safe for concurrent use.
+type FileCredentialStore struct {
+	path string
+
+	mu      sync.RWMutex
+	creds   map[string]string
+	modTime time.Time
+	size    int64
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// NewFileCredentialStore loads the credentials from the file, and checks the file
+// changes every interval if interval > 0, call Close to stop checking.
+func NewFileCredentialStore(path string, interval time.Duration) (*FileCredentialStore, error) {
+	sf := &FileCredentialStore{
+		path: path,
+		done: make(chan struct{}),
+	}
+	if err := sf.Reload(); err != nil {
+		return nil, err
+	}
+	if interval > 0 {
+		go sf.watch(interval)
+	}
+	return sf, nil
+}
+
+// Valid implement interface CredentialStore
+func (sf *FileCredentialStore) Valid(user, password, _ string) bool {
+	sf.mu.RLock()
+	pass, ok := sf.creds[user]
+	sf.mu.RUnlock()
+	return ok && password == pass
+}
+
+// Reload reloads the credentials from the file unconditionally,
+// the current credentials are kept if failed.
+func (sf *FileCredentialStore) Reload() error {
+	f, err := os.Open(sf.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	creds, err := parseCredentials(f)
+	if err != nil {
+		return fmt.Errorf("credential file %s: %v", sf.path, err)
+	}
+	sf.mu.Lock()
+	sf.creds, sf.modTime, sf.size = creds, info.ModTime(), info.Size()
+	sf.mu.Unlock()
+	return nil
+}
+
+// Close stops checking the file changes
+func (sf *FileCredentialStore) Close() error {
+	sf.closeOnce.Do(func() { close(sf.done) })
+	return nil
+}
+
+func (sf *FileCredentialStore) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sf.done:
+			return
+		case <-ticker.C:
+			if sf.changed() {
+				sf.Reload() // nolint: errcheck
+			}
+		}
+	}
+}
+
+// changed reports whether the file changed since last load
+func (sf *FileCredentialStore) changed() bool {
+	info, err := os.Stat(sf.path)
+	if err != nil {
+		return false
+	}
+	sf.mu.RLock()
+	defer sf.mu.RUnlock()
+	return !info.ModTime().Equal(sf.modTime) || info.Size() != sf.size
+}
+
+// parseCredentials parses the htpasswd-style "user:password" lines
+func parseCredentials(r io.Reader) (map[string]string, error) {
+	creds := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		idx := strings.IndexByte(text, ':')
+		if idx <= 0 {
+			return nil, fmt.Errorf("line %d: invalid format, expect user:password", line)
+		}
+		creds[text[:idx]] = text[idx+1:]
+	}
+	return creds, scanner.Err()
+}
@@ -0,0 +1,39 @@
+package socks5
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileCredentialStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socks5")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "passwd")
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("# users\nfoo:bar\n\nbaz:qux:quux\n"), 0600))
+	store, err := NewFileCredentialStore(path, 10*time.Millisecond)
+	require.NoError(t, err)
+	defer store.Close()
+
+	require.True(t, store.Valid("foo", "bar", ""))
+	require.True(t, store.Valid("baz", "qux:quux", ""))
+	require.False(t, store.Valid("foo", "baz", ""))
+	require.False(t, store.Valid("# users", "", ""))
+
+	// revoke foo, the file is reloaded automatically
+	require.NoError(t, ioutil.WriteFile(path, []byte("baz:qux:quux\nnew:user\n"), 0600))
+	require.Eventually(t, func() bool {
+		return !store.Valid("foo", "bar", "") && store.Valid("new", "user", "")
+	}, time.Second, 10*time.Millisecond)
+
+	// the invalid file is not loaded
+	require.NoError(t, ioutil.WriteFile(path, []byte("invalid\n"), 0600))
+	require.Error(t, store.Reload())
+	require.True(t, store.Valid("new", "user", ""))
+}
@@ -0,0 +1,140 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// UserInfo the password and the policy metadata of a user of the RoleCredentialStore
+type UserInfo struct {
+	// Password of the user
+	Password string
+	// Roles of the user, such as "admin"
+	Roles []string
+	// BandwidthTier of the user, used by the rate limiter such as "gold"
+	BandwidthTier string
+	// AllowedCommands the commands the user can request, empty means all
+	AllowedCommands []uint8
+	// Metadata any other per user attributes
+	Metadata map[string]string
+}
+
+// HasRole reports whether the user has the role
+func (sf UserInfo) HasRole(role string) bool {
+	for _, r := range sf.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// clone returns a deep copy, so the caller can not modify the stored one
+func (sf UserInfo) clone() UserInfo {
+	sf.Roles = append([]string(nil), sf.Roles...)
+	sf.AllowedCommands = append([]uint8(nil), sf.AllowedCommands...)
+	if sf.Metadata != nil {
+		md := make(map[string]string, len(sf.Metadata))
+		for k, v := range sf.Metadata {
+			md[k] = v
+		}
+		sf.Metadata = md
+	}
+	return sf
+}
+
+// RoleCredentialStore is an in-memory CredentialStore which stores the user's policy
+// alongside the password, the RuleSet and the rate limiter can consult it by the
+// username of the AuthContext, see UserOf. The users can be added, updated and removed
+// at runtime, it is safe for concurrent use.
+// It is a RuleSet too, which permits only the AllowedCommands of the known users.
+type RoleCredentialStore struct {
+	mu    sync.RWMutex
+	users map[string]UserInfo
+}
+
+// NewRoleCredentialStore returns an empty RoleCredentialStore
+func NewRoleCredentialStore() *RoleCredentialStore {
+	return &RoleCredentialStore{users: make(map[string]UserInfo)}
+}
+
+// Valid implement interface CredentialStore
+func (sf *RoleCredentialStore) Valid(user, password, _ string) bool {
+	sf.mu.RLock()
+	info, ok := sf.users[user]
+	sf.mu.RUnlock()
+	return ok && password == info.Password
+}
+
+// AddUser adds the user, returns error if the user exists.
+func (sf *RoleCredentialStore) AddUser(user string, info UserInfo) error {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	if _, ok := sf.users[user]; ok {
+		return fmt.Errorf("user %s already exists", user)
+	}
+	sf.users[user] = info.clone()
+	return nil
+}
+
+// UpdateUser replaces the user's info, returns error if the user not exists.
+func (sf *RoleCredentialStore) UpdateUser(user string, info UserInfo) error {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	if _, ok := sf.users[user]; !ok {
+		return fmt.Errorf("user %s not found", user)
+	}
+	sf.users[user] = info.clone()
+	return nil
+}
+
+// RemoveUser removes the user, the user's new connections are rejected.
+func (sf *RoleCredentialStore) RemoveUser(user string) {
+	sf.mu.Lock()
+	delete(sf.users, user)
+	sf.mu.Unlock()
+}
+
+// User returns a copy of the user's info
+func (sf *RoleCredentialStore) User(user string) (UserInfo, bool) {
+	sf.mu.RLock()
+	info, ok := sf.users[user]
+	sf.mu.RUnlock()
+	if !ok {
+		return UserInfo{}, false
+	}
+	return info.clone(), true
+}
+
+// UserOf returns a copy of the info of the user authenticated by the AuthContext
+func (sf *RoleCredentialStore) UserOf(auth *AuthContext) (UserInfo, bool) {
+	if auth == nil || auth.Username() == "" {
+		return UserInfo{}, false
+	}
+	return sf.User(auth.Username())
+}
+
+// Allow implement interface RuleSet, permits only the AllowedCommands of the user,
+// the requests of the users not in the store are denied.
+func (sf *RoleCredentialStore) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	sf.mu.RLock()
+	defer sf.mu.RUnlock()
+
+	if req.AuthContext == nil {
+		return ctx, false
+	}
+	info, ok := sf.users[req.AuthContext.Username()]
+	if !ok {
+		return ctx, false
+	}
+	if len(info.AllowedCommands) == 0 {
+		return ctx, true
+	}
+	for _, cmd := range info.AllowedCommands {
+		if cmd == req.Command {
+			return ctx, true
+		}
+	}
+	return ctx, false
+}
@@ -0,0 +1,56 @@
+package socks5
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/thinkgos/go-socks5/statute"
+)
+
+func TestRoleCredentialStore(t *testing.T) {
+	store := NewRoleCredentialStore()
+	require.NoError(t, store.AddUser("foo", UserInfo{
+		Password:        "bar",
+		Roles:           []string{"admin"},
+		BandwidthTier:   "gold",
+		AllowedCommands: []uint8{statute.CommandConnect},
+	}))
+	require.Error(t, store.AddUser("foo", UserInfo{Password: "baz"}))
+	require.True(t, store.Valid("foo", "bar", ""))
+	require.False(t, store.Valid("foo", "baz", ""))
+	require.False(t, store.Valid("nobody", "", ""))
+
+	auth := &AuthContext{Payload: map[string]string{AuthKeyUsername: "foo"}}
+	info, ok := store.UserOf(auth)
+	require.True(t, ok)
+	require.True(t, info.HasRole("admin"))
+	require.Equal(t, "gold", info.BandwidthTier)
+	// the copy can not modify the store
+	info.Roles[0] = "guest"
+	info, _ = store.User("foo")
+	require.True(t, info.HasRole("admin"))
+
+	// the allowed commands
+	request := func(cmd uint8, auth *AuthContext) *Request {
+		return &Request{Request: statute.Request{Command: cmd}, AuthContext: auth}
+	}
+	_, ok = store.Allow(context.Background(), request(statute.CommandConnect, auth))
+	require.True(t, ok)
+	_, ok = store.Allow(context.Background(), request(statute.CommandBind, auth))
+	require.False(t, ok)
+	_, ok = store.Allow(context.Background(), request(statute.CommandConnect, &AuthContext{}))
+	require.False(t, ok)
+
+	// update and remove at runtime
+	require.Error(t, store.UpdateUser("nobody", UserInfo{}))
+	require.NoError(t, store.UpdateUser("foo", UserInfo{Password: "baz"}))
+	require.True(t, store.Valid("foo", "baz", ""))
+	_, ok = store.Allow(context.Background(), request(statute.CommandBind, auth))
+	require.True(t, ok)
+	store.RemoveUser("foo")
+	require.False(t, store.Valid("foo", "baz", ""))
+	_, ok = store.UserOf(auth)
+	require.False(t, ok)
+}
@@ -0,0 +1,224 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// happyEyeballsDelay the connection attempt delay, see rfc8305
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// Side distinguishes the connection sides of the relay
+type Side int
+
+// Side of the connection
+const (
+	// SideClient the accepted client connection
+	SideClient Side = iota
+	// SideUpstream the dialed upstream connection of connect, or the inbound peer connection of bind
+	SideUpstream
+)
+
+// String implement interface fmt.Stringer
+func (s Side) String() string {
+	switch s {
+	case SideClient:
+		return "client"
+	case SideUpstream:
+		return "upstream"
+	}
+	return "unknown"
+}
+
+// DialFunc dials the outbound connection to the address of the network
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// localAddrCtxKey is the context key of the local address for outbound dials
+type localAddrCtxKey struct{}
+
+// transparentCtxKey is the context key of the transparent outbound dials
+type transparentCtxKey struct{}
+
+// defaultDial dials with the local address carried by ctx if any,
+// and sets the socket transparent if required by ctx.
+func defaultDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	if laddr, ok := ctx.Value(localAddrCtxKey{}).(net.Addr); ok {
+		d.LocalAddr = laddr
+	}
+	if transparent, _ := ctx.Value(transparentCtxKey{}).(bool); transparent {
+		d.Control = transparentControl
+	}
+	return d.DialContext(ctx, network, addr)
+}
+
+// bindAddr returns the source ip chosen by the bind address selector, nil if none.
+func (sf *Server) bindAddr(request *Request) net.IP {
+	if sf.bindAddrFunc == nil {
+		return nil
+	}
+	return sf.bindAddrFunc(request)
+}
+
+// interfaceAddr returns the current address of the named interface to bind the outbound
+// connection to the destination, which must be the same family as the destination if known.
+// The link-local addresses are skipped.
+func interfaceAddr(name string, dest net.IP) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if ok && !ipNet.IP.IsLinkLocalUnicast() && (dest == nil || sameFamily(ipNet.IP, dest)) {
+			return ipNet.IP, nil
+		}
+	}
+	return nil, fmt.Errorf("interface %s has no usable address", name)
+}
+
+// sameFamily reports whether the ip a and b are the same address family
+func sameFamily(a, b net.IP) bool {
+	return (a.To4() != nil) == (b.To4() != nil)
+}
+
+// isTimeout reports whether the err is a timeout error
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// happyEyeballsAddrs returns the candidate addresses of the destination to race,
+// the ips denied by rules or mismatch with the bind ip family are excluded.
+func (sf *Server) happyEyeballsAddrs(ctx context.Context, request *Request, bindIP net.IP) []string {
+	// the destination has been rewritten
+	if len(request.destIPs) < 2 || request.DestAddr != request.RawDestAddr {
+		return nil
+	}
+	ips := make([]net.IP, 0, len(request.destIPs))
+	for i, ip := range request.destIPs {
+		if bindIP != nil && !sameFamily(ip, bindIP) {
+			continue
+		}
+		// the first ip has been checked with the rules
+		if i > 0 && sf.rules != nil {
+			spec := *request.DestAddr
+			spec.IP = ip
+			r := *request
+			r.DestAddr, r.RawDestAddr = &spec, &spec
+			if _, ok := sf.rules.Allow(ctx, &r); !ok {
+				continue
+			}
+		}
+		ips = append(ips, ip)
+	}
+	ips = interleaveFamily(ips)
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), strconv.Itoa(request.DestAddr.Port)))
+	}
+	return addrs
+}
+
+// interleaveFamily interleaves the ips by address family,
+// beginning with the family of the first ip.
+func interleaveFamily(ips []net.IP) []net.IP {
+	if len(ips) == 0 {
+		return ips
+	}
+	var primary, secondary []net.IP
+	for _, ip := range ips {
+		if sameFamily(ip, ips[0]) {
+			primary = append(primary, ip)
+		} else {
+			secondary = append(secondary, ip)
+		}
+	}
+	result := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(primary) || i < len(secondary); i++ {
+		if i < len(primary) {
+			result = append(result, primary[i])
+		}
+		if i < len(secondary) {
+			result = append(result, secondary[i])
+		}
+	}
+	return result
+}
+
+// dialParallel races the connection attempts to the addrs in order staggered by delay,
+// the next attempt starts immediately once an attempt failed.
+// It returns the first established connection, or the first error if all failed.
+func dialParallel(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error),
+	network string, addrs []string, delay time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			conn, err := dial(ctx, network, addr)
+			results <- result{conn, err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// close the late established connections
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) {
+				start()
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(delay)
+			}
+		case <-timer.C:
+			if next < len(addrs) {
+				start()
+				timer.Reset(delay)
+			}
+		}
+	}
+	return nil, firstErr
+}
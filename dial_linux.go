@@ -0,0 +1,30 @@
+package socks5
+
+import (
+	"strings"
+	"syscall"
+)
+
+// ipv6Transparent is IPV6_TRANSPARENT, which is missing in package syscall
+const ipv6Transparent = 0x4b
+
+// transparentControl sets SO_REUSEADDR and IP_TRANSPARENT on the socket,
+// which allows binding to the non-local address such as the client's source.
+func transparentControl(network, _ string, c syscall.RawConn) error {
+	var opErr error
+	err := c.Control(func(fd uintptr) {
+		opErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		if opErr != nil {
+			return
+		}
+		if strings.HasSuffix(network, "6") {
+			opErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+		} else {
+			opErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return opErr
+}
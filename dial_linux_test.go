@@ -0,0 +1,38 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultDial_Transparent(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	peer := make(chan net.Addr, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		peer <- conn.RemoteAddr()
+		conn.Close()
+	}()
+
+	source := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 5), Port: 0}
+	ctx := context.WithValue(context.Background(), localAddrCtxKey{}, source)
+	ctx = context.WithValue(ctx, transparentCtxKey{}, true)
+	conn, err := defaultDial(ctx, "tcp", l.Addr().String())
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("IP_TRANSPARENT requires CAP_NET_ADMIN")
+	}
+	require.NoError(t, err)
+	defer conn.Close()
+	require.True(t, source.IP.Equal((<-peer).(*net.TCPAddr).IP))
+}
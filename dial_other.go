@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package socks5
+
+import (
+	"errors"
+	"syscall"
+)
+
+// transparentControl transparent dial only supported on linux
+func transparentControl(string, string, syscall.RawConn) error {
+	return errors.New("transparent dial not supported on this platform")
+}
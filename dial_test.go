@@ -0,0 +1,310 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/thinkgos/go-socks5/bufferpool"
+	"github.com/thinkgos/go-socks5/statute"
+)
+
+func TestInterleaveFamily(t *testing.T) {
+	ips := []net.IP{
+		net.ParseIP("::1"), net.ParseIP("::2"), net.ParseIP("::3"),
+		net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.2"),
+	}
+	got := interleaveFamily(ips)
+	require.Equal(t, []net.IP{ips[0], ips[3], ips[1], ips[4], ips[2]}, got)
+	require.Empty(t, interleaveFamily(nil))
+}
+
+func TestDialParallel(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	errRefused := errors.New("refused")
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		switch addr {
+		case "blackhole":
+			<-ctx.Done()
+			return nil, ctx.Err()
+		case "refused":
+			return nil, errRefused
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+
+	// the first attempt hangs, the second attempt starts after the delay
+	start := time.Now()
+	conn, err := dialParallel(context.Background(), dial, "tcp", []string{"blackhole", l.Addr().String()}, 50*time.Millisecond)
+	require.NoError(t, err)
+	conn.Close()
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(50*time.Millisecond))
+
+	// the first attempt failed, the second attempt starts immediately
+	start = time.Now()
+	conn, err = dialParallel(context.Background(), dial, "tcp", []string{"refused", l.Addr().String()}, time.Second)
+	require.NoError(t, err)
+	conn.Close()
+	require.Less(t, int64(time.Since(start)), int64(time.Second))
+
+	// all failed
+	_, err = dialParallel(context.Background(), dial, "tcp", []string{"refused", "refused"}, time.Second)
+	require.Equal(t, errRefused, err)
+}
+
+type multiResolver []net.IP
+
+func (sf multiResolver) Resolve(ctx context.Context, _ string) (context.Context, net.IP, error) {
+	return ctx, sf[0], nil
+}
+
+func (sf multiResolver) ResolveAll(ctx context.Context, _ string) (context.Context, []net.IP, error) {
+	return ctx, sf, nil
+}
+
+func TestRequest_Connect_HappyEyeballs(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	s := &Server{
+		rules:      NewPermitAll(),
+		resolver:   multiResolver{net.ParseIP("::1"), net.ParseIP("127.0.0.1")},
+		logger:     NewLogger(log.New(os.Stdout, "socks5: ", log.LstdFlags)),
+		bufferPool: bufferpool.NewPool(32 * 1024),
+		dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if host, _, _ := net.SplitHostPort(addr); host == "::1" {
+				// broken IPv6 path
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+		happyEyeballs: true,
+	}
+
+	req := statute.Request{
+		Version: statute.VersionSocks5,
+		Command: statute.CommandConnect,
+		DstAddr: statute.AddrSpec{FQDN: "dual.example", Port: lAddr.Port, AddrType: statute.ATYPDomain},
+	}
+	request, err := ParseRequest(bytes.NewReader(req.Bytes()))
+	require.NoError(t, err)
+
+	rsp := new(MockConn)
+	require.NoError(t, s.handleRequest(context.Background(), rsp, request))
+	require.Equal(t, statute.RepSuccess, rsp.buf.Bytes()[1])
+}
+
+func TestRequest_Connect_DialSelector(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	var selected []string
+	s := &Server{
+		rules:      NewPermitAll(),
+		resolver:   DNSResolver{},
+		logger:     NewLogger(log.New(os.Stdout, "socks5: ", log.LstdFlags)),
+		bufferPool: bufferpool.NewPool(32 * 1024),
+		dialSelector: func(ctx context.Context, req *Request) DialFunc {
+			if req.DestAddr.Port != lAddr.Port {
+				// blackhole
+				return func(ctx context.Context, network, addr string) (net.Conn, error) {
+					<-ctx.Done()
+					return nil, ctx.Err()
+				}
+			}
+			return func(ctx context.Context, network, addr string) (net.Conn, error) {
+				selected = append(selected, addr)
+				return defaultDial(ctx, network, addr)
+			}
+		},
+		dialTimeout: 50 * time.Millisecond,
+	}
+	request := func(port int) *Request {
+		req := statute.Request{
+			Version: statute.VersionSocks5,
+			Command: statute.CommandConnect,
+			DstAddr: statute.AddrSpec{IP: net.IPv4(127, 0, 0, 1), Port: port, AddrType: statute.ATYPIPv4},
+		}
+		request, err := ParseRequest(bytes.NewReader(req.Bytes()))
+		require.NoError(t, err)
+		return request
+	}
+
+	rsp := new(MockConn)
+	require.NoError(t, s.handleRequest(context.Background(), rsp, request(lAddr.Port)))
+	require.Equal(t, statute.RepSuccess, rsp.buf.Bytes()[1])
+	require.Equal(t, []string{lAddr.String()}, selected)
+
+	// the selected dial honors the dial timeout
+	rsp = new(MockConn)
+	require.Error(t, s.handleRequest(context.Background(), rsp, request(lAddr.Port+1)))
+	require.Equal(t, statute.RepTTLExpired, rsp.buf.Bytes()[1])
+
+	// nil falls back to the default
+	s.dialSelector = func(context.Context, *Request) DialFunc { return nil }
+	rsp = new(MockConn)
+	require.NoError(t, s.handleRequest(context.Background(), rsp, request(lAddr.Port)))
+	require.Equal(t, statute.RepSuccess, rsp.buf.Bytes()[1])
+	require.Len(t, selected, 1)
+}
+
+// loopbackInterface returns the name of the loopback interface
+func loopbackInterface(t *testing.T) string {
+	ifaces, err := net.Interfaces()
+	require.NoError(t, err)
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			return iface.Name
+		}
+	}
+	t.Skip("no loopback interface")
+	return ""
+}
+
+func TestInterfaceAddr(t *testing.T) {
+	lo := loopbackInterface(t)
+
+	ip, err := interfaceAddr(lo, net.IPv4(127, 0, 0, 1))
+	require.NoError(t, err)
+	require.True(t, ip.IsLoopback())
+	require.NotNil(t, ip.To4())
+
+	ip, err = interfaceAddr(lo, nil)
+	require.NoError(t, err)
+	require.True(t, ip.IsLoopback())
+
+	_, err = interfaceAddr("nonexistent0", nil)
+	require.Error(t, err)
+}
+
+func TestRequest_Connect_BindInterface(t *testing.T) {
+	lo := loopbackInterface(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	var iface string
+	s := &Server{
+		rules:      NewPermitAll(),
+		resolver:   DNSResolver{},
+		logger:     NewLogger(log.New(os.Stdout, "socks5: ", log.LstdFlags)),
+		bufferPool: bufferpool.NewPool(32 * 1024),
+		bindInterfaceFunc: func(req *Request) string {
+			return iface
+		},
+	}
+	request := func() *Request {
+		req := statute.Request{
+			Version: statute.VersionSocks5,
+			Command: statute.CommandConnect,
+			DstAddr: statute.AddrSpec{IP: lAddr.IP, Port: lAddr.Port, AddrType: statute.ATYPIPv4},
+		}
+		request, err := ParseRequest(bytes.NewReader(req.Bytes()))
+		require.NoError(t, err)
+		return request
+	}
+
+	iface = lo
+	rsp := new(MockConn)
+	require.NoError(t, s.handleRequest(context.Background(), rsp, request()))
+	require.Equal(t, statute.RepSuccess, rsp.buf.Bytes()[1])
+
+	iface = "nonexistent0"
+	rsp = new(MockConn)
+	require.Error(t, s.handleRequest(context.Background(), rsp, request()))
+	require.Equal(t, statute.RepNetworkUnreachable, rsp.buf.Bytes()[1])
+}
+
+func TestRequest_Connect_AddrFamily(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	s := &Server{
+		rules:      NewPermitAll(),
+		resolver:   multiResolver{net.ParseIP("::1"), net.ParseIP("127.0.0.1")},
+		logger:     NewLogger(log.New(os.Stdout, "socks5: ", log.LstdFlags)),
+		bufferPool: bufferpool.NewPool(32 * 1024),
+	}
+	connect := func() byte {
+		req := statute.Request{
+			Version: statute.VersionSocks5,
+			Command: statute.CommandConnect,
+			DstAddr: statute.AddrSpec{FQDN: "dual.example", Port: lAddr.Port, AddrType: statute.ATYPDomain},
+		}
+		request, err := ParseRequest(bytes.NewReader(req.Bytes()))
+		require.NoError(t, err)
+		rsp := new(MockConn)
+		s.handleRequest(context.Background(), rsp, request) // nolint: errcheck
+		return rsp.buf.Bytes()[1]
+	}
+
+	s.addrFamily = AddrFamilyPreferIPv4
+	require.Equal(t, statute.RepSuccess, connect())
+	s.addrFamily = AddrFamilyIPv4Only
+	require.Equal(t, statute.RepSuccess, connect())
+
+	s.resolver = multiResolver{net.ParseIP("127.0.0.1")}
+	s.addrFamily = AddrFamilyIPv6Only
+	require.Equal(t, statute.RepNetworkUnreachable, connect())
+}
@@ -0,0 +1,215 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/thinkgos/go-socks5/statute"
+)
+
+// GSSAPIMechanism is used to create the per-connection GSS-API security context,
+// it can be backed by any GSS-API mechanism, such as Kerberos V5 via gokrb5.
+type GSSAPIMechanism interface {
+	NewSecContext(userAddr string) (GSSAPISecContext, error)
+}
+
+// GSSAPISecContext is the GSS-API security context of a client connection
+type GSSAPISecContext interface {
+	// AcceptSecContext consumes a context token received from the client,
+	// returns the token to send back(may be empty) and whether the context is established.
+	AcceptSecContext(inputToken []byte) (outputToken []byte, established bool, err error)
+	// PeerName returns the authenticated principal name of the client.
+	PeerName() string
+	// Wrap protects the message, it is also encrypted if conf is true.
+	Wrap(msg []byte, conf bool) ([]byte, error)
+	// Unwrap verifies the protected message, and decrypts it if needed.
+	Unwrap(token []byte) ([]byte, error)
+}
+
+// GSSAPIAuthenticator is used to handle the GSS-API authentication, see rfc1961.
+// the subsequent traffic is protected with the negotiated per-message protection level.
+type GSSAPIAuthenticator struct {
+	Mechanism GSSAPIMechanism
+	// ProtectionLevels the per-message protection levels the server accepts,
+	// if the client requests one of them it is chosen, otherwise the first one.
+	// Defaults to accept any level the client requests.
+	ProtectionLevels []byte
+}
+
+// GetCode implement interface Authenticator
+func (a GSSAPIAuthenticator) GetCode() uint8 { return statute.MethodGSSAPI }
+
+// Authenticate implement interface Authenticator
+func (a GSSAPIAuthenticator) Authenticate(reader io.Reader, writer io.Writer, userAddr string) (*AuthContext, error) {
+	// reply the client to use gssapi auth
+	if _, err := writer.Write([]byte{statute.VersionSocks5, statute.MethodGSSAPI}); err != nil {
+		return nil, err
+	}
+
+	secCtx, err := a.Mechanism.NewSecContext(userAddr)
+	if err != nil {
+		return nil, a.abort(writer, err)
+	}
+
+	// security context establishment
+	for established := false; !established; {
+		msg, err := statute.ParseGSSAPIMessage(reader)
+		if err != nil {
+			return nil, err
+		}
+		if msg.MTyp == statute.GSSAPITypeAbort {
+			return nil, statute.ErrUserAuthFailed
+		}
+		if msg.MTyp != statute.GSSAPITypeInit {
+			return nil, a.abort(writer, fmt.Errorf("unexpected gssapi message type: %v", msg.MTyp))
+		}
+
+		var token []byte
+		token, established, err = secCtx.AcceptSecContext(msg.Token)
+		if err != nil {
+			return nil, a.abort(writer, fmt.Errorf("%w, %v", statute.ErrUserAuthFailed, err))
+		}
+		if len(token) > 0 {
+			if err = writeGSSAPIMessage(writer, statute.GSSAPITypeInit, token); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// per-message protection subnegotiation
+	msg, err := statute.ParseGSSAPIMessage(reader)
+	if err != nil {
+		return nil, err
+	}
+	if msg.MTyp == statute.GSSAPITypeAbort {
+		return nil, statute.ErrUserAuthFailed
+	}
+	if msg.MTyp != statute.GSSAPITypeProtection {
+		return nil, a.abort(writer, fmt.Errorf("unexpected gssapi message type: %v", msg.MTyp))
+	}
+	level, err := secCtx.Unwrap(msg.Token)
+	if err != nil || len(level) != 1 {
+		return nil, a.abort(writer, errors.New("invalid gssapi protection level"))
+	}
+	protection := a.selectProtection(level[0])
+	token, err := secCtx.Wrap([]byte{protection}, false)
+	if err != nil {
+		return nil, a.abort(writer, err)
+	}
+	if err = writeGSSAPIMessage(writer, statute.GSSAPITypeProtection, token); err != nil {
+		return nil, err
+	}
+
+	return &AuthContext{
+		Method: statute.MethodGSSAPI,
+		Payload: map[string]string{
+			AuthKeyPrincipal: secCtx.PeerName(),
+		},
+		Encapsulator: &gssapiEncapsulator{
+			secCtx,
+			protection == statute.GSSAPIProtectionConfidentiality,
+		},
+	}, nil
+}
+
+func (a GSSAPIAuthenticator) selectProtection(requested byte) byte {
+	if len(a.ProtectionLevels) == 0 {
+		return requested
+	}
+	for _, level := range a.ProtectionLevels {
+		if level == requested {
+			return requested
+		}
+	}
+	return a.ProtectionLevels[0]
+}
+
+// abort tell the client the negotiation aborted, and returns the err
+func (a GSSAPIAuthenticator) abort(writer io.Writer, err error) error {
+	writer.Write([]byte{statute.GSSAPIVersion, statute.GSSAPITypeAbort}) // nolint: errcheck
+	return err
+}
+
+func writeGSSAPIMessage(w io.Writer, mtyp byte, token []byte) error {
+	msg, err := statute.NewGSSAPIMessage(mtyp, token)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg.Bytes())
+	return err
+}
+
+// gssapiEncapsulator encapsulates the user data with the GSS-API security context
+type gssapiEncapsulator struct {
+	secCtx GSSAPISecContext
+	conf   bool
+}
+
+// Reader implement interface Encapsulator
+func (sf *gssapiEncapsulator) Reader(r io.Reader) io.Reader {
+	return &gssapiReader{sf.secCtx, r, bytes.Buffer{}}
+}
+
+// Writer implement interface Encapsulator
+func (sf *gssapiEncapsulator) Writer(w io.Writer) io.Writer {
+	return &gssapiWriter{sf.secCtx, sf.conf, w}
+}
+
+type gssapiReader struct {
+	secCtx GSSAPISecContext
+	r      io.Reader
+	buf    bytes.Buffer
+}
+
+func (sf *gssapiReader) Read(b []byte) (int, error) {
+	for sf.buf.Len() == 0 {
+		msg, err := statute.ParseGSSAPIMessage(sf.r)
+		if err != nil {
+			return 0, err
+		}
+		if msg.MTyp == statute.GSSAPITypeAbort {
+			return 0, io.EOF
+		}
+		if msg.MTyp != statute.GSSAPITypeEncapsulation {
+			return 0, fmt.Errorf("unexpected gssapi message type: %v", msg.MTyp)
+		}
+		data, err := sf.secCtx.Unwrap(msg.Token)
+		if err != nil {
+			return 0, err
+		}
+		sf.buf.Write(data)
+	}
+	return sf.buf.Read(b)
+}
+
+// gssapiMaxChunk the max size of user data wrapped in a message, leaves
+// enough room for the mechanism's wrap overhead.
+const gssapiMaxChunk = math.MaxUint16 / 2
+
+type gssapiWriter struct {
+	secCtx GSSAPISecContext
+	conf   bool
+	w      io.Writer
+}
+
+func (sf *gssapiWriter) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > gssapiMaxChunk {
+			chunk = chunk[:gssapiMaxChunk]
+		}
+		token, err := sf.secCtx.Wrap(chunk, sf.conf)
+		if err != nil {
+			return n, err
+		}
+		if err = writeGSSAPIMessage(sf.w, statute.GSSAPITypeEncapsulation, token); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
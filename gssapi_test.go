@@ -0,0 +1,117 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thinkgos/go-socks5/statute"
+)
+
+// mockSecContext established after two token exchanges,
+// wrap prefix the message with the conf flag.
+type mockSecContext struct {
+	round int
+}
+
+func (m *mockSecContext) AcceptSecContext(token []byte) ([]byte, bool, error) {
+	m.round++
+	switch {
+	case m.round == 1 && string(token) == "hello":
+		return []byte("challenge"), false, nil
+	case m.round == 2 && string(token) == "response":
+		return nil, true, nil
+	}
+	return nil, false, errors.New("invalid token")
+}
+
+func (m *mockSecContext) PeerName() string { return "foo@EXAMPLE.COM" }
+
+func (m *mockSecContext) Wrap(msg []byte, conf bool) ([]byte, error) {
+	flag := byte(0)
+	if conf {
+		flag = 1
+	}
+	return append([]byte{flag}, msg...), nil
+}
+
+func (m *mockSecContext) Unwrap(token []byte) ([]byte, error) {
+	if len(token) == 0 {
+		return nil, errors.New("invalid token")
+	}
+	return token[1:], nil
+}
+
+type mockMechanism struct{}
+
+func (mockMechanism) NewSecContext(string) (GSSAPISecContext, error) {
+	return &mockSecContext{}, nil
+}
+
+func gssapiMessage(t *testing.T, mtyp byte, token []byte) []byte {
+	msg, err := statute.NewGSSAPIMessage(mtyp, token)
+	require.NoError(t, err)
+	return msg.Bytes()
+}
+
+func TestGSSAPIAuth_Valid(t *testing.T) {
+	req := new(bytes.Buffer)
+	req.Write(gssapiMessage(t, statute.GSSAPITypeInit, []byte("hello")))
+	req.Write(gssapiMessage(t, statute.GSSAPITypeInit, []byte("response")))
+	req.Write(gssapiMessage(t, statute.GSSAPITypeProtection, []byte{0, statute.GSSAPIProtectionConfidentiality}))
+	rsp := new(bytes.Buffer)
+	cator := GSSAPIAuthenticator{Mechanism: mockMechanism{}}
+
+	ctx, err := cator.Authenticate(req, rsp, "")
+	require.NoError(t, err)
+	assert.Equal(t, statute.MethodGSSAPI, ctx.Method)
+	assert.Equal(t, "foo@EXAMPLE.COM", ctx.Payload["principal"])
+
+	want := []byte{statute.VersionSocks5, statute.MethodGSSAPI}
+	want = append(want, gssapiMessage(t, statute.GSSAPITypeInit, []byte("challenge"))...)
+	want = append(want, gssapiMessage(t, statute.GSSAPITypeProtection, []byte{0, statute.GSSAPIProtectionConfidentiality})...)
+	assert.Equal(t, want, rsp.Bytes())
+
+	// the subsequent traffic is encapsulated
+	require.NotNil(t, ctx.Encapsulator)
+	rsp.Reset()
+	_, err = ctx.Encapsulator.Writer(rsp).Write([]byte("ping"))
+	require.NoError(t, err)
+	assert.Equal(t, gssapiMessage(t, statute.GSSAPITypeEncapsulation, []byte("\x01ping")), rsp.Bytes())
+
+	b, err := ioutil.ReadAll(ctx.Encapsulator.Reader(rsp))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("ping"), b)
+}
+
+func TestGSSAPIAuth_Invalid(t *testing.T) {
+	req := bytes.NewBuffer(gssapiMessage(t, statute.GSSAPITypeInit, []byte("bad")))
+	rsp := new(bytes.Buffer)
+	cator := GSSAPIAuthenticator{Mechanism: mockMechanism{}}
+
+	ctx, err := cator.Authenticate(req, rsp, "")
+	require.True(t, errors.Is(err, statute.ErrUserAuthFailed))
+	require.Nil(t, ctx)
+	assert.Equal(t, []byte{statute.VersionSocks5, statute.MethodGSSAPI, statute.GSSAPIVersion, statute.GSSAPITypeAbort}, rsp.Bytes())
+}
+
+func TestGSSAPIAuth_ProtectionLevels(t *testing.T) {
+	req := new(bytes.Buffer)
+	req.Write(gssapiMessage(t, statute.GSSAPITypeInit, []byte("hello")))
+	req.Write(gssapiMessage(t, statute.GSSAPITypeInit, []byte("response")))
+	req.Write(gssapiMessage(t, statute.GSSAPITypeProtection, []byte{0, statute.GSSAPIProtectionIntegrity}))
+	rsp := new(bytes.Buffer)
+	cator := GSSAPIAuthenticator{
+		Mechanism:        mockMechanism{},
+		ProtectionLevels: []byte{statute.GSSAPIProtectionConfidentiality},
+	}
+
+	_, err := cator.Authenticate(req, rsp, "")
+	require.NoError(t, err)
+	assert.True(t, bytes.HasSuffix(rsp.Bytes(),
+		gssapiMessage(t, statute.GSSAPITypeProtection, []byte{0, statute.GSSAPIProtectionConfidentiality})))
+}
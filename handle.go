@@ -1,12 +1,15 @@
 package socks5
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
-	"strings"
-	"sync"
+	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/thinkgos/go-socks5/statute"
 )
@@ -16,6 +19,19 @@ type AddressRewriter interface {
 	Rewrite(ctx context.Context, request *Request) (context.Context, *statute.AddrSpec)
 }
 
+// RequestRewriter is an AddressRewriter which can also rewrite the command together
+// with the destination, if the rewriter given by WithRewriter implements it,
+// RewriteRequest is invoked instead of Rewrite. It returns the possibly modified request,
+// nil means unchanged. Modify a copy of the request such as
+// r := *request; r.Command = statute.CommandConnect; return ctx, &r
+type RequestRewriter interface {
+	AddressRewriter
+	RewriteRequest(ctx context.Context, request *Request) (context.Context, *Request)
+}
+
+// HandleFunc handles the request, writes the replies to the writer
+type HandleFunc func(ctx context.Context, writer io.Writer, request *Request) error
+
 // A Request represents request received by a server
 type Request struct {
 	statute.Request
@@ -29,73 +45,227 @@ type Request struct {
 	DestAddr *statute.AddrSpec
 	// Reader connect of request
 	Reader io.Reader
-	// RawDestAddr of the desired destination
+	// RawDestAddr of the desired destination, the ip is filled in by the resolution
 	RawDestAddr *statute.AddrSpec
+	// RequestedAddr the destination as the client sent it, the address type and the domain
+	// name or the ip literal, never modified by the resolution, normalization or rewrite.
+	RequestedAddr statute.AddrSpec
+	// OutboundAddr the local address of the outbound socket to the destination,
+	// set once the connect is dialed or the udp associate relay is set up.
+	OutboundAddr net.Addr
+	// BindIP the ip which the bind or udp associate listen on, selected by the server,
+	// set before the handlers of bind and associate (including the user's) run.
+	BindIP net.IP
+	// ConnID the unique id of the client connection, which prefixes the server's log lines
+	// of the connection, the handlers can log it to correlate.
+	ConnID string
+
+	// conn and bufConn of the client, used to watch the client disconnect.
+	conn    net.Conn
+	bufConn *bufio.Reader
+	// destIPs all the resolved ips of the destination, used by happy eyeballs.
+	destIPs []net.IP
+	// pooled the target connection is managed by the ConnPool
+	pooled bool
+	// outstanding the pooled relay was interrupted while the target had not answered
+	// the last bytes of the client, the response may still arrive on the connection.
+	outstanding bool
+	// unixPath the unix socket path the connect destination mapped to
+	unixPath string
 }
 
 // ParseRequest creates a new Request from the tcp connection
 func ParseRequest(bufConn io.Reader) (*Request, error) {
-	hd, err := statute.ParseRequest(bufConn)
+	return parseRequest(bufConn, 0)
+}
+
+// parseRequest creates a new Request like ParseRequest, with the domain length limit
+func parseRequest(bufConn io.Reader, maxDomainLen int) (*Request, error) {
+	hd, err := statute.ParseRequestLimit(bufConn, maxDomainLen)
 	if err != nil {
 		return nil, err
 	}
+	requested := hd.DstAddr
+	// the IPv4-mapped IPv6 destination is matched and dialed as IPv4
+	hd.DstAddr.NormalizeIPv4Mapped()
 	return &Request{
-		Request:     hd,
-		RawDestAddr: &hd.DstAddr,
-		Reader:      bufConn,
+		Request:       hd,
+		RawDestAddr:   &hd.DstAddr,
+		RequestedAddr: requested,
+		Reader:        bufConn,
 	}, nil
 }
 
+// ListenTCP listens on the BindIP with an ephemeral port, such as for the bind command,
+// the allocated address is the listener's Addr.
+func (sf *Request) ListenTCP() (*net.TCPListener, error) {
+	return net.ListenTCP("tcp", &net.TCPAddr{IP: sf.BindIP})
+}
+
+// ListenUDP listens on the BindIP with an ephemeral port, such as for the udp associate,
+// the allocated address is the conn's LocalAddr.
+func (sf *Request) ListenUDP() (*net.UDPConn, error) {
+	return net.ListenUDP("udp", &net.UDPAddr{IP: sf.BindIP})
+}
+
 // handleRequest is used for request processing after authentication
-func (sf *Server) handleRequest(write io.Writer, req *Request) error {
-	var err error
+func (sf *Server) handleRequest(ctx context.Context, write io.Writer, req *Request) (err error) {
+	recorder := &replyRecorder{Writer: write, metrics: sf.getMetrics(), cmd: req.Command, start: time.Now()}
+	if sf.replyDelay != nil {
+		recorder.delay = sf.delayReply
+	}
+	write = recorder
+	ctx = withRequest(ctx, req)
 
-	ctx := context.Background()
-	// Resolve the address if we have a FQDN
-	dest := req.RawDestAddr
-	if dest.FQDN != "" {
-		ctx, dest.IP, err = sf.resolver.Resolve(ctx, dest.FQDN)
-		if err != nil {
-			if err := SendReply(write, statute.RepHostUnreachable, nil); err != nil {
-				return fmt.Errorf("failed to send reply, %v", err)
+	if sf.accessLogger != nil {
+		entry := &AccessLogEntry{Time: recorder.start}
+		ctx = context.WithValue(ctx, accessLogCtxKey{}, entry)
+		defer func() {
+			entry.Duration = time.Since(entry.Time)
+			entry.ConnID = req.ConnID
+			entry.RemoteAddr = req.RemoteAddr
+			entry.Username = req.AuthContext.Username()
+			entry.Command = req.Command
+			if req.DestAddr != nil {
+				entry.Destination = req.DestAddr.String()
+			} else {
+				entry.Destination = req.RawDestAddr.String()
 			}
-			return fmt.Errorf("failed to resolve destination[%v], %v", dest.FQDN, err)
+			entry.OutboundAddr = req.OutboundAddr
+			entry.Replied, entry.Reply = recorder.done, recorder.rep
+			entry.Err = err
+			sf.accessLogger(*entry)
+		}()
+	}
+
+	if sf.tracer != nil {
+		var span RequestSpan
+		ctx, span = sf.tracer.StartRequest(ctx, req)
+		defer func() { span.End(req, recorder.done, recorder.rep, err) }()
+	}
+
+	defer func() {
+		// the handlers failed without replying
+		if re, ok := asReplyError(err); ok && !recorder.done {
+			SendReply(write, re.Code, nil) // nolint: errcheck
+		}
+	}()
+
+	if sf.allowedCommands != nil && !sf.allowedCommands[req.Command] {
+		if err := SendReply(write, statute.RepCommandNotSupported, nil); err != nil {
+			return fmt.Errorf("failed to send reply, %v", err)
+		}
+		return fmt.Errorf("command[%v] not allowed", req.Command)
+	}
+
+	if sf.unixDestination != nil && req.Command == statute.CommandConnect {
+		req.unixPath = sf.unixDestination(req)
+	}
+
+	// the domain destination of connect is dialed by the hostname, left to the upstream
+	remoteDNS := sf.remoteDNS && req.Command == statute.CommandConnect
+
+	// Resolve the address if we have a FQDN, the chosen ip is stored on the
+	// destination, the rules and the dial see exactly the same address.
+	if dest := req.RawDestAddr; dest.FQDN != "" && req.unixPath == "" && !scopedLiteral(dest) && !remoteDNS {
+		happyEyeballs := sf.happyEyeballs && req.Command == statute.CommandConnect
+		var ips []net.IP
+		if ctx, ips, err = sf.resolveDest(ctx, req, dest.FQDN, happyEyeballs); err != nil {
+			return err
+		}
+		dest.IP = ips[0]
+		if happyEyeballs {
+			req.destIPs = ips
 		}
 	}
 
 	// Apply any address rewrites
 	req.DestAddr = req.RawDestAddr
-	if sf.rewriter != nil {
+	if rr, ok := sf.rewriter.(RequestRewriter); ok {
+		var rewritten *Request
+		if ctx, rewritten = rr.RewriteRequest(ctx, req); rewritten != nil {
+			req = rewritten
+			ctx = withRequest(ctx, req)
+			if req.DestAddr == nil {
+				req.DestAddr = req.RawDestAddr
+			}
+		}
+	} else if sf.rewriter != nil {
 		ctx, req.DestAddr = sf.rewriter.Rewrite(ctx, req)
 	}
+	// the rewritten destination is resolved before the rules too,
+	// otherwise the dial would look it up again behind the rules.
+	if dest := req.DestAddr; dest != req.RawDestAddr && dest.FQDN != "" && len(dest.IP) == 0 && !scopedLiteral(dest) && !remoteDNS {
+		var ips []net.IP
+		if ctx, ips, err = sf.resolveDest(ctx, req, dest.FQDN, false); err != nil {
+			return err
+		}
+		dest.IP = ips[0]
+	}
+	// the IPv4-mapped IPv6 destination is matched and dialed as IPv4
+	req.DestAddr.NormalizeIPv4Mapped()
 
 	// Check if this is allowed
 	var ok bool
 	ctx, ok = sf.rules.Allow(ctx, req)
 	if !ok {
-		if err := SendReply(write, statute.RepRuleFailure, nil); err != nil {
+		rep, drop := DenyReplyFromContext(ctx)
+		if drop {
+			return fmt.Errorf("bind to %v blocked by rules, dropped, %w", req.RawDestAddr, ErrPolicyDenied)
+		}
+		if err := SendReply(write, rep, nil); err != nil {
 			return fmt.Errorf("failed to send reply, %v", err)
 		}
-		return fmt.Errorf("bind to %v blocked by rules", req.RawDestAddr)
+		return fmt.Errorf("bind to %v blocked by rules, %w", req.RawDestAddr, ErrPolicyDenied)
 	}
 
+	sf.event("request dispatched",
+		"conn_id", req.ConnID,
+		"remote", addrString(req.RemoteAddr),
+		"command", req.Command,
+		"destination", req.DestAddr.Address(),
+		"method", authMethod(req.AuthContext))
+
+	if sf.handler != nil {
+		return sf.handler(ctx, write, req)
+	}
+	return sf.dispatch(ctx, write, req)
+}
+
+// dispatch is the built-in handling of the allowed request by its command,
+// wrapped by the request middlewares if any.
+func (sf *Server) dispatch(ctx context.Context, write io.Writer, req *Request) error {
 	// Switch on the command
 	switch req.Command {
 	case statute.CommandConnect:
 		if sf.userConnectHandle != nil {
+			enterPhase(ctx, &sf.stats.relaying)
 			return sf.userConnectHandle(ctx, write, req)
 		}
-		return sf.handleConnect(ctx, write, req)
+		return sf.DefaultConnectHandler(ctx, write, req)
 	case statute.CommandBind:
+		req.BindIP = sf.listenIP(req)
 		if sf.userBindHandle != nil {
+			enterPhase(ctx, &sf.stats.relaying)
 			return sf.userBindHandle(ctx, write, req)
 		}
-		return sf.handleBind(ctx, write, req)
+		return sf.DefaultBindHandler(ctx, write, req)
 	case statute.CommandAssociate:
+		req.BindIP = sf.listenIP(req)
 		if sf.userAssociateHandle != nil {
+			enterPhase(ctx, &sf.stats.relaying)
+			if sf.udpMaxLifetime > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, sf.udpMaxLifetime)
+				defer cancel()
+				if req.conn != nil {
+					t := time.AfterFunc(sf.udpMaxLifetime, func() { req.conn.Close() })
+					defer t.Stop()
+				}
+			}
 			return sf.userAssociateHandle(ctx, write, req)
 		}
-		return sf.handleAssociate(ctx, write, req)
+		return sf.DefaultAssociateHandler(ctx, write, req)
 	default:
 		if err := SendReply(write, statute.RepCommandNotSupported, nil); err != nil {
 			return fmt.Errorf("failed to send reply, %v", err)
@@ -104,40 +274,255 @@ func (sf *Server) handleRequest(write io.Writer, req *Request) error {
 	}
 }
 
-// handleConnect is used to handle a connect command
-func (sf *Server) handleConnect(ctx context.Context, writer io.Writer, request *Request) error {
+// watchClient returns a context derived from ctx which is canceled as soon as
+// the client disconnects, stop must be called before reading from the client again.
+func watchClient(ctx context.Context, req *Request) (context.Context, func()) {
+	if req.conn == nil || req.bufConn == nil {
+		return ctx, func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Peek does not consume any pipelined data of the client.
+		if _, err := req.bufConn.Peek(1); err != nil {
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				cancel()
+			}
+		}
+	}()
+	return ctx, func() {
+		req.conn.SetReadDeadline(time.Unix(1, 0)) // nolint: errcheck
+		<-done
+		req.conn.SetReadDeadline(time.Time{}) // nolint: errcheck
+	}
+}
+
+// DefaultConnectHandler is the built-in handler of the connect command, which dials the
+// destination, sends the reply and relays. A handler set by WithConnectHandle can call
+// it to wrap rather than reimplement the default behavior.
+func (sf *Server) DefaultConnectHandler(ctx context.Context, writer io.Writer, request *Request) error {
 	// Attempt to connect
 	dial := sf.dial
 	if dial == nil {
-		dial = func(ctx context.Context, net_, addr string) (net.Conn, error) {
-			return net.Dial(net_, addr)
+		dial = defaultDial
+	}
+	if sf.dialSelector != nil {
+		if d := sf.dialSelector(ctx, request); d != nil {
+			dial = d
+		}
+	}
+	var bindIP net.IP
+	if request.unixPath == "" {
+		bindIP = sf.bindAddr(request)
+	}
+	if sf.bindInterfaceFunc != nil && request.unixPath == "" {
+		if name := sf.bindInterfaceFunc(request); name != "" {
+			ip, err := interfaceAddr(name, request.DestAddr.IP)
+			if err != nil {
+				if err := SendReply(writer, statute.RepNetworkUnreachable, nil); err != nil {
+					return fmt.Errorf("failed to send reply, %v", err)
+				}
+				return fmt.Errorf("connect to %v failed, %v", request.RawDestAddr, err)
+			}
+			bindIP = ip
+		}
+	}
+	transparent := false
+	if sf.transparentDial && request.unixPath == "" {
+		// originate from the client's real source address
+		if ip, _, ok := splitAddr(request.RemoteAddr); ok && ip != nil {
+			bindIP, transparent = ip, true
+		}
+	}
+	if bindIP != nil {
+		if request.DestAddr.IP != nil && !sameFamily(bindIP, request.DestAddr.IP) {
+			if err := SendReply(writer, statute.RepAddrTypeNotSupported, nil); err != nil {
+				return fmt.Errorf("failed to send reply, %v", err)
+			}
+			return fmt.Errorf("connect to %v failed, bind ip %v family mismatch", request.RawDestAddr, bindIP)
+		}
+		laddr := &net.TCPAddr{IP: bindIP}
+		if transparent {
+			_, laddr.Port, _ = splitAddr(request.RemoteAddr)
+			ctx = context.WithValue(ctx, transparentCtxKey{}, true)
+		}
+		ctx = context.WithValue(ctx, localAddrCtxKey{}, laddr)
+	}
+	if sf.optimisticConnect {
+		// reply before dialing, the early bytes of the client wait in the connection buffer
+		// until the relay starts, a failed dial can only close the connection
+		if err := SendReply(writer, statute.RepSuccess, &net.TCPAddr{IP: net.IPv4zero}); err != nil {
+			return fmt.Errorf("%w, %v", ErrClientGone, err)
+		}
+	}
+	dialCtx := ctx
+	if sf.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, sf.dialTimeout)
+		defer cancel()
+	}
+	var target net.Conn
+	var err error
+	if request.unixPath != "" {
+		target, err = dial(dialCtx, "unix", request.unixPath)
+	} else if sf.connPool != nil && sf.connPool.Poolable("tcp", request.DestAddr.String()) {
+		request.pooled = true
+		target, _ = sf.connPool.Get("tcp", request.DestAddr.String())
+	}
+	if target == nil && err == nil {
+		if addrs := sf.happyEyeballsAddrs(ctx, request, bindIP); len(addrs) > 1 {
+			target, err = dialParallel(dialCtx, dial, "tcp", addrs, happyEyeballsDelay)
+		} else {
+			target, err = dial(dialCtx, "tcp", request.DestAddr.String())
 		}
 	}
-	target, err := dial(ctx, "tcp", request.DestAddr.String())
 	if err != nil {
-		msg := err.Error()
-		resp := statute.RepHostUnreachable
-		if strings.Contains(msg, "refused") {
-			resp = statute.RepConnectionRefused
-		} else if strings.Contains(msg, "network is unreachable") {
-			resp = statute.RepNetworkUnreachable
-		}
-		if err := SendReply(writer, resp, nil); err != nil {
+		if sf.optimisticConnect {
+			return fmt.Errorf("connect to %v failed after optimistic reply, %v", request.RawDestAddr, err)
+		}
+		if err := SendReply(writer, dialReplyCode(err), nil); err != nil {
 			return fmt.Errorf("failed to send reply, %v", err)
 		}
 		return fmt.Errorf("connect to %v failed, %v", request.RawDestAddr, err)
 	}
-	defer target.Close()
+	if request.pooled {
+		// the pool keeps or closes the connection, never keeps the one whose response
+		// is outstanding, which would be read by the next client.
+		defer func() {
+			putErr := err
+			if putErr == nil && request.outstanding {
+				putErr = errResponseOutstanding
+			}
+			sf.connPool.Put(target, putErr)
+		}()
+	} else {
+		defer target.Close()
+	}
+	request.OutboundAddr = target.LocalAddr()
+	if sf.connTuner != nil {
+		sf.connTuner(target, SideUpstream)
+	}
 
-	// Send success
-	if err := SendReply(writer, statute.RepSuccess, target.LocalAddr()); err != nil {
-		return fmt.Errorf("failed to send reply, %v", err)
+	if !sf.optimisticConnect {
+		// Send success, the deferred close releases the target if the client has gone
+		if err = SendReply(writer, statute.RepSuccess, target.LocalAddr()); err != nil {
+			return fmt.Errorf("%w, %v", ErrClientGone, err)
+		}
 	}
+	enterPhase(ctx, &sf.stats.relaying)
 
 	// Start proxying
+	err = sf.relay(ctx, writer, request, target)
+	return err
+}
+
+// relay is used to proxy data between the client and the target bidirectionally,
+// until either side finishes with error or both sides finish.
+func (sf *Server) relay(ctx context.Context, writer io.Writer, request *Request, target net.Conn) (err error) {
+	up, down := &countReader{Reader: request.Reader}, &countReader{Reader: target}
+	defer func() {
+		sf.event("relay finished",
+			"conn_id", request.ConnID,
+			"remote", addrString(request.RemoteAddr),
+			"destination", request.DestAddr.String(),
+			"upstream_bytes", up.Count(),
+			"downstream_bytes", down.Count(),
+			"error", err)
+		sf.getMetrics().BytesTransferred(up.Count(), down.Count())
+		atomic.AddInt64(&sf.stats.bytesUp, up.Count())
+		atomic.AddInt64(&sf.stats.bytesDown, down.Count())
+		recordRelayBytes(ctx, up.Count(), down.Count())
+		if sf.sessionEnd != nil {
+			sf.sessionEnd(request, up.Count(), down.Count(), err)
+		}
+	}()
+
+	if client, upstream, ok := sf.spliceConns(request, target); ok {
+		return sf.relaySplice(request, client, upstream, up, down)
+	}
+
+	var upstream, downstream io.Reader = up, down
+	if sf.globalRateLimit != nil {
+		// chained with the user's limiters, the tighter one wins
+		upstream = &limitedReader{ctx, upstream, sf.globalRateLimit}
+		downstream = &limitedReader{ctx, downstream, sf.globalRateLimit}
+	}
+	if sf.userRateLimit != nil {
+		up, down := sf.userRateLimit(request.AuthContext)
+		if up != nil {
+			upstream = &limitedReader{ctx, upstream, up}
+		}
+		if down != nil {
+			downstream = &limitedReader{ctx, downstream, down}
+		}
+	}
+	var upTimer, downTimer *idleTimer
+	if sf.connIdleTimeout > 0 {
+		// each direction is watched by its own timer, so that trickling in one direction
+		// can't keep the other idle forever. Closing the target interrupts both directions.
+		upTimer = newIdleTimer(sf.connIdleTimeout, func() { target.Close() })
+		downTimer = newIdleTimer(sf.connIdleTimeout, func() { target.Close() })
+		upstream = &idleReader{upstream, upTimer}
+		downstream = &idleReader{downstream, downTimer}
+	}
+	var toTarget io.Writer = target
+	if sf.relayReadTimeout > 0 {
+		downstream = &deadlineReader{downstream, target, sf.relayReadTimeout}
+		if request.conn != nil {
+			upstream = &deadlineReader{upstream, request.conn, sf.relayReadTimeout}
+		}
+	}
+	if sf.relayWriteTimeout > 0 {
+		toTarget = &deadlineWriter{target, target, sf.relayWriteTimeout}
+		if request.conn != nil {
+			writer = &deadlineWriter{writer, request.conn, sf.relayWriteTimeout}
+		}
+	}
 	errCh := make(chan error, 2)
-	sf.goFunc(func() { errCh <- sf.Proxy(target, request.Reader) })
-	sf.goFunc(func() { errCh <- sf.Proxy(writer, target) })
+	if request.pooled {
+		// the pooled connection is kept open, the relay finishes once the client finished,
+		// interrupting the read of the target. The exchange is complete only if the target
+		// answered after the last bytes of the client, as the poolable request/response
+		// protocols do, otherwise the connection is not reused.
+		var interrupted, outstanding int32
+		upstream = &activityReader{upstream, func() { atomic.StoreInt32(&outstanding, 1) }}
+		downstream = &activityReader{downstream, func() { atomic.StoreInt32(&outstanding, 0) }}
+		sf.goFunc(func() {
+			err := sf.Proxy(struct{ io.Writer }{toTarget}, upstream)
+			upTimer.stop()
+			atomic.StoreInt32(&interrupted, 1)
+			target.SetReadDeadline(time.Now()) // nolint: errcheck
+			errCh <- err
+		})
+		sf.goFunc(func() {
+			err := sf.Proxy(writer, downstream)
+			downTimer.stop()
+			if err != nil && atomic.LoadInt32(&interrupted) == 1 && isTimeout(err) {
+				err = nil
+			}
+			errCh <- err
+		})
+		for i := 0; i < 2; i++ {
+			if e := <-errCh; e != nil {
+				return e
+			}
+		}
+		request.outstanding = atomic.LoadInt32(&outstanding) == 1
+		target.SetReadDeadline(time.Time{}) // nolint: errcheck
+		return nil
+	}
+	sf.goFunc(func() {
+		err := sf.Proxy(toTarget, upstream)
+		// the finished direction is no longer idle
+		upTimer.stop()
+		errCh <- err
+	})
+	sf.goFunc(func() {
+		err := sf.Proxy(writer, downstream)
+		downTimer.stop()
+		errCh <- err
+	})
 	// Wait
 	for i := 0; i < 2; i++ {
 		e := <-errCh
@@ -149,143 +534,99 @@ func (sf *Server) handleConnect(ctx context.Context, writer io.Writer, request *
 	return nil
 }
 
-// handleBind is used to handle a connect command
-func (sf *Server) handleBind(_ context.Context, writer io.Writer, _ *Request) error {
-	// TODO: Support bind
-	if err := SendReply(writer, statute.RepCommandNotSupported, nil); err != nil {
-		return fmt.Errorf("failed to send reply: %v", err)
+// scopedLiteral sets the ip and the zone of the destination if its domain is
+// a scoped IPv6 literal such as "fe80::1%eth0", which the resolver can not carry the zone.
+func scopedLiteral(dest *statute.AddrSpec) bool {
+	ip, zone := statute.ParseIPZone(dest.FQDN)
+	if ip == nil || zone == "" {
+		return false
 	}
-	return nil
+	dest.IP, dest.Zone = ip, zone
+	return true
 }
 
-// handleAssociate is used to handle a connect command
-func (sf *Server) handleAssociate(ctx context.Context, writer io.Writer, request *Request) error {
-	// Attempt to connect
-	dial := sf.dial
-	if dial == nil {
-		dial = func(ctx context.Context, net_, addr string) (net.Conn, error) {
-			return net.Dial(net_, addr)
-		}
-	}
+// resolveDest resolves the fqdn once with the resolver, all the addresses are looked up
+// if the happy eyeballs or the address family policy need them. The failure is a ReplyError.
+func (sf *Server) resolveDest(ctx context.Context, req *Request, fqdn string, all bool) (context.Context, []net.IP, error) {
+	rctx, stop := watchClient(ctx, req)
+	defer stop()
 
-	target, err := dial(ctx, "udp", request.DestAddr.String())
-	if err != nil {
-		msg := err.Error()
-		resp := statute.RepHostUnreachable
-		if strings.Contains(msg, "refused") {
-			resp = statute.RepConnectionRefused
-		} else if strings.Contains(msg, "network is unreachable") {
-			resp = statute.RepNetworkUnreachable
-		}
-		if err := SendReply(writer, resp, nil); err != nil {
-			return fmt.Errorf("failed to send reply, %v", err)
+	var ips []net.IP
+	var err error
+	if mr, ok := sf.resolver.(MultiNameResolver); ok && (all || sf.addrFamily != AddrFamilyAny) {
+		ctx, ips, err = mr.ResolveAll(rctx, fqdn)
+	} else {
+		var ip net.IP
+		if ctx, ip, err = sf.resolver.Resolve(rctx, fqdn); err == nil {
+			ips = []net.IP{ip}
 		}
-		return fmt.Errorf("connect to %v failed, %v", request.RawDestAddr, err)
 	}
-	defer target.Close()
-
-	targetUDP, ok := target.(*net.UDPConn)
-	if !ok {
-		if err := SendReply(writer, statute.RepServerFailure, nil); err != nil {
-			return fmt.Errorf("failed to send reply, %v", err)
+	if err == nil && len(ips) == 0 {
+		err = errors.New("no address")
+	}
+	var denied *ResolveDeniedError
+	if errors.As(err, &denied) {
+		rep := denied.Code
+		if rep == statute.RepSuccess {
+			rep = statute.RepHostUnreachable
 		}
-		return fmt.Errorf("dial udp invalid")
+		return ctx, nil, ReplyError{rep, fmt.Errorf("destination[%v] blocked by resolver, %w", fqdn, err)}
 	}
-
-	bindLn, err := net.ListenUDP("udp", nil)
 	if err != nil {
-		if err := SendReply(writer, statute.RepServerFailure, nil); err != nil {
-			return fmt.Errorf("failed to send reply, %v", err)
-		}
-		return fmt.Errorf("listen udp failed, %v", err)
+		return ctx, nil, ReplyError{statute.RepHostUnreachable,
+			fmt.Errorf("failed to resolve destination[%v], %v", fqdn, err)}
 	}
-	defer bindLn.Close()
+	if ips = sf.addrFamily.sort(ips); len(ips) == 0 {
+		return ctx, nil, ReplyError{statute.RepNetworkUnreachable,
+			fmt.Errorf("failed to resolve destination[%v], no %v address", fqdn, sf.addrFamily)}
+	}
+	return ctx, ips, nil
+}
 
-	sf.logger.Errorf("target addr %v, listen addr: %s", targetUDP.RemoteAddr(), bindLn.LocalAddr())
-	// send BND.ADDR and BND.PORT, client used
-	if err = SendReply(writer, statute.RepSuccess, bindLn.LocalAddr()); err != nil {
-		return fmt.Errorf("failed to send reply, %v", err)
+// spliceConns returns the tcp connections of both sides if the relay can copy between them
+// directly, that is nothing needs to inspect or transform the bytes relayed.
+func (sf *Server) spliceConns(request *Request, target net.Conn) (*net.TCPConn, *net.TCPConn, bool) {
+	if sf.userRateLimit != nil || sf.globalRateLimit != nil || sf.connIdleTimeout > 0 || request.pooled ||
+		sf.relayReadTimeout > 0 || sf.relayWriteTimeout > 0 ||
+		request.bufConn == nil || request.Reader != request.bufConn {
+		return nil, nil, false
 	}
+	client, ok := request.conn.(*net.TCPConn)
+	if !ok {
+		return nil, nil, false
+	}
+	upstream, ok := target.(*net.TCPConn)
+	return client, upstream, ok
+}
 
+// relaySplice relays between the tcp connections by net.TCPConn.ReadFrom,
+// which uses splice(2) on linux, the bytes are counted by the returned size.
+func (sf *Server) relaySplice(request *Request, client, upstream *net.TCPConn, up, down *countReader) error {
+	errCh := make(chan error, 2)
 	sf.goFunc(func() {
-		// read from client and write to remote server
-		conns := sync.Map{}
-		bufPool := sf.bufferPool.Get()
-		defer func() {
-			targetUDP.Close()
-			bindLn.Close()
-			sf.bufferPool.Put(bufPool)
-		}()
-		for {
-			n, srcAddr, err := bindLn.ReadFrom(bufPool[:cap(bufPool)])
-			if err != nil {
-				if strings.Contains(err.Error(), "use of closed network connection") {
-					sf.logger.Errorf("read data from bind listen address %s failed, %v", bindLn.LocalAddr(), err)
-					return
-				}
-				continue
-			}
-
-			pk, err := statute.ParseDatagram(bufPool[:n])
-			if err != nil {
-				continue
-			}
-
-			if _, ok := conns.LoadOrStore(srcAddr.String(), struct{}{}); !ok {
-				sf.goFunc(func() {
-					// read from remote server and write to client
-					bufPool := sf.bufferPool.Get()
-					defer func() {
-						targetUDP.Close()
-						bindLn.Close()
-						sf.bufferPool.Put(bufPool)
-					}()
-
-					for {
-						buf := bufPool[:cap(bufPool)]
-						n, remote, err := targetUDP.ReadFrom(buf)
-						if err != nil {
-							sf.logger.Errorf("read data from remote %s failed, %v", targetUDP.RemoteAddr(), err)
-							return
-						}
-
-						pkb, err := statute.NewDatagram(remote.String(), buf[:n])
-						if err != nil {
-							continue
-						}
-						tmpBufPool := sf.bufferPool.Get()
-						proBuf := tmpBufPool
-						proBuf = append(proBuf, pkb.Header()...)
-						proBuf = append(proBuf, pkb.Data...)
-						if _, err := bindLn.WriteTo(proBuf, srcAddr); err != nil {
-							sf.bufferPool.Put(tmpBufPool)
-							sf.logger.Errorf("write data to client %s failed, %v", bindLn.LocalAddr(), err)
-							return
-						}
-						sf.bufferPool.Put(tmpBufPool)
-					}
-				})
-			}
-
-			// 把消息写给remote sever
-			if _, err := targetUDP.Write(pk.Data); err != nil {
-				sf.logger.Errorf("write data to remote %s failed, %v", targetUDP.RemoteAddr(), err)
-				return
-			}
+		// the pipelined data buffered first
+		n, err := io.CopyN(upstream, request.bufConn, int64(request.bufConn.Buffered()))
+		if err == nil {
+			var m int64
+			m, err = upstream.ReadFrom(client)
+			n += m
 		}
+		atomic.AddInt64(&up.n, n)
+		upstream.CloseWrite() // nolint: errcheck
+		errCh <- err
 	})
-
-	buf := sf.bufferPool.Get()
-	defer sf.bufferPool.Put(buf)
-
-	for {
-		_, err := request.Reader.Read(buf[:cap(buf)])
-		if err != nil {
-			if strings.Contains(err.Error(), "use of closed network connection") {
-				return err
-			}
+	sf.goFunc(func() {
+		n, err := client.ReadFrom(upstream)
+		atomic.AddInt64(&down.n, n)
+		client.CloseWrite() // nolint: errcheck
+		errCh <- err
+	})
+	for i := 0; i < 2; i++ {
+		if err := <-errCh; err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
 // SendReply is used to send a reply message
@@ -302,20 +643,23 @@ func SendReply(w io.Writer, rep uint8, bindAddr net.Addr) error {
 	}
 
 	if rsp.Response == statute.RepSuccess {
-		if tcpAddr, ok := bindAddr.(*net.TCPAddr); ok && tcpAddr != nil {
-			rsp.BndAddr.IP = tcpAddr.IP
-			rsp.BndAddr.Port = tcpAddr.Port
-		} else if udpAddr, ok := bindAddr.(*net.UDPAddr); ok && udpAddr != nil {
-			rsp.BndAddr.IP = udpAddr.IP
-			rsp.BndAddr.Port = udpAddr.Port
+		if ip, port, ok := splitAddr(bindAddr); ok {
+			if ip != nil {
+				rsp.BndAddr.IP = ip
+			}
+			rsp.BndAddr.Port = port
 		} else {
 			rsp.Response = statute.RepAddrTypeNotSupported
 		}
 
-		if rsp.BndAddr.IP.To4() != nil {
-			rsp.BndAddr.AddrType = statute.ATYPIPv4
-		} else if rsp.BndAddr.IP.To16() != nil {
-			rsp.BndAddr.AddrType = statute.ATYPIPv6
+		if ip4 := rsp.BndAddr.IP.To4(); ip4 != nil {
+			rsp.BndAddr.AddrType, rsp.BndAddr.IP = statute.ATYPIPv4, ip4
+		} else if ip6 := rsp.BndAddr.IP.To16(); ip6 != nil {
+			rsp.BndAddr.AddrType, rsp.BndAddr.IP = statute.ATYPIPv6, ip6
+		} else {
+			// never write the malformed ip truncated
+			rsp.Response = statute.RepAddrTypeNotSupported
+			rsp.BndAddr.IP, rsp.BndAddr.Port = net.IPv4zero, 0
 		}
 	}
 	// Send the message
@@ -323,15 +667,52 @@ func SendReply(w io.Writer, rep uint8, bindAddr net.Addr) error {
 	return err
 }
 
+// splitAddr returns the ip and port of the addr, ip is nil if unspecified.
+// The addr other than *net.TCPAddr and *net.UDPAddr is parsed from its string.
+func splitAddr(addr net.Addr) (net.IP, int, bool) {
+	switch v := addr.(type) {
+	case *net.TCPAddr:
+		if v != nil {
+			return v.IP, v.Port, true
+		}
+	case *net.UDPAddr:
+		if v != nil {
+			return v.IP, v.Port, true
+		}
+	case *net.UnixAddr:
+		// no ip and port, such as the unix socket destination or client
+		return nil, 0, v != nil
+	case nil:
+	default:
+		host, port, err := net.SplitHostPort(v.String())
+		if err != nil {
+			return nil, 0, false
+		}
+		// the zone of the scoped IPv6 address is not carried on the wire
+		ip, _ := statute.ParseIPZone(host)
+		p, err := strconv.Atoi(port)
+		if (ip == nil && host != "") || err != nil {
+			return nil, 0, false
+		}
+		return ip, p, true
+	}
+	return nil, 0, false
+}
+
 type closeWriter interface {
 	CloseWrite() error
 }
 
 // Proxy is used to suffle data from src to destination, and sends errors
-// down a dedicated channel
+// down a dedicated channel. Once src finished, the write side of dst is shut down
+// if it supports CloseWrite, the other direction keeps relaying until it finishes too.
 func (sf *Server) Proxy(dst io.Writer, src io.Reader) error {
-	buf := sf.bufferPool.Get()
-	defer sf.bufferPool.Put(buf)
+	pool := sf.bufferPool
+	if sf.relayBufferPool != nil {
+		pool = sf.relayBufferPool
+	}
+	buf := pool.Get()
+	defer pool.Put(buf)
 	_, err := io.CopyBuffer(dst, src, buf[:cap(buf)])
 	if tcpConn, ok := dst.(closeWriter); ok {
 		tcpConn.CloseWrite() // nolint: errcheck
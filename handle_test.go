@@ -2,11 +2,15 @@ package socks5
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
@@ -66,7 +70,7 @@ func TestRequest_Connect(t *testing.T) {
 	req, err := ParseRequest(buf)
 	require.NoError(t, err)
 
-	err = proxySrv.handleRequest(rsp, req)
+	err = proxySrv.handleRequest(context.Background(), rsp, req)
 	require.NoError(t, err)
 
 	// Verify response
@@ -124,8 +128,9 @@ func TestRequest_Connect_RuleFail(t *testing.T) {
 	req, err := ParseRequest(buf)
 	require.NoError(t, err)
 
-	err = s.handleRequest(rsp, req)
+	err = s.handleRequest(context.Background(), rsp, req)
 	require.Contains(t, err.Error(), "blocked by rules")
+	require.True(t, errors.Is(err, ErrPolicyDenied))
 
 	// Verify response
 	out := rsp.buf.Bytes()
@@ -135,3 +140,554 @@ func TestRequest_Connect_RuleFail(t *testing.T) {
 	}
 	require.Equal(t, expected, out)
 }
+
+type blockResolver struct {
+	canceled chan struct{}
+}
+
+func (sf blockResolver) Resolve(ctx context.Context, _ string) (context.Context, net.IP, error) {
+	<-ctx.Done()
+	close(sf.canceled)
+	return ctx, nil, ctx.Err()
+}
+
+func TestRequest_ResolveCanceledOnDisconnect(t *testing.T) {
+	resolver := blockResolver{make(chan struct{})}
+	srv := NewServer(WithResolver(resolver))
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srvLn.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte{statute.VersionSocks5, 1, statute.MethodNoAuth})
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 2))
+	require.NoError(t, err)
+	req := statute.Request{
+		Version: statute.VersionSocks5,
+		Command: statute.CommandConnect,
+		DstAddr: statute.AddrSpec{FQDN: "hang.example", Port: 80, AddrType: statute.ATYPDomain},
+	}
+	_, err = conn.Write(req.Bytes())
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+
+	select {
+	case <-resolver.canceled:
+	case <-time.After(time.Second):
+		t.Fatal("resolution not canceled on client disconnect")
+	}
+}
+
+func TestRequest_Connect_BindAddrFunc(t *testing.T) {
+	// Create a local listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	peer := make(chan net.Addr, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		peer <- conn.RemoteAddr()
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	proxySrv := &Server{
+		rules:      NewPermitAll(),
+		resolver:   DNSResolver{},
+		logger:     NewLogger(log.New(os.Stdout, "socks5: ", log.LstdFlags)),
+		bufferPool: bufferpool.NewPool(32 * 1024),
+		bindAddrFunc: func(req *Request) net.IP {
+			return net.IPv4(127, 0, 0, 2)
+		},
+	}
+
+	buf := bytes.NewBuffer([]byte{
+		statute.VersionSocks5, statute.CommandConnect, 0,
+		statute.ATYPIPv4, 127, 0, 0, 1, byte(lAddr.Port >> 8), byte(lAddr.Port),
+	})
+	req, err := ParseRequest(buf)
+	require.NoError(t, err)
+	rsp := new(MockConn)
+	require.NoError(t, proxySrv.handleRequest(context.Background(), rsp, req))
+	require.Equal(t, statute.RepSuccess, rsp.buf.Bytes()[1])
+	require.True(t, net.IPv4(127, 0, 0, 2).Equal((<-peer).(*net.TCPAddr).IP))
+
+	// the chosen ip family mismatch with the destination
+	proxySrv.bindAddrFunc = func(req *Request) net.IP { return net.IPv6loopback }
+	buf = bytes.NewBuffer([]byte{
+		statute.VersionSocks5, statute.CommandConnect, 0,
+		statute.ATYPIPv4, 127, 0, 0, 1, byte(lAddr.Port >> 8), byte(lAddr.Port),
+	})
+	req, err = ParseRequest(buf)
+	require.NoError(t, err)
+	rsp = new(MockConn)
+	require.Error(t, proxySrv.handleRequest(context.Background(), rsp, req))
+	require.Equal(t, statute.RepAddrTypeNotSupported, rsp.buf.Bytes()[1])
+}
+
+func TestRequest_Connect_DialTimeout(t *testing.T) {
+	s := &Server{
+		rules:      NewPermitAll(),
+		resolver:   DNSResolver{},
+		logger:     NewLogger(log.New(os.Stdout, "socks5: ", log.LstdFlags)),
+		bufferPool: bufferpool.NewPool(32 * 1024),
+		dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			// blackhole
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+		dialTimeout: 50 * time.Millisecond,
+	}
+
+	buf := bytes.NewBuffer([]byte{
+		statute.VersionSocks5, statute.CommandConnect, 0,
+		statute.ATYPIPv4, 10, 255, 255, 1, 0, 80,
+	})
+	req, err := ParseRequest(buf)
+	require.NoError(t, err)
+
+	rsp := new(MockConn)
+	start := time.Now()
+	require.Error(t, s.handleRequest(context.Background(), rsp, req))
+	require.Less(t, int64(time.Since(start)), int64(time.Second))
+	require.Equal(t, statute.RepTTLExpired, rsp.buf.Bytes()[1])
+}
+
+type stringAddr string
+
+func (stringAddr) Network() string   { return "custom" }
+func (sf stringAddr) String() string { return string(sf) }
+
+func TestSendReply(t *testing.T) {
+	tests := []struct {
+		name     string
+		bindAddr net.Addr
+		want     []byte
+	}{
+		{
+			"ipv4",
+			&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 8080},
+			[]byte{statute.VersionSocks5, statute.RepSuccess, 0, statute.ATYPIPv4, 10, 0, 0, 1, 0x1f, 0x90},
+		},
+		{
+			"ipv6",
+			&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53},
+			append(append([]byte{statute.VersionSocks5, statute.RepSuccess, 0, statute.ATYPIPv6},
+				net.ParseIP("2001:db8::1")...), 0, 53),
+		},
+		{
+			"unspecified ip",
+			&net.TCPAddr{Port: 1080},
+			[]byte{statute.VersionSocks5, statute.RepSuccess, 0, statute.ATYPIPv4, 0, 0, 0, 0, 0x04, 0x38},
+		},
+		{
+			"custom addr",
+			stringAddr("[2001:db8::2]:443"),
+			append(append([]byte{statute.VersionSocks5, statute.RepSuccess, 0, statute.ATYPIPv6},
+				net.ParseIP("2001:db8::2")...), 0x01, 0xbb),
+		},
+		{
+			"scoped ipv6 custom addr",
+			stringAddr("[fe80::1%eth0]:443"),
+			append(append([]byte{statute.VersionSocks5, statute.RepSuccess, 0, statute.ATYPIPv6},
+				net.ParseIP("fe80::1")...), 0x01, 0xbb),
+		},
+		{
+			"malformed ip",
+			&net.TCPAddr{IP: net.IP{10, 0, 0}, Port: 8080},
+			[]byte{statute.VersionSocks5, statute.RepAddrTypeNotSupported, 0, statute.ATYPIPv4, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			"unsupported addr",
+			stringAddr("pipe"),
+			[]byte{statute.VersionSocks5, statute.RepAddrTypeNotSupported, 0, statute.ATYPIPv4, 0, 0, 0, 0, 0, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			require.NoError(t, SendReply(buf, statute.RepSuccess, tt.bindAddr))
+			require.Equal(t, tt.want, buf.Bytes())
+		})
+	}
+}
+
+func TestSendReply_RoundTrip(t *testing.T) {
+	for _, addr := range []*net.TCPAddr{
+		{IP: net.IPv4(192, 0, 2, 1), Port: 1080},
+		{IP: net.ParseIP("2001:db8::1"), Port: 1080},
+		{IP: net.ParseIP("fe80::1"), Port: 65535, Zone: "eth0"},
+		{IP: net.IPv6unspecified, Port: 1},
+	} {
+		buf := new(bytes.Buffer)
+		require.NoError(t, SendReply(buf, statute.RepSuccess, addr))
+		rsp, err := statute.ParseReply(buf)
+		require.NoError(t, err)
+		require.Zero(t, buf.Len(), addr.String())
+		require.Equal(t, statute.RepSuccess, rsp.Response)
+		if addr.IP.To4() != nil {
+			require.Equal(t, statute.ATYPIPv4, rsp.BndAddr.AddrType)
+		} else {
+			require.Equal(t, statute.ATYPIPv6, rsp.BndAddr.AddrType)
+			require.Len(t, rsp.BndAddr.IP, net.IPv6len)
+		}
+		require.True(t, addr.IP.Equal(rsp.BndAddr.IP), addr.String())
+		require.Equal(t, addr.Port, rsp.BndAddr.Port)
+	}
+}
+
+type commandRewriter struct {
+	honeypot *statute.AddrSpec
+}
+
+func (sf commandRewriter) Rewrite(ctx context.Context, request *Request) (context.Context, *statute.AddrSpec) {
+	return ctx, request.DestAddr
+}
+
+func (sf commandRewriter) RewriteRequest(ctx context.Context, request *Request) (context.Context, *Request) {
+	r := *request
+	switch r.Command {
+	case statute.CommandConnect:
+		r.DestAddr = sf.honeypot
+	case statute.CommandBind:
+		// deny bind by rewriting to an unsupported command
+		r.Command = 0xff
+	}
+	return ctx, &r
+}
+
+func TestRequest_RequestRewriter(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("honeypot")) // nolint: errcheck
+		conn.Close()
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	s := &Server{
+		rules:      NewPermitAll(),
+		resolver:   DNSResolver{},
+		rewriter:   commandRewriter{&statute.AddrSpec{IP: lAddr.IP, Port: lAddr.Port, AddrType: statute.ATYPIPv4}},
+		logger:     NewLogger(log.New(os.Stdout, "socks5: ", log.LstdFlags)),
+		bufferPool: bufferpool.NewPool(32 * 1024),
+	}
+
+	// connect is redirected to the honeypot
+	req, err := ParseRequest(bytes.NewBuffer([]byte{
+		statute.VersionSocks5, statute.CommandConnect, 0,
+		statute.ATYPIPv4, 10, 255, 255, 1, 0, 80,
+	}))
+	require.NoError(t, err)
+	rsp := new(MockConn)
+	require.NoError(t, s.handleRequest(context.Background(), rsp, req))
+	out := rsp.buf.Bytes()
+	require.Equal(t, statute.RepSuccess, out[1])
+	require.Equal(t, []byte("honeypot"), out[10:])
+
+	// bind is denied
+	req, err = ParseRequest(bytes.NewBuffer([]byte{
+		statute.VersionSocks5, statute.CommandBind, 0,
+		statute.ATYPIPv4, 10, 255, 255, 1, 0, 80,
+	}))
+	require.NoError(t, err)
+	rsp = new(MockConn)
+	require.Error(t, s.handleRequest(context.Background(), rsp, req))
+	// the rules see the rewritten command
+	require.Equal(t, statute.RepRuleFailure, rsp.buf.Bytes()[1])
+}
+
+func TestRequest_RewriteResolvedOnce(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("honeypot")) // nolint: errcheck
+		conn.Close()
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	resolver := &countResolver{}
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	s := &Server{
+		rules:      NewCIDRRuleSet([]*net.IPNet{loopback}, nil),
+		resolver:   resolver,
+		rewriter:   commandRewriter{&statute.AddrSpec{FQDN: "honeypot.example", Port: lAddr.Port, AddrType: statute.ATYPDomain}},
+		logger:     NewLogger(log.New(os.Stdout, "socks5: ", log.LstdFlags)),
+		bufferPool: bufferpool.NewPool(32 * 1024),
+	}
+
+	req, err := ParseRequest(bytes.NewBuffer([]byte{
+		statute.VersionSocks5, statute.CommandConnect, 0,
+		statute.ATYPIPv4, 127, 0, 0, 1, 0, 80,
+	}))
+	require.NoError(t, err)
+	rsp := new(MockConn)
+	// the rules see the resolved ip of the rewritten domain, which is dialed
+	require.NoError(t, s.handleRequest(context.Background(), rsp, req))
+	out := rsp.buf.Bytes()
+	require.Equal(t, statute.RepSuccess, out[1])
+	require.Equal(t, []byte("honeypot"), out[10:])
+	require.Equal(t, 1, resolver.count)
+}
+
+func TestRequest_ScopedIPv6(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("ipv6 not available")
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("scoped")) // nolint: errcheck
+		conn.Close()
+	}()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	resolver := &countResolver{}
+	s := &Server{
+		rules:      NewPermitAll(),
+		resolver:   resolver,
+		logger:     NewLogger(log.New(os.Stdout, "socks5: ", log.LstdFlags)),
+		bufferPool: bufferpool.NewPool(32 * 1024),
+	}
+	// the scoped literal can only be requested as a domain
+	hd := statute.Request{
+		Version: statute.VersionSocks5,
+		Command: statute.CommandConnect,
+		DstAddr: statute.AddrSpec{FQDN: "::1%lo", Port: port, AddrType: statute.ATYPDomain},
+	}
+	req, err := ParseRequest(bytes.NewBuffer(hd.Bytes()))
+	require.NoError(t, err)
+	rsp := new(MockConn)
+	require.NoError(t, s.handleRequest(context.Background(), rsp, req))
+	require.Equal(t, statute.RepSuccess, rsp.buf.Bytes()[1])
+	require.True(t, bytes.HasSuffix(rsp.buf.Bytes(), []byte("scoped")))
+	// the zone is kept, the resolver is not involved
+	require.Equal(t, "lo", req.DestAddr.Zone)
+	require.Equal(t, fmt.Sprintf("[::1%%lo]:%d", port), req.DestAddr.String())
+	require.Zero(t, resolver.count)
+}
+
+func TestRequest_DenyReply(t *testing.T) {
+	s := &Server{
+		rules:      NewDenyReplyRuleSet(NewPermitNone(), statute.RepHostUnreachable),
+		resolver:   DNSResolver{},
+		logger:     NewLogger(log.New(os.Stdout, "socks5: ", log.LstdFlags)),
+		bufferPool: bufferpool.NewPool(32 * 1024),
+	}
+	request := func() *Request {
+		req, err := ParseRequest(bytes.NewBuffer([]byte{
+			statute.VersionSocks5, statute.CommandConnect, 0,
+			statute.ATYPIPv4, 127, 0, 0, 1, 0, 80,
+		}))
+		require.NoError(t, err)
+		return req
+	}
+
+	rsp := new(MockConn)
+	require.Error(t, s.handleRequest(context.Background(), rsp, request()))
+	require.Equal(t, statute.RepHostUnreachable, rsp.buf.Bytes()[1])
+
+	// silent drop
+	s.rules = NewDenyDropRuleSet(NewPermitNone())
+	rsp = new(MockConn)
+	require.Error(t, s.handleRequest(context.Background(), rsp, request()))
+	require.Zero(t, rsp.buf.Len())
+}
+
+func TestRequest_IPv4MappedDest(t *testing.T) {
+	_, deny, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+	s := &Server{
+		rules:      NewCIDRRuleSet(nil, []*net.IPNet{deny}),
+		resolver:   DNSResolver{},
+		logger:     NewLogger(log.New(os.Stdout, "socks5: ", log.LstdFlags)),
+		bufferPool: bufferpool.NewPool(32 * 1024),
+	}
+	// ::ffff:10.0.0.1
+	req, err := ParseRequest(bytes.NewBuffer([]byte{
+		statute.VersionSocks5, statute.CommandConnect, 0,
+		statute.ATYPIPv6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 10, 0, 0, 1, 0, 80,
+	}))
+	require.NoError(t, err)
+	require.Equal(t, net.IP{10, 0, 0, 1}, req.RawDestAddr.IP)
+	require.Equal(t, statute.ATYPIPv4, req.RawDestAddr.AddrType)
+
+	rsp := new(MockConn)
+	require.Error(t, s.handleRequest(context.Background(), rsp, req))
+	require.Equal(t, statute.RepRuleFailure, rsp.buf.Bytes()[1])
+}
+
+// sinkholeResolver vetoes the blocked domain by ResolveDeniedError
+type sinkholeResolver struct {
+	blocked string
+	rep     uint8
+}
+
+func (sf sinkholeResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	if name == sf.blocked {
+		return ctx, nil, &ResolveDeniedError{Code: sf.rep, Err: fmt.Errorf("%s is blocked", name)}
+	}
+	return ctx, net.IPv4(127, 0, 0, 1), nil
+}
+
+func TestRequest_ResolveDenied(t *testing.T) {
+	for _, tc := range []struct {
+		rep  uint8
+		want uint8
+	}{
+		{0, statute.RepHostUnreachable},
+		{statute.RepRuleFailure, statute.RepRuleFailure},
+	} {
+		s := &Server{
+			rules:      NewPermitAll(),
+			resolver:   sinkholeResolver{"ads.example", tc.rep},
+			logger:     NewLogger(log.New(os.Stdout, "socks5: ", log.LstdFlags)),
+			bufferPool: bufferpool.NewPool(32 * 1024),
+		}
+		req, err := ParseRequest(bytes.NewBuffer([]byte{
+			statute.VersionSocks5, statute.CommandConnect, 0,
+			statute.ATYPDomain, 11, 'a', 'd', 's', '.', 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0, 80,
+		}))
+		require.NoError(t, err)
+		rsp := new(MockConn)
+		err = s.handleRequest(context.Background(), rsp, req)
+		require.True(t, errors.Is(err, ErrPolicyDenied))
+		require.Equal(t, tc.want, rsp.buf.Bytes()[1])
+	}
+}
+
+func TestRequest_RequestedAddr(t *testing.T) {
+	s := &Server{
+		rules:      NewPermitNone(),
+		resolver:   &countResolver{},
+		logger:     NewLogger(log.New(os.Stdout, "socks5: ", log.LstdFlags)),
+		bufferPool: bufferpool.NewPool(32 * 1024),
+	}
+
+	// the domain name is kept after the resolution
+	req, err := ParseRequest(bytes.NewBuffer([]byte{
+		statute.VersionSocks5, statute.CommandConnect, 0,
+		statute.ATYPDomain, 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0, 80,
+	}))
+	require.NoError(t, err)
+	require.Error(t, s.handleRequest(context.Background(), new(MockConn), req))
+	require.True(t, net.IPv4(127, 0, 0, 1).Equal(req.RawDestAddr.IP))
+	require.Equal(t, statute.ATYPDomain, req.RequestedAddr.AddrType)
+	require.Equal(t, "example", req.RequestedAddr.FQDN)
+	require.Nil(t, req.RequestedAddr.IP)
+
+	// the IPv4-mapped literal is kept as IPv6
+	req, err = ParseRequest(bytes.NewBuffer([]byte{
+		statute.VersionSocks5, statute.CommandConnect, 0,
+		statute.ATYPIPv6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 10, 0, 0, 1, 0, 80,
+	}))
+	require.NoError(t, err)
+	require.Equal(t, statute.ATYPIPv4, req.RawDestAddr.AddrType)
+	require.Equal(t, statute.ATYPIPv6, req.RequestedAddr.AddrType)
+	require.Equal(t, net.ParseIP("::ffff:10.0.0.1"), req.RequestedAddr.IP)
+}
+
+func TestRelay_Splice(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn) // nolint: errcheck
+			}()
+		}
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 8192)
+
+	for _, opts := range [][]Option{
+		nil, // splice
+		{WithRelayBufferSize(512), WithConnIdleTimeout(time.Minute)},
+	} {
+		counts := make(chan [2]int64, 1)
+		srv := NewServer(append(opts, WithSessionEnd(func(req *Request, up, down int64, err error) {
+			counts <- [2]int64{up, down}
+		}))...)
+		srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		go srv.Serve(srvLn) // nolint: errcheck
+
+		conn, err := net.Dial("tcp", srvLn.Addr().String())
+		require.NoError(t, err)
+		// the payload is pipelined with the request
+		req := statute.Request{
+			Version: statute.VersionSocks5,
+			Command: statute.CommandConnect,
+			DstAddr: statute.AddrSpec{IP: lAddr.IP, Port: lAddr.Port, AddrType: statute.ATYPIPv4},
+		}
+		msg := append([]byte{statute.VersionSocks5, 1, statute.MethodNoAuth}, req.Bytes()...)
+		go conn.Write(append(msg, payload...)) // nolint: errcheck
+
+		out := make([]byte, 2+10+len(payload))
+		_, err = io.ReadFull(conn, out)
+		require.NoError(t, err)
+		require.Equal(t, statute.RepSuccess, out[3])
+		require.Equal(t, payload, out[12:])
+		conn.Close()
+
+		select {
+		case c := <-counts:
+			require.Equal(t, [2]int64{int64(len(payload)), int64(len(payload))}, c)
+		case <-time.After(time.Second):
+			t.Fatal("session end not called")
+		}
+		srv.Close()
+	}
+}
+
+func TestRequest_AllowedCommands(t *testing.T) {
+	s := &Server{
+		rules:           NewPermitAll(),
+		resolver:        DNSResolver{},
+		logger:          NewLogger(log.New(os.Stdout, "socks5: ", log.LstdFlags)),
+		bufferPool:      bufferpool.NewPool(32 * 1024),
+		allowedCommands: map[uint8]bool{statute.CommandConnect: true},
+	}
+	for _, cmd := range []byte{statute.CommandBind, statute.CommandAssociate} {
+		// the fqdn is never resolved
+		req := statute.Request{
+			Version: statute.VersionSocks5,
+			Command: cmd,
+			DstAddr: statute.AddrSpec{FQDN: "nonexistent.invalid", Port: 80, AddrType: statute.ATYPDomain},
+		}
+		request, err := ParseRequest(bytes.NewReader(req.Bytes()))
+		require.NoError(t, err)
+		rsp := new(MockConn)
+		require.Error(t, s.handleRequest(context.Background(), rsp, request))
+		require.Equal(t, statute.RepCommandNotSupported, rsp.buf.Bytes()[1])
+		require.Nil(t, request.RawDestAddr.IP)
+	}
+}
@@ -0,0 +1,100 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// idleTimer invokes onIdle once no activity is reported within the timeout
+type idleTimer struct {
+	timeout time.Duration
+	last    int64 // unix nano of last activity, accessed atomically
+	done    chan struct{}
+}
+
+// newIdleTimer new idle timer, onIdle is called at most once
+func newIdleTimer(timeout time.Duration, onIdle func()) *idleTimer {
+	t := &idleTimer{
+		timeout: timeout,
+		last:    time.Now().UnixNano(),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		for {
+			select {
+			case <-t.done:
+				return
+			case <-timer.C:
+				idle := time.Since(time.Unix(0, atomic.LoadInt64(&t.last)))
+				if idle >= timeout {
+					onIdle()
+					return
+				}
+				timer.Reset(timeout - idle)
+			}
+		}
+	}()
+	return t
+}
+
+// touch reports activity, resets the idle timeout
+func (sf *idleTimer) touch() {
+	atomic.StoreInt64(&sf.last, time.Now().UnixNano())
+}
+
+// stop the idle timer, a nil timer is a no-op
+func (sf *idleTimer) stop() {
+	if sf != nil {
+		close(sf.done)
+	}
+}
+
+// idleReader reports activity to the idle timer on every successful read
+type idleReader struct {
+	io.Reader
+	timer *idleTimer
+}
+
+func (sf *idleReader) Read(b []byte) (int, error) {
+	n, err := sf.Reader.Read(b)
+	if n > 0 {
+		sf.timer.touch()
+	}
+	return n, err
+}
+
+// deadlineReader sets a rolling read deadline of the conn before every read
+type deadlineReader struct {
+	io.Reader
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (sf *deadlineReader) Read(b []byte) (int, error) {
+	sf.conn.SetReadDeadline(time.Now().Add(sf.timeout)) // nolint: errcheck
+	return sf.Reader.Read(b)
+}
+
+// deadlineWriter sets a rolling write deadline of the conn before every write
+type deadlineWriter struct {
+	io.Writer
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (sf *deadlineWriter) Write(b []byte) (int, error) {
+	sf.conn.SetWriteDeadline(time.Now().Add(sf.timeout)) // nolint: errcheck
+	return sf.Writer.Write(b)
+}
+
+// CloseWrite forwards to the underlying writer if supported
+func (sf *deadlineWriter) CloseWrite() error {
+	if cw, ok := sf.Writer.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
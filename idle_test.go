@@ -0,0 +1,72 @@
+package socks5
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdleTimer(t *testing.T) {
+	var fired int32
+	timer := newIdleTimer(50*time.Millisecond, func() { atomic.StoreInt32(&fired, 1) })
+
+	// activity keeps the timer alive
+	r := &idleReader{bytes.NewReader(make([]byte, 8)), timer}
+	for i := 0; i < 4; i++ {
+		time.Sleep(20 * time.Millisecond)
+		_, err := r.Read(make([]byte, 1))
+		require.NoError(t, err)
+	}
+	require.Equal(t, int32(0), atomic.LoadInt32(&fired))
+
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&fired) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// stopped timer never fires
+	atomic.StoreInt32(&fired, 0)
+	timer = newIdleTimer(10*time.Millisecond, func() { atomic.StoreInt32(&fired, 1) })
+	timer.stop()
+	time.Sleep(30 * time.Millisecond)
+	require.Equal(t, int32(0), atomic.LoadInt32(&fired))
+}
+
+func TestDeadlineWriter(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	// nobody reads from the pipe, the write is blocked until the deadline
+	w := &deadlineWriter{c1, c1, 50 * time.Millisecond}
+	start := time.Now()
+	_, err := w.Write([]byte("hello"))
+	require.Error(t, err)
+	nerr, ok := err.(net.Error)
+	require.True(t, ok)
+	require.True(t, nerr.Timeout())
+	require.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestDeadlineReader(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	go c2.Write([]byte("hi")) // nolint: errcheck
+
+	r := &deadlineReader{c1, c1, 50 * time.Millisecond}
+	buf := make([]byte, 2)
+	n, err := r.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "hi", string(buf[:n]))
+
+	// nothing more, the read times out
+	_, err = r.Read(buf)
+	nerr, ok := err.(net.Error)
+	require.True(t, ok)
+	require.True(t, nerr.Timeout())
+}
@@ -0,0 +1,170 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket rate limiter, which the tokens are bytes,
+// *rate.Limiter of golang.org/x/time/rate implements it.
+type Limiter interface {
+	// WaitN blocks until n tokens are available.
+	WaitN(ctx context.Context, n int) error
+	// Burst returns the maximum tokens can be consumed in a single call.
+	Burst() int
+}
+
+// limitedReader limits the read rate with the limiter,
+// every read waits for tokens of the bytes it read.
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter Limiter
+}
+
+func (sf *limitedReader) Read(b []byte) (int, error) {
+	// never read more than burst, otherwise it can't wait enough tokens
+	if burst := sf.limiter.Burst(); burst > 0 && len(b) > burst {
+		b = b[:burst]
+	}
+	n, err := sf.r.Read(b)
+	if n > 0 {
+		if e := sf.limiter.WaitN(sf.ctx, n); e != nil {
+			return n, e
+		}
+	}
+	return n, err
+}
+
+// ipBucketGCInterval the interval to collect the idle ip buckets
+const ipBucketGCInterval = time.Minute
+
+// maxBucketChunk the max tokens consumed by a single wait of the tokenBucket,
+// so that a heavy session can't starve the others sharing the bucket.
+const maxBucketChunk = 16 * 1024
+
+// tokenBucket is a Limiter shared by the sessions, the waits reserve the tokens
+// in the order they arrive, so that the sessions get served in turn.
+type tokenBucket struct {
+	rate  float64 // tokens per second
+	burst int
+
+	mu     sync.Mutex
+	tokens float64 // negative means reserved by the waits in future
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: float64(burst), last: time.Now()}
+}
+
+// WaitN implement interface Limiter
+func (sf *tokenBucket) WaitN(ctx context.Context, n int) error {
+	sf.mu.Lock()
+	now := time.Now()
+	sf.tokens += now.Sub(sf.last).Seconds() * sf.rate
+	if sf.tokens > float64(sf.burst) {
+		sf.tokens = float64(sf.burst)
+	}
+	sf.last = now
+	sf.tokens -= float64(n)
+	tokens := sf.tokens
+	sf.mu.Unlock()
+	if tokens >= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Duration(-tokens / sf.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// give back the reservation
+		sf.mu.Lock()
+		sf.tokens += float64(n)
+		sf.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Burst implement interface Limiter
+func (sf *tokenBucket) Burst() int {
+	if sf.burst > maxBucketChunk {
+		return maxBucketChunk
+	}
+	return sf.burst
+}
+
+// ipRateLimiter is a token bucket limiter keyed by the ip,
+// the idle buckets which have been refilled full are collected periodically.
+type ipRateLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*ipBucket
+	lastGC  time.Time
+	now     func() time.Time
+}
+
+type ipBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newIPRateLimiter(rate float64, burst int) *ipRateLimiter {
+	return &ipRateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*ipBucket),
+		now:     time.Now,
+	}
+}
+
+// allow reports whether a token of the ip is available, and consumes it if so.
+func (sf *ipRateLimiter) allow(ip string) bool {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	now := sf.now()
+	if now.Sub(sf.lastGC) >= ipBucketGCInterval {
+		sf.lastGC = now
+		for k, b := range sf.buckets {
+			if sf.refill(b, now) >= sf.burst {
+				delete(sf.buckets, k)
+			}
+		}
+	}
+
+	b, ok := sf.buckets[ip]
+	if !ok {
+		b = &ipBucket{tokens: sf.burst, last: now}
+		sf.buckets[ip] = b
+	}
+	b.tokens = sf.refill(b, now)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// refill returns the tokens of the bucket at now
+func (sf *ipRateLimiter) refill(b *ipBucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*sf.rate
+	if tokens > sf.burst {
+		tokens = sf.burst
+	}
+	return tokens
+}
+
+// len returns the number of the buckets
+func (sf *ipRateLimiter) len() int {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	return len(sf.buckets)
+}
@@ -0,0 +1,84 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockLimiter struct {
+	burst int
+	waits []int
+}
+
+func (sf *mockLimiter) WaitN(_ context.Context, n int) error {
+	sf.waits = append(sf.waits, n)
+	return nil
+}
+
+func (sf *mockLimiter) Burst() int { return sf.burst }
+
+func TestLimitedReader(t *testing.T) {
+	limiter := &mockLimiter{burst: 4}
+	r := &limitedReader{context.Background(), bytes.NewReader([]byte("0123456789")), limiter}
+
+	b, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("0123456789"), b)
+	assert.Equal(t, []int{4, 4, 2}, limiter.waits)
+}
+
+func TestIPRateLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newIPRateLimiter(2, 3)
+	l.now = func() time.Time { return now }
+
+	// burst
+	for i := 0; i < 3; i++ {
+		require.True(t, l.allow("10.0.0.1"))
+	}
+	require.False(t, l.allow("10.0.0.1"))
+	// other ip has its own bucket
+	require.True(t, l.allow("10.0.0.2"))
+
+	// refill 2 tokens per second
+	now = now.Add(500 * time.Millisecond)
+	require.True(t, l.allow("10.0.0.1"))
+	require.False(t, l.allow("10.0.0.1"))
+	require.Equal(t, 2, l.len())
+
+	// the idle buckets are collected
+	now = now.Add(ipBucketGCInterval)
+	require.True(t, l.allow("10.0.0.3"))
+	require.Equal(t, 1, l.len())
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(10000, 1000)
+	require.Equal(t, 1000, b.Burst())
+	require.Equal(t, maxBucketChunk, newTokenBucket(1<<20, 1<<20).Burst())
+
+	ctx := context.Background()
+	start := time.Now()
+	require.NoError(t, b.WaitN(ctx, 1000))
+	require.Less(t, int64(time.Since(start)), int64(20*time.Millisecond))
+
+	// 500 tokens takes 50ms to refill
+	start = time.Now()
+	require.NoError(t, b.WaitN(ctx, 500))
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(40*time.Millisecond))
+
+	// the canceled wait gives back the reservation
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	require.Error(t, b.WaitN(cctx, 1000))
+	b.mu.Lock()
+	tokens := b.tokens
+	b.mu.Unlock()
+	require.Greater(t, tokens, float64(0))
+}
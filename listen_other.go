@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package socks5
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePortControl SO_REUSEPORT only supported on linux
+func reusePortControl(string, string, syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT not supported on this platform")
+}
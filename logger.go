@@ -1,7 +1,12 @@
 package socks5
 
 import (
+	"io"
 	"log"
+	"net"
+	"sync/atomic"
+
+	"github.com/thinkgos/go-socks5/statute"
 )
 
 // Logger is used to provide debug logger
@@ -9,6 +14,30 @@ type Logger interface {
 	Errorf(format string, arg ...interface{})
 }
 
+// WarnLogger is a Logger which supports warn level,
+// the warnings are logged at error level if the logger does not implement it.
+type WarnLogger interface {
+	Warnf(format string, arg ...interface{})
+}
+
+// InfoLogger is a Logger which supports info level,
+// the info messages are dropped if the logger does not implement it.
+type InfoLogger interface {
+	Infof(format string, arg ...interface{})
+}
+
+// DebugLogger is a Logger which supports debug level,
+// the debug messages are dropped if the logger does not implement it.
+type DebugLogger interface {
+	Debugf(format string, arg ...interface{})
+}
+
+// EventLogger is used to provide structured logger,
+// the events are logged with alternating key/value pairs.
+type EventLogger interface {
+	Event(msg string, keyvals ...interface{})
+}
+
 // Std std logger
 type Std struct {
 	*log.Logger
@@ -23,3 +52,76 @@ func NewLogger(l *log.Logger) *Std {
 func (sf Std) Errorf(format string, args ...interface{}) {
 	sf.Logger.Printf("[E]: "+format, args...)
 }
+
+// Warnf implement interface WarnLogger
+func (sf Std) Warnf(format string, args ...interface{}) {
+	sf.Logger.Printf("[W]: "+format, args...)
+}
+
+// Infof implement interface InfoLogger
+func (sf Std) Infof(format string, args ...interface{}) {
+	sf.Logger.Printf("[I]: "+format, args...)
+}
+
+// warnf logs at warn level if supported by the logger, otherwise at error level.
+func (sf *Server) warnf(format string, args ...interface{}) {
+	if wl, ok := sf.logger.(WarnLogger); ok {
+		wl.Warnf(format, args...)
+		return
+	}
+	sf.logger.Errorf(format, args...)
+}
+
+// infof logs at info level if supported by the logger
+func (sf *Server) infof(format string, args ...interface{}) {
+	if il, ok := sf.logger.(InfoLogger); ok {
+		il.Infof(format, args...)
+	}
+}
+
+// debugf logs at debug level if supported by the logger
+func (sf *Server) debugf(format string, args ...interface{}) {
+	if dl, ok := sf.logger.(DebugLogger); ok {
+		dl.Debugf(format, args...)
+	}
+}
+
+// event logs the structured event if the event logger provided
+func (sf *Server) event(msg string, keyvals ...interface{}) {
+	if sf.eventLogger != nil {
+		sf.eventLogger.Event(msg, keyvals...)
+	}
+}
+
+// addrString returns the string of addr, empty if nil
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// authMethod returns the auth method of the auth context, MethodNoAcceptable if nil
+func authMethod(authContext *AuthContext) uint8 {
+	if authContext == nil {
+		return statute.MethodNoAcceptable
+	}
+	return authContext.Method
+}
+
+// countReader counts the bytes read
+type countReader struct {
+	io.Reader
+	n int64 // accessed atomically
+}
+
+func (sf *countReader) Read(b []byte) (int, error) {
+	n, err := sf.Reader.Read(b)
+	atomic.AddInt64(&sf.n, int64(n))
+	return n, err
+}
+
+// Count returns the bytes read so far
+func (sf *countReader) Count() int64 {
+	return atomic.LoadInt64(&sf.n)
+}
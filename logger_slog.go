@@ -0,0 +1,53 @@
+//go:build go1.21
+// +build go1.21
+
+package socks5
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// SlogLogger is a Logger and EventLogger backed by log/slog
+type SlogLogger struct {
+	*slog.Logger
+}
+
+var _ Logger = SlogLogger{}
+var _ DebugLogger = SlogLogger{}
+var _ WarnLogger = SlogLogger{}
+var _ InfoLogger = SlogLogger{}
+var _ EventLogger = SlogLogger{}
+
+// NewSlogLogger new a slog logger, use slog.Default() if l is nil
+func NewSlogLogger(l *slog.Logger) SlogLogger {
+	if l == nil {
+		l = slog.Default()
+	}
+	return SlogLogger{l}
+}
+
+// Errorf implement interface Logger
+func (sf SlogLogger) Errorf(format string, args ...interface{}) {
+	sf.Logger.Error(fmt.Sprintf(format, args...))
+}
+
+// Debugf implement interface DebugLogger
+func (sf SlogLogger) Debugf(format string, args ...interface{}) {
+	sf.Logger.Debug(fmt.Sprintf(format, args...))
+}
+
+// Warnf implement interface WarnLogger
+func (sf SlogLogger) Warnf(format string, args ...interface{}) {
+	sf.Logger.Warn(fmt.Sprintf(format, args...))
+}
+
+// Infof implement interface InfoLogger
+func (sf SlogLogger) Infof(format string, args ...interface{}) {
+	sf.Logger.Info(fmt.Sprintf(format, args...))
+}
+
+// Event implement interface EventLogger
+func (sf SlogLogger) Event(msg string, keyvals ...interface{}) {
+	sf.Logger.Info(msg, keyvals...)
+}
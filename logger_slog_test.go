@@ -0,0 +1,82 @@
+//go:build go1.21
+// +build go1.21
+
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+)
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (sf *syncBuffer) Write(b []byte) (int, error) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	return sf.buf.Write(b)
+}
+
+func (sf *syncBuffer) String() string {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	return sf.buf.String()
+}
+
+func TestSlogLogger_Events(t *testing.T) {
+	// Create a local listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn) // nolint: errcheck
+	}()
+
+	out := &syncBuffer{}
+	srv := NewServer(WithLogger(NewSlogLogger(slog.New(slog.NewTextHandler(out, nil)))))
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	dial, err := proxy.SOCKS5("tcp", srvLn.Addr().String(), nil, proxy.Direct)
+	require.NoError(t, err)
+	conn, err := dial.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 4))
+	require.NoError(t, err)
+	conn.Close()
+
+	require.Eventually(t, func() bool {
+		return strings.Contains(out.String(), "relay finished")
+	}, time.Second, 10*time.Millisecond)
+
+	logs := out.String()
+	require.Contains(t, logs, `msg="connection accepted"`)
+	require.Contains(t, logs, `msg=authenticate`)
+	require.Contains(t, logs, `ok=true`)
+	require.Contains(t, logs, `msg="request dispatched"`)
+	require.Contains(t, logs, "destination="+l.Addr().String())
+	require.Contains(t, logs, "upstream_bytes=4")
+	require.Contains(t, logs, "downstream_bytes=4")
+}
@@ -0,0 +1,77 @@
+package socks5
+
+import (
+	"io"
+	"time"
+)
+
+// Metrics is used to collect the server metrics,
+// the implementation must be safe for concurrent use.
+type Metrics interface {
+	// ConnAccepted is called when a connection is accepted.
+	ConnAccepted()
+	// AuthResult is called when the authentication finished,
+	// method is MethodNoAcceptable if no method negotiated.
+	AuthResult(method uint8, ok bool)
+	// RequestHandled is called when the (first) reply of the request has been sent,
+	// dur is the elapsed time since the request handling started.
+	RequestHandled(cmd uint8, reply uint8, dur time.Duration)
+	// BytesTransferred is called when the relay finished,
+	// up is client to target, down is target to client.
+	BytesTransferred(up, down int64)
+}
+
+// NopMetrics is a no-op Metrics
+type NopMetrics struct{}
+
+var _ Metrics = NopMetrics{}
+
+// ConnAccepted implement interface Metrics
+func (NopMetrics) ConnAccepted() {}
+
+// AuthResult implement interface Metrics
+func (NopMetrics) AuthResult(uint8, bool) {}
+
+// RequestHandled implement interface Metrics
+func (NopMetrics) RequestHandled(uint8, uint8, time.Duration) {}
+
+// BytesTransferred implement interface Metrics
+func (NopMetrics) BytesTransferred(int64, int64) {}
+
+// getMetrics returns the metrics, NopMetrics if not provided
+func (sf *Server) getMetrics() Metrics {
+	if sf.metrics == nil {
+		return NopMetrics{}
+	}
+	return sf.metrics
+}
+
+// replyRecorder reports the first reply written to the client
+type replyRecorder struct {
+	io.Writer
+	metrics Metrics
+	cmd     uint8
+	start   time.Time
+	done    bool
+	rep     uint8
+	delay   func() // optional, called before the first reply
+}
+
+func (sf *replyRecorder) Write(b []byte) (int, error) {
+	if !sf.done && len(b) >= 2 {
+		if sf.delay != nil {
+			sf.delay()
+		}
+		sf.done, sf.rep = true, b[1]
+		sf.metrics.RequestHandled(sf.cmd, b[1], time.Since(sf.start))
+	}
+	return sf.Writer.Write(b)
+}
+
+// CloseWrite forwards to the underlying writer if supported
+func (sf *replyRecorder) CloseWrite() error {
+	if cw, ok := sf.Writer.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
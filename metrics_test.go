@@ -0,0 +1,129 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+
+	"github.com/thinkgos/go-socks5/statute"
+)
+
+type mockMetrics struct {
+	mu       sync.Mutex
+	accepted int
+	auths    []uint8
+	failures []uint8
+	replies  []uint8
+	up, down int64
+}
+
+func (sf *mockMetrics) ConnAccepted() {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	sf.accepted++
+}
+
+func (sf *mockMetrics) AuthResult(method uint8, ok bool) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	if ok {
+		sf.auths = append(sf.auths, method)
+	} else {
+		sf.failures = append(sf.failures, method)
+	}
+}
+
+func (sf *mockMetrics) RequestHandled(_ uint8, reply uint8, _ time.Duration) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	sf.replies = append(sf.replies, reply)
+}
+
+func (sf *mockMetrics) BytesTransferred(up, down int64) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	sf.up += up
+	sf.down += down
+}
+
+func TestServer_Metrics(t *testing.T) {
+	// Create a local listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 4)
+		io.ReadFull(conn, buf)          // nolint: errcheck
+		conn.Write([]byte("pong-pong")) // nolint: errcheck
+	}()
+
+	m := &mockMetrics{}
+	srv := NewServer(WithMetrics(m))
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	dial, err := proxy.SOCKS5("tcp", srvLn.Addr().String(), nil, proxy.Direct)
+	require.NoError(t, err)
+	conn, err := dial.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 9))
+	require.NoError(t, err)
+	conn.Close()
+
+	require.Eventually(t, func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return m.up == 4 && m.down == 9
+	}, time.Second, 10*time.Millisecond)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	require.Equal(t, 1, m.accepted)
+	require.Equal(t, []uint8{statute.MethodNoAuth}, m.auths)
+	require.Equal(t, []uint8{statute.RepSuccess}, m.replies)
+}
+
+func TestServer_Metrics_AuthFailure(t *testing.T) {
+	m := &mockMetrics{}
+	srv := NewServer(WithMetrics(m), WithCredential(StaticCredentials{"foo": "bar"}))
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	// the wrong password
+	dial, err := proxy.SOCKS5("tcp", srvLn.Addr().String(), &proxy.Auth{User: "foo", Password: "baz"}, proxy.Direct)
+	require.NoError(t, err)
+	_, err = dial.Dial("tcp", "127.0.0.1:1")
+	require.Error(t, err)
+
+	// no acceptable method
+	dial, err = proxy.SOCKS5("tcp", srvLn.Addr().String(), nil, proxy.Direct)
+	require.NoError(t, err)
+	_, err = dial.Dial("tcp", "127.0.0.1:1")
+	require.Error(t, err)
+
+	require.Eventually(t, func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return len(m.failures) == 2
+	}, time.Second, 10*time.Millisecond)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	require.Equal(t, []uint8{statute.MethodUserPassAuth, statute.MethodNoAcceptable}, m.failures)
+}
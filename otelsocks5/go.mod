@@ -0,0 +1,26 @@
+module github.com/thinkgos/go-socks5/otelsocks5
+
+// go 1.23.0 is the minimum required by go.opentelemetry.io/otel v1.38.0
+go 1.23.0
+
+require (
+	github.com/stretchr/testify v1.11.1
+	github.com/thinkgos/go-socks5 v0.0.0-20261015081017-b583a515e825
+	go.opentelemetry.io/otel v1.38.0
+	go.opentelemetry.io/otel/sdk v1.38.0
+	go.opentelemetry.io/otel/trace v1.38.0
+	golang.org/x/net v0.0.0-20200324143707-d3edc9973b7e
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/go-logr/logr v1.4.3 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	go.opentelemetry.io/auto/sdk v1.1.0 // indirect
+	go.opentelemetry.io/otel/metric v1.38.0 // indirect
+	golang.org/x/crypto v0.0.0-20200820211705-5c72a883971a // indirect
+	golang.org/x/sys v0.35.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
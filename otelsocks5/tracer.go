@@ -0,0 +1,89 @@
+// Package otelsocks5 implements the socks5 server RequestTracer with OpenTelemetry.
+// It is a separate module so that the socks5 module has no dependency on OpenTelemetry.
+package otelsocks5
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/thinkgos/go-socks5"
+	"github.com/thinkgos/go-socks5/statute"
+)
+
+const instrumentationName = "github.com/thinkgos/go-socks5/otelsocks5"
+
+// Tracer implement socks5.RequestTracer, a span is started per request named by the command,
+// with the attributes of the client, destination, auth method and reply code.
+// The span is the child of the span context in the request context if any, e.g. the
+// trace context propagated by the client via socks5.WithConnContext, otherwise a root span.
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+var _ socks5.RequestTracer = (*Tracer)(nil)
+
+// New new tracer with the tracer provider, nil means the global one.
+func New(tp trace.TracerProvider) *Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return &Tracer{tp.Tracer(instrumentationName)}
+}
+
+// WithTracerProvider traces the requests of the server with the tracer provider.
+func WithTracerProvider(tp trace.TracerProvider) socks5.Option {
+	return socks5.WithRequestTracer(New(tp))
+}
+
+// StartRequest implement interface socks5.RequestTracer
+func (sf *Tracer) StartRequest(ctx context.Context, req *socks5.Request) (context.Context, socks5.RequestSpan) {
+	attrs := []attribute.KeyValue{
+		attribute.Int("socks5.command", int(req.Command)),
+		attribute.String("socks5.destination", req.RawDestAddr.String()),
+	}
+	if req.RemoteAddr != nil {
+		attrs = append(attrs, attribute.String("client.address", req.RemoteAddr.String()))
+	}
+	if req.AuthContext != nil {
+		attrs = append(attrs, attribute.Int("socks5.auth_method", int(req.AuthContext.Method)))
+	}
+	ctx, span := sf.tracer.Start(ctx, spanName(req.Command),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrs...))
+	return ctx, requestSpan{span}
+}
+
+type requestSpan struct {
+	span trace.Span
+}
+
+// End implement interface socks5.RequestSpan
+func (sf requestSpan) End(req *socks5.Request, replied bool, reply uint8, err error) {
+	if req.DestAddr != nil && req.DestAddr.String() != req.RawDestAddr.String() {
+		sf.span.SetAttributes(attribute.String("socks5.rewritten_destination", req.DestAddr.String()))
+	}
+	if replied {
+		sf.span.SetAttributes(attribute.Int("socks5.reply", int(reply)))
+	}
+	if err != nil {
+		sf.span.RecordError(err)
+		sf.span.SetStatus(codes.Error, err.Error())
+	}
+	sf.span.End()
+}
+
+func spanName(cmd uint8) string {
+	switch cmd {
+	case statute.CommandConnect:
+		return "socks5.connect"
+	case statute.CommandBind:
+		return "socks5.bind"
+	case statute.CommandAssociate:
+		return "socks5.associate"
+	}
+	return "socks5.request"
+}
@@ -0,0 +1,57 @@
+package otelsocks5
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/proxy"
+
+	"github.com/thinkgos/go-socks5"
+	"github.com/thinkgos/go-socks5/statute"
+)
+
+func TestTracer(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	parent := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{2},
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	})
+
+	srv := socks5.NewServer(
+		WithTracerProvider(tp),
+		socks5.WithConnContext(func(ctx context.Context, conn net.Conn) context.Context {
+			return trace.ContextWithRemoteSpanContext(ctx, parent)
+		}),
+	)
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	dial, err := proxy.SOCKS5("tcp", srvLn.Addr().String(), nil, proxy.Direct)
+	require.NoError(t, err)
+	_, err = dial.Dial("tcp", "127.0.0.1:1")
+	require.Error(t, err)
+
+	require.Eventually(t, func() bool { return len(recorder.Ended()) == 1 }, time.Second, 10*time.Millisecond)
+	span := recorder.Ended()[0]
+	require.Equal(t, "socks5.connect", span.Name())
+	require.Equal(t, trace.SpanKindServer, span.SpanKind())
+	require.Equal(t, parent.TraceID(), span.SpanContext().TraceID())
+	require.Equal(t, parent.SpanID(), span.Parent().SpanID())
+	require.Equal(t, codes.Error, span.Status().Code)
+	require.Contains(t, span.Attributes(), attribute.String("socks5.destination", "127.0.0.1:1"))
+	require.Contains(t, span.Attributes(), attribute.Int("socks5.reply", int(statute.RepConnectionRefused)))
+	require.Contains(t, span.Attributes(), attribute.Int("socks5.auth_method", int(statute.MethodNoAuth)))
+}
@@ -0,0 +1,52 @@
+//go:build linux && go1.16
+// +build linux,go1.16
+
+package socks5
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// DropPrivileges switches the process to the user, such as "nobody", with its primary
+// and supplementary groups, typically by WithAfterListen once the privileged port is
+// listened. It applies to all the threads of the process and can not be undone.
+// It's only supported on linux.
+func DropPrivileges(username string) error {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("invalid uid %q of user %s", u.Uid, username)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return fmt.Errorf("invalid gid %q of user %s", u.Gid, username)
+	}
+	groupIds, err := u.GroupIds()
+	if err != nil {
+		return err
+	}
+	groups := make([]int, 0, len(groupIds))
+	for _, g := range groupIds {
+		if id, err := strconv.Atoi(g); err == nil {
+			groups = append(groups, id)
+		}
+	}
+
+	// the groups first, they can not be changed once the uid dropped
+	if err = syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("setgroups failed, %w", err)
+	}
+	if err = syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid %d failed, %w", gid, err)
+	}
+	if err = syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid %d failed, %w", uid, err)
+	}
+	return nil
+}
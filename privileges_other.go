@@ -0,0 +1,13 @@
+//go:build !linux || !go1.16
+// +build !linux !go1.16
+
+package socks5
+
+import (
+	"errors"
+)
+
+// DropPrivileges switching the user only supported on linux
+func DropPrivileges(string) error {
+	return errors.New("dropping privileges not supported on this platform")
+}
@@ -0,0 +1,95 @@
+// Package promsocks5 implements the socks5 server Metrics with prometheus.
+package promsocks5
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/thinkgos/go-socks5"
+)
+
+// Metrics implement socks5.Metrics and prometheus.Collector,
+// register it to a prometheus registry and use it with socks5.WithMetrics.
+type Metrics struct {
+	connAccepted prometheus.Counter
+	authResults  *prometheus.CounterVec
+	requests     *prometheus.HistogramVec
+	bytes        *prometheus.CounterVec
+}
+
+var _ socks5.Metrics = (*Metrics)(nil)
+var _ prometheus.Collector = (*Metrics)(nil)
+
+// New new prometheus metrics with the namespace
+func New(namespace string) *Metrics {
+	return &Metrics{
+		connAccepted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "socks5",
+			Name:      "connections_accepted_total",
+			Help:      "Total number of connections accepted.",
+		}),
+		authResults: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "socks5",
+			Name:      "auth_total",
+			Help:      "Total number of authentications by method and result.",
+		}, []string{"method", "result"}),
+		requests: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "socks5",
+			Name:      "request_duration_seconds",
+			Help:      "Duration until the request replied, by command and reply code.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"command", "reply"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "socks5",
+			Name:      "transferred_bytes_total",
+			Help:      "Total number of bytes relayed by direction.",
+		}, []string{"direction"}),
+	}
+}
+
+// ConnAccepted implement interface socks5.Metrics
+func (sf *Metrics) ConnAccepted() {
+	sf.connAccepted.Inc()
+}
+
+// AuthResult implement interface socks5.Metrics
+func (sf *Metrics) AuthResult(method uint8, ok bool) {
+	result := "failure"
+	if ok {
+		result = "success"
+	}
+	sf.authResults.WithLabelValues(strconv.Itoa(int(method)), result).Inc()
+}
+
+// RequestHandled implement interface socks5.Metrics
+func (sf *Metrics) RequestHandled(cmd uint8, reply uint8, dur time.Duration) {
+	sf.requests.WithLabelValues(strconv.Itoa(int(cmd)), strconv.Itoa(int(reply))).Observe(dur.Seconds())
+}
+
+// BytesTransferred implement interface socks5.Metrics
+func (sf *Metrics) BytesTransferred(up, down int64) {
+	sf.bytes.WithLabelValues("up").Add(float64(up))
+	sf.bytes.WithLabelValues("down").Add(float64(down))
+}
+
+// Describe implement interface prometheus.Collector
+func (sf *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	sf.connAccepted.Describe(ch)
+	sf.authResults.Describe(ch)
+	sf.requests.Describe(ch)
+	sf.bytes.Describe(ch)
+}
+
+// Collect implement interface prometheus.Collector
+func (sf *Metrics) Collect(ch chan<- prometheus.Metric) {
+	sf.connAccepted.Collect(ch)
+	sf.authResults.Collect(ch)
+	sf.requests.Collect(ch)
+	sf.bytes.Collect(ch)
+}
@@ -0,0 +1,37 @@
+package promsocks5
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thinkgos/go-socks5/statute"
+)
+
+func TestMetrics(t *testing.T) {
+	m := New("test")
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, reg.Register(m))
+
+	m.ConnAccepted()
+	m.ConnAccepted()
+	m.AuthResult(statute.MethodUserPassAuth, true)
+	m.AuthResult(statute.MethodUserPassAuth, false)
+	m.AuthResult(statute.MethodUserPassAuth, false)
+	m.RequestHandled(statute.CommandConnect, statute.RepSuccess, 10*time.Millisecond)
+	m.BytesTransferred(10, 20)
+	m.BytesTransferred(1, 2)
+
+	require.Equal(t, float64(2), testutil.ToFloat64(m.connAccepted))
+	require.Equal(t, float64(1), testutil.ToFloat64(m.authResults.WithLabelValues("2", "success")))
+	require.Equal(t, float64(2), testutil.ToFloat64(m.authResults.WithLabelValues("2", "failure")))
+	require.Equal(t, float64(11), testutil.ToFloat64(m.bytes.WithLabelValues("up")))
+	require.Equal(t, float64(22), testutil.ToFloat64(m.bytes.WithLabelValues("down")))
+
+	n, err := testutil.GatherAndCount(reg, "test_socks5_request_duration_seconds")
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+}
@@ -0,0 +1,155 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ErrNoProxyHeader is returned when the PROXY protocol header is required but missing
+var ErrNoProxyHeader = errors.New("socks5: missing PROXY protocol header")
+
+// proxyV2Signature the signature of the PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyV1MaxLen the maximum length of the PROXY protocol v1 header, including the CRLF
+const proxyV1MaxLen = 107
+
+// proxyProtoConn is the client connection behind a load balancer, whose remote address
+// is the client address carried by the PROXY protocol header.
+type proxyProtoConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (sf *proxyProtoConn) Read(b []byte) (int, error) { return sf.r.Read(b) }
+
+// RemoteAddr returns the client address of the PROXY protocol header
+func (sf *proxyProtoConn) RemoteAddr() net.Addr { return sf.remote }
+
+// CloseWrite forwards to the underlying connection if supported
+func (sf *proxyProtoConn) CloseWrite() error {
+	if cw, ok := sf.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// readProxyHeader reads the PROXY protocol v1 or v2 header at the start of the connection,
+// returns the connection whose remote address is the client address of the header. The
+// connection without the header is returned as it is if lenient, otherwise ErrNoProxyHeader.
+func readProxyHeader(conn net.Conn, lenient bool) (net.Conn, error) {
+	br := bufio.NewReader(conn)
+	remote, err := parseProxyHeader(br)
+	if err != nil {
+		if err != ErrNoProxyHeader || !lenient {
+			return nil, err
+		}
+	}
+	if remote == nil {
+		// the LOCAL command, the UNKNOWN protocol or no header at all
+		remote = conn.RemoteAddr()
+	}
+	return &proxyProtoConn{conn, br, remote}, nil
+}
+
+// parseProxyHeader parses the PROXY protocol header, returns nil address if the header
+// carries no client address, ErrNoProxyHeader if the connection does not start with it.
+func parseProxyHeader(br *bufio.Reader) (net.Addr, error) {
+	first, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	// the socks requests start with the version byte, never peek beyond the header signature
+	switch first[0] {
+	case 'P':
+		if sig, err := br.Peek(6); err != nil || string(sig) != "PROXY " {
+			return nil, ErrNoProxyHeader
+		}
+		return parseProxyV1(br)
+	case proxyV2Signature[0]:
+		if sig, err := br.Peek(len(proxyV2Signature)); err != nil || !bytes.Equal(sig, proxyV2Signature) {
+			return nil, ErrNoProxyHeader
+		}
+		return parseProxyV2(br)
+	default:
+		return nil, ErrNoProxyHeader
+	}
+}
+
+// parseProxyV1 parses the human-readable header, such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 1080\r\n".
+func parseProxyV1(br *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read PROXY v1 header, %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("invalid PROXY v1 header, line too long or not terminated by CRLF")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("invalid PROXY v1 header %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// parseProxyV2 parses the binary header
+func parseProxyV2(br *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY v2 header, %w", err)
+	}
+	verCmd, family := hdr[12], hdr[13]
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("invalid PROXY v2 version %d", verCmd>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY v2 addresses, %w", err)
+	}
+	switch verCmd & 0x0f {
+	case 0x00: // LOCAL, such as the health check of the balancer
+		return nil, nil
+	case 0x01: // PROXY
+	default:
+		return nil, fmt.Errorf("invalid PROXY v2 command %d", verCmd&0x0f)
+	}
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, errors.New("invalid PROXY v2 header, short IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[:4]), Port: int(binary.BigEndian.Uint16(payload[8:]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, errors.New("invalid PROXY v2 header, short IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[:16]), Port: int(binary.BigEndian.Uint16(payload[32:]))}, nil
+	default:
+		// UNSPEC or the unsupported families, the addresses are ignored
+		return nil, nil
+	}
+}
@@ -0,0 +1,103 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/thinkgos/go-socks5/statute"
+)
+
+func proxyV2Header(cmd, family byte, addrs []byte) []byte {
+	b := append([]byte{}, proxyV2Signature...)
+	b = append(b, 0x20|cmd, family, 0, 0)
+	binary.BigEndian.PutUint16(b[14:], uint16(len(addrs)))
+	return append(b, addrs...)
+}
+
+func TestParseProxyHeader(t *testing.T) {
+	parse := func(b []byte) (net.Addr, []byte, error) {
+		br := bufio.NewReader(bytes.NewReader(b))
+		addr, err := parseProxyHeader(br)
+		rest, _ := ioutil.ReadAll(br)
+		return addr, rest, err
+	}
+	socks := []byte{statute.VersionSocks5, 1, statute.MethodNoAuth}
+
+	// v1
+	addr, rest, err := parse(append([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 1080\r\n"), socks...))
+	require.NoError(t, err)
+	require.Equal(t, "192.0.2.1:56324", addr.String())
+	require.Equal(t, socks, rest)
+	addr, _, err = parse([]byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 1080\r\n"))
+	require.NoError(t, err)
+	require.Equal(t, "[2001:db8::1]:56324", addr.String())
+	addr, _, err = parse([]byte("PROXY UNKNOWN\r\n"))
+	require.NoError(t, err)
+	require.Nil(t, addr)
+	_, _, err = parse([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n"))
+	require.Error(t, err)
+	_, _, err = parse([]byte("PROXY TCP4 2001:db8::1 198.51.100.1 56324 1080\r\n"))
+	require.Error(t, err)
+
+	// v2
+	addr, rest, err = parse(append(proxyV2Header(0x01, 0x11, []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x04, 0x38}), socks...))
+	require.NoError(t, err)
+	require.Equal(t, "192.0.2.1:56324", addr.String())
+	require.Equal(t, socks, rest)
+	addr, rest, err = parse(append(proxyV2Header(0x00, 0x00, nil), socks...))
+	require.NoError(t, err)
+	require.Nil(t, addr)
+	require.Equal(t, socks, rest)
+	_, _, err = parse(proxyV2Header(0x01, 0x11, []byte{192, 0, 2, 1}))
+	require.Error(t, err)
+
+	// no header
+	_, rest, err = parse(socks)
+	require.Equal(t, ErrNoProxyHeader, err)
+	require.Equal(t, socks, rest)
+}
+
+func TestServer_ProxyProtocol(t *testing.T) {
+	remotes := make(chan net.Addr, 1)
+	newServer := func(opts ...Option) *Server {
+		return NewServer(append(opts, WithConnectHandle(func(ctx context.Context, writer io.Writer, request *Request) error {
+			remotes <- request.RemoteAddr
+			return SendReply(writer, statute.RepSuccess, nil)
+		}))...)
+	}
+	serve := func(srv *Server, header []byte) error {
+		client, server := net.Pipe()
+		defer client.Close()
+		go func() {
+			client.Write(header) // nolint: errcheck
+			client.Write([]byte{ // nolint: errcheck
+				statute.VersionSocks5, 1, statute.MethodNoAuth,
+				statute.VersionSocks5, statute.CommandConnect, 0, statute.ATYPIPv4, 127, 0, 0, 1, 0, 80,
+			})
+			io.Copy(ioutil.Discard, client) // nolint: errcheck
+		}()
+		return srv.ServeConn(server)
+	}
+
+	// the client address of the header
+	require.NoError(t, serve(newServer(WithProxyProtocol(true)), []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 1080\r\n")))
+	require.Equal(t, "192.0.2.1:56324", (<-remotes).String())
+
+	// the header is required
+	err := serve(newServer(WithProxyProtocol(true)), nil)
+	require.True(t, errors.Is(err, ErrNoProxyHeader))
+	require.True(t, errors.Is(err, ErrRequestParse))
+
+	// lenient
+	require.NoError(t, serve(newServer(WithProxyProtocolLenient(true)), nil))
+	require.Equal(t, "pipe", (<-remotes).Network())
+}
@@ -0,0 +1,104 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/thinkgos/go-socks5/statute"
+)
+
+// ReplyError is the error carrying the reply code, which can be returned by the user's handle,
+// the server sends the reply before closing if nothing has been replied.
+type ReplyError struct {
+	Code uint8
+	Err  error
+}
+
+// Error implement interface error
+func (e ReplyError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("socks5: reply %d", e.Code)
+	}
+	return fmt.Sprintf("socks5: reply %d, %v", e.Code, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e ReplyError) Unwrap() error { return e.Err }
+
+// asReplyError finds the first ReplyError or *ReplyError in err's chain
+func asReplyError(err error) (ReplyError, bool) {
+	var re ReplyError
+	if errors.As(err, &re) {
+		return re, true
+	}
+	var pre *ReplyError
+	if errors.As(err, &pre) && pre != nil {
+		return *pre, true
+	}
+	return re, false
+}
+
+// ReplyCode maps the error to the reply code sent to the client.
+// The ReplyError carries its code, the syscall.Errno in the chain such as the dial
+// *net.OpError is matched: ECONNREFUSED, EHOSTUNREACH, ENETUNREACH and ETIMEDOUT map to
+// the respective code, so does the timeout. The other network errors map to
+// RepHostUnreachable, otherwise RepServerFailure.
+func ReplyCode(err error) uint8 {
+	if err == nil {
+		return statute.RepSuccess
+	}
+	if re, ok := asReplyError(err); ok {
+		return re.Code
+	}
+	var ue *upstreamError
+	if errors.As(err, &ue) {
+		return ue.rep
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.ECONNREFUSED:
+			return statute.RepConnectionRefused
+		case syscall.EHOSTUNREACH:
+			return statute.RepHostUnreachable
+		case syscall.ENETUNREACH:
+			return statute.RepNetworkUnreachable
+		case syscall.ETIMEDOUT:
+			return statute.RepTTLExpired
+		}
+	}
+	if isTimeout(err) {
+		return statute.RepTTLExpired
+	}
+	// the platforms whose errno are not matched
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "refused"):
+		return statute.RepConnectionRefused
+	case strings.Contains(msg, "network is unreachable"):
+		return statute.RepNetworkUnreachable
+	case strings.Contains(msg, "no route to host"), strings.Contains(msg, "host is unreachable"):
+		return statute.RepHostUnreachable
+	}
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return statute.RepHostUnreachable
+	}
+	return statute.RepServerFailure
+}
+
+// dialReplyCode maps the dial error to the reply code, any unknown error maps
+// to RepHostUnreachable.
+func dialReplyCode(err error) uint8 {
+	if rep := ReplyCode(err); rep != statute.RepServerFailure {
+		return rep
+	}
+	var ue *upstreamError
+	if errors.As(err, &ue) {
+		return ue.rep
+	}
+	return statute.RepHostUnreachable
+}
@@ -0,0 +1,94 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/thinkgos/go-socks5/statute"
+)
+
+func TestReplyCode(t *testing.T) {
+	dialErr := func(msg string) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: errors.New(msg)}
+	}
+	errnoErr := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+	}
+	for _, tc := range []struct {
+		err  error
+		want uint8
+	}{
+		{nil, statute.RepSuccess},
+		{ReplyError{Code: statute.RepNetworkUnreachable}, statute.RepNetworkUnreachable},
+		{&ReplyError{Code: statute.RepRuleFailure}, statute.RepRuleFailure},
+		{fmt.Errorf("wrapped, %w", ReplyError{Code: statute.RepTTLExpired}), statute.RepTTLExpired},
+		{&upstreamError{statute.RepConnectionRefused, errors.New("x")}, statute.RepConnectionRefused},
+		{context.DeadlineExceeded, statute.RepTTLExpired},
+		{errnoErr(syscall.ECONNREFUSED), statute.RepConnectionRefused},
+		{errnoErr(syscall.EHOSTUNREACH), statute.RepHostUnreachable},
+		{errnoErr(syscall.ENETUNREACH), statute.RepNetworkUnreachable},
+		{errnoErr(syscall.ETIMEDOUT), statute.RepTTLExpired},
+		{dialErr("connect: connection refused"), statute.RepConnectionRefused},
+		{dialErr("connect: network is unreachable"), statute.RepNetworkUnreachable},
+		{dialErr("connect: no route to host"), statute.RepHostUnreachable},
+		{dialErr("something else"), statute.RepHostUnreachable},
+		{errors.New("something else"), statute.RepServerFailure},
+	} {
+		require.Equal(t, tc.want, ReplyCode(tc.err), "%v", tc.err)
+	}
+	require.Equal(t, statute.RepHostUnreachable, dialReplyCode(errors.New("something else")))
+	require.Equal(t, statute.RepServerFailure, dialReplyCode(&upstreamError{statute.RepServerFailure, errors.New("x")}))
+}
+
+func TestReplyCode_Dial(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	_, err = net.Dial("tcp", addr)
+	require.Error(t, err)
+	require.Equal(t, statute.RepConnectionRefused, ReplyCode(err))
+}
+
+func TestRequest_UserHandleReplyError(t *testing.T) {
+	var replied bool
+	s := NewServer(WithConnectHandle(func(ctx context.Context, writer io.Writer, request *Request) error {
+		if replied {
+			SendReply(writer, statute.RepSuccess, &net.TCPAddr{IP: net.IPv4zero}) // nolint: errcheck
+		}
+		return ReplyError{Code: statute.RepConnectionRefused, Err: errors.New("backend down")}
+	}))
+	request := func() *Request {
+		req := statute.Request{
+			Version: statute.VersionSocks5,
+			Command: statute.CommandConnect,
+			DstAddr: statute.AddrSpec{IP: net.IPv4(127, 0, 0, 1), Port: 80, AddrType: statute.ATYPIPv4},
+		}
+		request, err := ParseRequest(bytes.NewReader(req.Bytes()))
+		require.NoError(t, err)
+		return request
+	}
+
+	rsp := new(MockConn)
+	err := s.handleRequest(context.Background(), rsp, request())
+	require.Contains(t, err.Error(), "backend down")
+	require.Equal(t, statute.RepConnectionRefused, rsp.buf.Bytes()[1])
+	require.Equal(t, 10, rsp.buf.Len())
+
+	// replied already, no more reply
+	replied = true
+	rsp = new(MockConn)
+	require.Error(t, s.handleRequest(context.Background(), rsp, request()))
+	require.Equal(t, statute.RepSuccess, rsp.buf.Bytes()[1])
+	require.Equal(t, 10, rsp.buf.Len())
+}
@@ -2,6 +2,7 @@ package socks5
 
 import (
 	"context"
+	"fmt"
 	"net"
 )
 
@@ -10,14 +11,157 @@ type NameResolver interface {
 	Resolve(ctx context.Context, name string) (context.Context, net.IP, error)
 }
 
-// DNSResolver uses the system DNS to resolve host names
-type DNSResolver struct{}
+// ResolveDeniedError is returned by the NameResolver to veto the request by policy, such as
+// a sinkhole of the blocked domains. The server replies Code, RepHostUnreachable if zero,
+// and the error of ServeConn wraps ErrPolicyDenied rather than a resolution failure.
+type ResolveDeniedError struct {
+	Code uint8
+	Err  error
+}
+
+// Error implement interface error
+func (e *ResolveDeniedError) Error() string {
+	if e.Err == nil {
+		return "resolution denied by policy"
+	}
+	return fmt.Sprintf("resolution denied by policy, %v", e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *ResolveDeniedError) Unwrap() error { return e.Err }
+
+// Is reports the error is a policy denial, matchable with errors.Is(err, ErrPolicyDenied)
+func (e *ResolveDeniedError) Is(target error) bool { return target == ErrPolicyDenied }
+
+// MultiNameResolver is a NameResolver which can resolve all the addresses of the name,
+// used by the happy eyeballs dialing.
+type MultiNameResolver interface {
+	NameResolver
+	ResolveAll(ctx context.Context, name string) (context.Context, []net.IP, error)
+}
+
+// ReverseNameResolver is a NameResolver which can reverse lookup the names of the ip,
+// used by the PTRRuleSet.
+type ReverseNameResolver interface {
+	NameResolver
+	LookupAddr(ctx context.Context, ip net.IP) ([]string, error)
+}
+
+// AddrFamily the address family policy of the resolved destination addresses
+type AddrFamily int
+
+// AddrFamily policies
+const (
+	// AddrFamilyAny the addresses are used in the order resolved
+	AddrFamilyAny AddrFamily = iota
+	// AddrFamilyIPv4Only only the IPv4 addresses are used
+	AddrFamilyIPv4Only
+	// AddrFamilyIPv6Only only the IPv6 addresses are used
+	AddrFamilyIPv6Only
+	// AddrFamilyPreferIPv4 the IPv4 addresses are tried first
+	AddrFamilyPreferIPv4
+	// AddrFamilyPreferIPv6 the IPv6 addresses are tried first
+	AddrFamilyPreferIPv6
+)
+
+// String implement interface fmt.Stringer
+func (af AddrFamily) String() string {
+	switch af {
+	case AddrFamilyAny:
+		return "any"
+	case AddrFamilyIPv4Only:
+		return "ipv4-only"
+	case AddrFamilyIPv6Only:
+		return "ipv6-only"
+	case AddrFamilyPreferIPv4:
+		return "prefer-ipv4"
+	case AddrFamilyPreferIPv6:
+		return "prefer-ipv6"
+	}
+	return "unknown"
+}
+
+// sort filters and sorts the ips stably by the policy.
+func (af AddrFamily) sort(ips []net.IP) []net.IP {
+	if af == AddrFamilyAny {
+		return ips
+	}
+	v4 := make([]net.IP, 0, len(ips))
+	v6 := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	switch af {
+	case AddrFamilyIPv4Only:
+		return v4
+	case AddrFamilyIPv6Only:
+		return v6
+	case AddrFamilyPreferIPv6:
+		return append(v6, v4...)
+	}
+	return append(v4, v6...)
+}
+
+// DNSResolver uses the system DNS to resolve host names,
+// the lookup is aborted when the ctx is canceled.
+type DNSResolver struct {
+	resolver *net.Resolver
+}
+
+// NewDNSResolverWithServer returns a DNSResolver which sends all the lookups to the dns server
+// at addr such as "10.0.0.53:53" over the network "udp" or "tcp", instead of the system
+// configured ones, without touching /etc/resolv.conf.
+func NewDNSResolverWithServer(addr, network string) DNSResolver {
+	return DNSResolver{
+		&net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		},
+	}
+}
+
+func (d DNSResolver) getResolver() *net.Resolver {
+	if d.resolver == nil {
+		return net.DefaultResolver
+	}
+	return d.resolver
+}
 
-// Resolve implement interface NameResolver
+// Resolve implement interface NameResolver, prefer IPv4 address
 func (d DNSResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
-	addr, err := net.ResolveIPAddr("ip", name)
+	addrs, err := d.getResolver().LookupIPAddr(ctx, name)
 	if err != nil {
 		return ctx, nil, err
 	}
-	return ctx, addr.IP, err
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			return ctx, addr.IP, nil
+		}
+	}
+	return ctx, addrs[0].IP, nil
+}
+
+// ResolveAll implement interface MultiNameResolver
+func (d DNSResolver) ResolveAll(ctx context.Context, name string) (context.Context, []net.IP, error) {
+	addrs, err := d.getResolver().LookupIPAddr(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ctx, ips, nil
+}
+
+// LookupAddr implement interface ReverseNameResolver
+func (d DNSResolver) LookupAddr(ctx context.Context, ip net.IP) ([]string, error) {
+	return d.getResolver().LookupAddr(ctx, ip.String())
 }
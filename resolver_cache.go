@@ -0,0 +1,258 @@
+package socks5
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"hash/fnv"
+	"net"
+	"sync"
+	"time"
+)
+
+// CacheOption is the option of CachingResolver
+type CacheOption func(c *CachingResolver)
+
+// WithCacheTTL the duration of successful resolve results are cached.
+// Defaults to 1 minute.
+func WithCacheTTL(d time.Duration) CacheOption {
+	return func(c *CachingResolver) {
+		c.ttl = d
+	}
+}
+
+// WithCacheNegativeTTL the duration of not found(NXDOMAIN) results are cached,
+// zero disable negative caching.
+// Defaults to 10 seconds.
+func WithCacheNegativeTTL(d time.Duration) CacheOption {
+	return func(c *CachingResolver) {
+		c.negativeTTL = d
+	}
+}
+
+// WithCacheMaxEntries the max number of entries cached, it is split evenly among the shards,
+// the least recently used entry of the shard is evicted when the shard is full.
+// Defaults to 1024.
+func WithCacheMaxEntries(n int) CacheOption {
+	return func(c *CachingResolver) {
+		c.maxEntries = n
+	}
+}
+
+// cacheShards the number of the shards of the CachingResolver, each shard has its own lock
+const cacheShards = 16
+
+// CachingResolver caches the resolve results of the inner NameResolver keyed by name,
+// all the addresses of the name are cached if the inner is a MultiNameResolver, so that
+// the happy eyeballs and the address family policy keep working.
+// It is safe for concurrent use. The cache is sharded by the hash of the name, each shard
+// evicts its least recently used entry on its own. The concurrent misses of the same name
+// are collapsed into one lookup of the inner resolver.
+type CachingResolver struct {
+	inner       NameResolver
+	ttl         time.Duration
+	negativeTTL time.Duration
+	maxEntries  int
+	shards      []*cacheShard
+}
+
+type cacheShard struct {
+	mu         sync.Mutex
+	maxEntries int
+	lru        *list.List // of *cacheEntry, front is the most recently used
+	entries    map[string]*list.Element
+	calls      map[string]*cacheCall // the lookups in flight
+}
+
+type cacheEntry struct {
+	name   string
+	ips    []net.IP
+	err    error
+	expire time.Time
+}
+
+// cacheCall is a lookup of the inner resolver in flight, the result is set before done closed
+type cacheCall struct {
+	done chan struct{}
+	ips  []net.IP
+	err  error
+}
+
+// NewCachingResolver new caching resolver wrapping the inner resolver
+func NewCachingResolver(inner NameResolver, opts ...CacheOption) *CachingResolver {
+	c := &CachingResolver{
+		inner:       inner,
+		ttl:         time.Minute,
+		negativeTTL: 10 * time.Second,
+		maxEntries:  1024,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	// the capacity is split among the shards, fewer shards for the tiny cache
+	n := cacheShards
+	if c.maxEntries < n {
+		n = c.maxEntries
+	}
+	if n < 1 {
+		n = 1
+	}
+	c.shards = make([]*cacheShard, n)
+	for i := range c.shards {
+		c.shards[i] = &cacheShard{
+			maxEntries: c.maxEntries / n,
+			lru:        list.New(),
+			entries:    make(map[string]*list.Element),
+			calls:      make(map[string]*cacheCall),
+		}
+	}
+	return c
+}
+
+// Resolve implement interface NameResolver, prefer IPv4 address of the cached addresses
+func (sf *CachingResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	ctx, ips, err := sf.resolve(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ctx, ip, nil
+		}
+	}
+	return ctx, ips[0], nil
+}
+
+// ResolveAll implement interface MultiNameResolver, the inner which is not a MultiNameResolver
+// resolves the only address.
+func (sf *CachingResolver) ResolveAll(ctx context.Context, name string) (context.Context, []net.IP, error) {
+	ctx, ips, err := sf.resolve(ctx, name)
+	// the cached slice is shared
+	return ctx, append([]net.IP(nil), ips...), err
+}
+
+// LookupAddr implement interface ReverseNameResolver, delegates to the inner resolver
+// without caching, fails if the inner is not a ReverseNameResolver.
+func (sf *CachingResolver) LookupAddr(ctx context.Context, ip net.IP) ([]string, error) {
+	rr, ok := sf.inner.(ReverseNameResolver)
+	if !ok {
+		return nil, errors.New("socks5: the inner resolver does not support reverse lookup")
+	}
+	return rr.LookupAddr(ctx, ip)
+}
+
+// resolve returns the addresses of the name cached, or looks up the inner resolver
+func (sf *CachingResolver) resolve(ctx context.Context, name string) (context.Context, []net.IP, error) {
+	shard := sf.shard(name)
+	for {
+		shard.mu.Lock()
+		if ips, err, ok := shard.get(name); ok {
+			shard.mu.Unlock()
+			return ctx, ips, err
+		}
+		if call, ok := shard.calls[name]; ok {
+			// wait for the lookup in flight
+			shard.mu.Unlock()
+			select {
+			case <-call.done:
+			case <-ctx.Done():
+				return ctx, nil, ctx.Err()
+			}
+			if call.err != nil && isContextErr(call.err) && ctx.Err() == nil {
+				// the lookup was canceled by its own caller, look up again
+				continue
+			}
+			return ctx, call.ips, call.err
+		}
+		call := &cacheCall{done: make(chan struct{})}
+		shard.calls[name] = call
+		shard.mu.Unlock()
+
+		ctx, call.ips, call.err = sf.lookup(ctx, name)
+
+		shard.mu.Lock()
+		if call.err == nil {
+			shard.add(name, call.ips, nil, sf.ttl)
+		} else if isNotFound(call.err) {
+			shard.add(name, nil, call.err, sf.negativeTTL)
+		}
+		delete(shard.calls, name)
+		shard.mu.Unlock()
+		close(call.done)
+		return ctx, call.ips, call.err
+	}
+}
+
+// lookup looks up all the addresses of the name through the inner resolver
+func (sf *CachingResolver) lookup(ctx context.Context, name string) (context.Context, []net.IP, error) {
+	if mr, ok := sf.inner.(MultiNameResolver); ok {
+		ctx, ips, err := mr.ResolveAll(ctx, name)
+		if err == nil && len(ips) == 0 {
+			err = &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		}
+		return ctx, ips, err
+	}
+	ctx, ip, err := sf.inner.Resolve(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	return ctx, []net.IP{ip}, nil
+}
+
+// Len returns the number of entries cached, include the expired but not evicted.
+func (sf *CachingResolver) Len() int {
+	n := 0
+	for _, shard := range sf.shards {
+		shard.mu.Lock()
+		n += shard.lru.Len()
+		shard.mu.Unlock()
+	}
+	return n
+}
+
+// shard returns the shard of the name
+func (sf *CachingResolver) shard(name string) *cacheShard {
+	h := fnv.New32a()
+	h.Write([]byte(name)) // nolint: errcheck
+	return sf.shards[h.Sum32()%uint32(len(sf.shards))]
+}
+
+// isContextErr reports whether the err is caused by the context canceled or deadline exceeded
+func isContextErr(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// get returns the entry cached, the lock must be held
+func (sf *cacheShard) get(name string) ([]net.IP, error, bool) { // nolint: stylecheck
+	elem, ok := sf.entries[name]
+	if !ok {
+		return nil, nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expire) {
+		sf.lru.Remove(elem)
+		delete(sf.entries, name)
+		return nil, nil, false
+	}
+	sf.lru.MoveToFront(elem)
+	return entry.ips, entry.err, true
+}
+
+// add caches the entry, the lock must be held
+func (sf *cacheShard) add(name string, ips []net.IP, err error, ttl time.Duration) {
+	if ttl <= 0 || sf.maxEntries <= 0 {
+		return
+	}
+	entry := &cacheEntry{name, ips, err, time.Now().Add(ttl)}
+	if elem, ok := sf.entries[name]; ok {
+		elem.Value = entry
+		sf.lru.MoveToFront(elem)
+		return
+	}
+	sf.entries[name] = sf.lru.PushFront(entry)
+	for sf.lru.Len() > sf.maxEntries {
+		elem := sf.lru.Back()
+		sf.lru.Remove(elem)
+		delete(sf.entries, elem.Value.(*cacheEntry).name)
+	}
+}
@@ -0,0 +1,132 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type countResolver struct {
+	count int
+}
+
+func (sf *countResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	sf.count++
+	if name == "nxdomain" {
+		return ctx, nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return ctx, net.IPv4(127, 0, 0, byte(sf.count)), nil
+}
+
+func TestCachingResolver(t *testing.T) {
+	inner := &countResolver{}
+	r := NewCachingResolver(inner, WithCacheTTL(50*time.Millisecond), WithCacheMaxEntries(1))
+	ctx := context.Background()
+
+	_, ip, err := r.Resolve(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, net.IPv4(127, 0, 0, 1), ip)
+	_, ip, err = r.Resolve(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, net.IPv4(127, 0, 0, 1), ip)
+	assert.Equal(t, 1, inner.count)
+
+	// negative caching
+	_, _, err = r.Resolve(ctx, "nxdomain")
+	require.Error(t, err)
+	_, _, err = r.Resolve(ctx, "nxdomain")
+	require.Error(t, err)
+	assert.Equal(t, 2, inner.count)
+
+	// lru evicted, the tiny cache has the only shard
+	_, _, err = r.Resolve(ctx, "b")
+	require.NoError(t, err)
+	assert.Equal(t, 1, r.Len())
+	_, ip, err = r.Resolve(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, net.IPv4(127, 0, 0, 4), ip)
+
+	// expired
+	time.Sleep(60 * time.Millisecond)
+	_, ip, err = r.Resolve(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, net.IPv4(127, 0, 0, 5), ip)
+}
+
+// gateResolver blocks the lookups until release closed
+type gateResolver struct {
+	count   int32
+	release chan struct{}
+}
+
+func (sf *gateResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	atomic.AddInt32(&sf.count, 1)
+	<-sf.release
+	return ctx, net.IPv4(127, 0, 0, 1), nil
+}
+
+func TestCachingResolver_Collapse(t *testing.T) {
+	inner := &gateResolver{release: make(chan struct{})}
+	r := NewCachingResolver(inner)
+	require.Len(t, r.shards, cacheShards)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, ip, err := r.Resolve(context.Background(), "a")
+			assert.NoError(t, err)
+			assert.Equal(t, net.IPv4(127, 0, 0, 1), ip)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(inner.release)
+	wg.Wait()
+	// the concurrent misses looked up once
+	assert.Equal(t, int32(1), atomic.LoadInt32(&inner.count))
+
+	// the waiter gives up with its context
+	inner = &gateResolver{release: make(chan struct{})}
+	r = NewCachingResolver(inner)
+	go r.Resolve(context.Background(), "b") // nolint: errcheck
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&inner.count) == 1
+	}, time.Second, 10*time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, _, err := r.Resolve(ctx, "b")
+	require.Error(t, err)
+	close(inner.release)
+}
+
+func TestCachingResolver_ResolveAll(t *testing.T) {
+	inner := &ptrResolver{
+		names: map[string][]string{"10.1.2.3": {"a.test."}},
+		addrs: map[string][]net.IP{"a.test": {net.ParseIP("fd00::1"), net.IPv4(10, 1, 2, 3)}},
+	}
+	r := NewCachingResolver(inner)
+	ctx := context.Background()
+
+	_, ips, err := r.ResolveAll(ctx, "a.test")
+	require.NoError(t, err)
+	assert.Equal(t, []net.IP{net.ParseIP("fd00::1"), net.IPv4(10, 1, 2, 3)}, ips)
+	// picked from the cached, prefer IPv4
+	inner.addrs = nil
+	_, ip, err := r.Resolve(ctx, "a.test")
+	require.NoError(t, err)
+	assert.Equal(t, net.IPv4(10, 1, 2, 3), ip)
+
+	// reverse lookup delegated
+	names, err := r.LookupAddr(ctx, net.IPv4(10, 1, 2, 3))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.test."}, names)
+	_, err = NewCachingResolver(&countResolver{}).LookupAddr(ctx, net.IPv4(10, 1, 2, 3))
+	require.Error(t, err)
+}
@@ -0,0 +1,147 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dohMaxMessageSize the max size of the dns message
+const dohMaxMessageSize = 65535
+
+// DoHResolver resolves host names via DNS-over-HTTPS(rfc8484), the queries are sent
+// to the endpoint by POST, both A and AAAA are queried. Wrap it by NewCachingResolver to cache,
+// which keeps both families of the addresses for the happy eyeballs.
+type DoHResolver struct {
+	endpoint string
+	client   *http.Client
+}
+
+// NewDoHResolver new a DoHResolver with the endpoint such as "https://dns.google/dns-query",
+// client is used to send the queries, so that certs can be pinned or proxies can be set,
+// nil means http.DefaultClient.
+func NewDoHResolver(endpoint string, client *http.Client) *DoHResolver {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &DoHResolver{endpoint, client}
+}
+
+// Resolve implement interface NameResolver, prefer IPv4 address
+func (sf *DoHResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	ips, err := sf.lookup(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ctx, ip, nil
+		}
+	}
+	return ctx, ips[0], nil
+}
+
+// ResolveAll implement interface MultiNameResolver
+func (sf *DoHResolver) ResolveAll(ctx context.Context, name string) (context.Context, []net.IP, error) {
+	ips, err := sf.lookup(ctx, name)
+	return ctx, ips, err
+}
+
+// lookup queries A and AAAA concurrently, returns all the addresses.
+func (sf *DoHResolver) lookup(ctx context.Context, name string) ([]net.IP, error) {
+	type result struct {
+		ips []net.IP
+		err error
+	}
+	ch := make(chan result, 2)
+	for _, typ := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		go func(typ dnsmessage.Type) {
+			ips, err := sf.query(ctx, name, typ)
+			ch <- result{ips, err}
+		}(typ)
+	}
+	var ips []net.IP
+	var err error
+	for i := 0; i < 2; i++ {
+		r := <-ch
+		ips = append(ips, r.ips...)
+		if r.err != nil && err == nil {
+			err = r.err
+		}
+	}
+	if len(ips) > 0 {
+		return ips, nil
+	}
+	if err == nil {
+		err = &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return nil, err
+}
+
+// query sends a single query of the type, returns the addresses answered.
+func (sf *DoHResolver) query(ctx context.Context, name string, typ dnsmessage.Type) ([]net.IP, error) {
+	fqdn := name
+	if !strings.HasSuffix(fqdn, ".") {
+		fqdn += "."
+	}
+	qname, err := dnsmessage.NewName(fqdn)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: name}
+	}
+	// the id is zero for the http cache friendliness, see rfc8484 section 4.1
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: typ, Class: dnsmessage.ClassINET}},
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sf.endpoint, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	rsp, err := sf.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh query %s failed, status %s", name, rsp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(rsp.Body, dohMaxMessageSize))
+	if err != nil {
+		return nil, err
+	}
+	if err = msg.Unpack(body); err != nil {
+		return nil, fmt.Errorf("doh query %s failed, %v", name, err)
+	}
+	switch msg.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	default:
+		return nil, &net.DNSError{Err: "server misbehaving, " + msg.RCode.String(), Name: name}
+	}
+
+	var ips []net.IP
+	for _, answer := range msg.Answers {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]))
+		}
+	}
+	return ips, nil
+}
@@ -0,0 +1,147 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/thinkgos/go-socks5/bufferpool"
+	"github.com/thinkgos/go-socks5/statute"
+)
+
+// dohHandler answers example.test. with 10.1.2.3 and fd00::1, others not found
+func dohHandler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "application/dns-message", r.Header.Get("Content-Type"))
+		b, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		var msg dnsmessage.Message
+		require.NoError(t, msg.Unpack(b))
+		q := msg.Questions[0]
+		msg.Header.Response = true
+		if q.Name.String() != "example.test." {
+			msg.Header.RCode = dnsmessage.RCodeNameError
+		} else {
+			hdr := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60}
+			switch q.Type {
+			case dnsmessage.TypeA:
+				msg.Answers = []dnsmessage.Resource{{Header: hdr, Body: &dnsmessage.AResource{A: [4]byte{10, 1, 2, 3}}}}
+			case dnsmessage.TypeAAAA:
+				var aaaa dnsmessage.AAAAResource
+				copy(aaaa.AAAA[:], net.ParseIP("fd00::1"))
+				msg.Answers = []dnsmessage.Resource{{Header: hdr, Body: &aaaa}}
+			}
+		}
+		out, err := msg.Pack()
+		require.NoError(t, err)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(out) // nolint: errcheck
+	}
+}
+
+func TestDoHResolver(t *testing.T) {
+	srv := httptest.NewTLSServer(dohHandler(t))
+	defer srv.Close()
+	d := NewDoHResolver(srv.URL+"/dns-query", srv.Client())
+	ctx := context.Background()
+
+	_, ip, err := d.Resolve(ctx, "example.test")
+	require.NoError(t, err)
+	require.Equal(t, "10.1.2.3", ip.String())
+
+	_, ips, err := d.ResolveAll(ctx, "example.test.")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"10.1.2.3", "fd00::1"}, []string{ips[0].String(), ips[1].String()})
+
+	_, _, err = d.Resolve(ctx, "missing.test")
+	var dnsErr *net.DNSError
+	require.True(t, errors.As(err, &dnsErr))
+	require.True(t, dnsErr.IsNotFound)
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, _, err = d.Resolve(cctx, "example.test")
+	require.Error(t, err)
+
+	// cached via the caching resolver
+	c := NewCachingResolver(d)
+	_, ip, err = c.Resolve(ctx, "example.test")
+	require.NoError(t, err)
+	require.Equal(t, "10.1.2.3", ip.String())
+	srv.Close()
+	_, ip, err = c.Resolve(ctx, "example.test")
+	require.NoError(t, err)
+	require.Equal(t, "10.1.2.3", ip.String())
+}
+
+func TestDoHResolver_Caching_HappyEyeballs(t *testing.T) {
+	srv := httptest.NewTLSServer(dohHandler(t))
+	defer srv.Close()
+	c := NewCachingResolver(NewDoHResolver(srv.URL+"/dns-query", srv.Client()))
+
+	// all the addresses are cached
+	_, ips, err := c.ResolveAll(context.Background(), "example.test")
+	require.NoError(t, err)
+	require.Len(t, ips, 2)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}()
+
+	var mu sync.Mutex
+	var dialed []string
+	s := &Server{
+		rules:      NewPermitAll(),
+		resolver:   c,
+		logger:     NewLogger(log.New(os.Stdout, "socks5: ", log.LstdFlags)),
+		bufferPool: bufferpool.NewPool(32 * 1024),
+		dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			mu.Lock()
+			dialed = append(dialed, addr)
+			first := len(dialed) == 1
+			mu.Unlock()
+			if first {
+				// the broken path of the first family, falls back to the other
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, l.Addr().String())
+		},
+		happyEyeballs: true,
+	}
+
+	req := statute.Request{
+		Version: statute.VersionSocks5,
+		Command: statute.CommandConnect,
+		DstAddr: statute.AddrSpec{FQDN: "example.test", Port: 80, AddrType: statute.ATYPDomain},
+	}
+	request, err := ParseRequest(bytes.NewReader(req.Bytes()))
+	require.NoError(t, err)
+
+	rsp := new(MockConn)
+	require.NoError(t, s.handleRequest(context.Background(), rsp, request))
+	require.Equal(t, statute.RepSuccess, rsp.buf.Bytes()[1])
+	mu.Lock()
+	defer mu.Unlock()
+	require.ElementsMatch(t, []string{"[fd00::1]:80", "10.1.2.3:80"}, dialed)
+}
@@ -2,10 +2,12 @@ package socks5
 
 import (
 	"context"
+	"net"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 func TestDNSResolver(t *testing.T) {
@@ -16,3 +18,79 @@ func TestDNSResolver(t *testing.T) {
 	require.NoError(t, err)
 	assert.True(t, addr.IsLoopback())
 }
+
+func TestDNSResolver_Canceled(t *testing.T) {
+	d := DNSResolver{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, err := d.Resolve(ctx, "example.com")
+	require.Error(t, err)
+}
+
+// serveDNS serves the A queries with the ip on the udp conn until it's closed
+func serveDNS(conn net.PacketConn, ip net.IP) {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(buf[:n]); err != nil || len(msg.Questions) == 0 {
+			continue
+		}
+		q := msg.Questions[0]
+		msg.Header.Response = true
+		msg.Header.Authoritative = true
+		if q.Type == dnsmessage.TypeA {
+			var a dnsmessage.AResource
+			copy(a.A[:], ip.To4())
+			msg.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60},
+				Body:   &a,
+			}}
+		}
+		out, err := msg.Pack()
+		if err != nil {
+			continue
+		}
+		conn.WriteTo(out, addr) // nolint: errcheck
+	}
+}
+
+func TestDNSResolverWithServer(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+	go serveDNS(conn, net.IPv4(10, 1, 2, 3))
+
+	d := NewDNSResolverWithServer(conn.LocalAddr().String(), "udp")
+	_, ip, err := d.Resolve(context.Background(), "split.horizon.test.")
+	require.NoError(t, err)
+	require.Equal(t, "10.1.2.3", ip.String())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = d.Resolve(ctx, "other.horizon.test.")
+	require.Error(t, err)
+}
+
+func TestAddrFamily(t *testing.T) {
+	ips := []net.IP{net.ParseIP("::1"), net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1"), net.ParseIP("10.0.0.2")}
+	str := func(ips []net.IP) []string {
+		s := make([]string, 0, len(ips))
+		for _, ip := range ips {
+			s = append(s, ip.String())
+		}
+		return s
+	}
+
+	require.Equal(t, []string{"::1", "10.0.0.1", "fd00::1", "10.0.0.2"}, str(AddrFamilyAny.sort(ips)))
+	require.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, str(AddrFamilyIPv4Only.sort(ips)))
+	require.Equal(t, []string{"::1", "fd00::1"}, str(AddrFamilyIPv6Only.sort(ips)))
+	require.Equal(t, []string{"10.0.0.1", "10.0.0.2", "::1", "fd00::1"}, str(AddrFamilyPreferIPv4.sort(ips)))
+	require.Equal(t, []string{"::1", "fd00::1", "10.0.0.1", "10.0.0.2"}, str(AddrFamilyPreferIPv6.sort(ips)))
+	require.Empty(t, AddrFamilyIPv6Only.sort([]net.IP{net.ParseIP("10.0.0.1")}))
+	require.Equal(t, "prefer-ipv6", AddrFamilyPreferIPv6.String())
+}
@@ -2,11 +2,21 @@ package socks5
 
 import (
 	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/thinkgos/go-socks5/statute"
 )
 
-// RuleSet is used to provide custom rules to allow or prohibit actions
+// RuleSet is used to provide custom rules to allow or prohibit actions.
+// On denial the server replies RepRuleFailure, unless the returned context
+// carries another reply by WithDenyReply or WithDenyDrop.
+// The identity of the client is req.AuthContext, such as the username of its Payload,
+// the per user state such as a byte quota can be updated by WithSessionEnd,
+// see _example/quota.
 type RuleSet interface {
 	Allow(ctx context.Context, req *Request) (context.Context, bool)
 }
@@ -46,3 +56,447 @@ func (p *PermitCommand) Allow(ctx context.Context, req *Request) (context.Contex
 	}
 	return ctx, false
 }
+
+// CIDRRuleSet is an implementation of the RuleSet which
+// filters the destination ip with cidr allow and deny list.
+type CIDRRuleSet struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewCIDRRuleSet returns a RuleSet which denies the destination matching any deny entry,
+// and permits only the destination in the allow list, empty allow means all.
+// The domain destination is matched against the ip resolved by the server's resolver.
+func NewCIDRRuleSet(allow, deny []*net.IPNet) *CIDRRuleSet {
+	return &CIDRRuleSet{allow, deny}
+}
+
+// Allow implement interface RuleSet
+func (sf *CIDRRuleSet) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	dest := req.DestAddr
+	if dest == nil {
+		dest = req.RawDestAddr
+	}
+	if dest == nil || dest.IP == nil {
+		return ctx, false
+	}
+	if containsIP(sf.deny, dest.IP) {
+		return ctx, false
+	}
+	return ctx, len(sf.allow) == 0 || containsIP(sf.allow, dest.IP)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// DomainRuleSet is an implementation of the RuleSet which
+// permits only the destination domain matching the allow list.
+type DomainRuleSet struct {
+	exact    map[string]struct{}
+	suffixes []string
+	allowIP  bool
+}
+
+// NewDomainRuleSet returns a RuleSet which permits only the requested domain(before resolution)
+// matching any of the names, case-insensitive and ignore the trailing dot.
+// A name with "*." prefix such as "*.internal.example.com" matches any subdomain of it,
+// but not itself. allowIP controls whether the request with ip literal rather than domain is permitted.
+func NewDomainRuleSet(names []string, allowIP bool) *DomainRuleSet {
+	sf := &DomainRuleSet{
+		exact:   make(map[string]struct{}),
+		allowIP: allowIP,
+	}
+	for _, name := range names {
+		name = normalizeDomain(name)
+		if strings.HasPrefix(name, "*.") {
+			sf.suffixes = append(sf.suffixes, name[1:])
+		} else {
+			sf.exact[name] = struct{}{}
+		}
+	}
+	return sf
+}
+
+// Allow implement interface RuleSet
+func (sf *DomainRuleSet) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	if req.RawDestAddr == nil || req.RawDestAddr.FQDN == "" {
+		return ctx, sf.allowIP
+	}
+	return ctx, sf.Match(req.RawDestAddr.FQDN)
+}
+
+// Match reports whether the domain matches any of the names
+func (sf *DomainRuleSet) Match(domain string) bool {
+	domain = normalizeDomain(domain)
+	if _, ok := sf.exact[domain]; ok {
+		return true
+	}
+	for _, suffix := range sf.suffixes {
+		if len(domain) > len(suffix) && strings.HasSuffix(domain, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeDomain(s string) string {
+	return strings.ToLower(strings.TrimSuffix(s, "."))
+}
+
+// maxPTREntries the max number of the reverse lookup results cached by PTRRuleSet
+const maxPTREntries = 4096
+
+// PTRRuleSet is an implementation of the RuleSet which permits only the destination
+// ip whose PTR records match the names, it is safe for concurrent use.
+type PTRRuleSet struct {
+	resolver       ReverseNameResolver
+	names          *DomainRuleSet
+	timeout        time.Duration
+	ttl            time.Duration
+	allowOnTimeout bool
+
+	mu    sync.Mutex
+	cache map[string]ptrEntry
+}
+
+type ptrEntry struct {
+	allowed bool
+	expire  time.Time
+}
+
+// NewPTRRuleSet returns a RuleSet which reverse looks up the resolved destination ip through
+// the resolver, and permits it if any of the returned names matches the names, which has
+// the same syntax as NewDomainRuleSet. The matched name must resolve forward to the ip too,
+// through ResolveAll if the resolver is a MultiNameResolver, so that whoever controls the
+// reverse zone of the ip can't pass the rule by a spoofed PTR record.
+// The lookups of a request are bounded by the timeout if > 0, allowOnTimeout controls
+// whether the request is permitted when the lookups timed out.
+// The results(include not found) are cached for the ttl, zero disable caching.
+func NewPTRRuleSet(resolver ReverseNameResolver, names []string,
+	timeout, ttl time.Duration, allowOnTimeout bool) *PTRRuleSet {
+	return &PTRRuleSet{
+		resolver:       resolver,
+		names:          NewDomainRuleSet(names, false),
+		timeout:        timeout,
+		ttl:            ttl,
+		allowOnTimeout: allowOnTimeout,
+		cache:          make(map[string]ptrEntry),
+	}
+}
+
+// Allow implement interface RuleSet
+func (sf *PTRRuleSet) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	dest := req.DestAddr
+	if dest == nil {
+		dest = req.RawDestAddr
+	}
+	if dest == nil || dest.IP == nil {
+		return ctx, false
+	}
+	allowed, err := sf.lookup(ctx, dest.IP)
+	if err != nil {
+		return ctx, sf.allowOnTimeout && isTimeout(err)
+	}
+	return ctx, allowed
+}
+
+// lookup reports whether the ip has a PTR record matching the names and confirmed forward.
+func (sf *PTRRuleSet) lookup(ctx context.Context, ip net.IP) (bool, error) {
+	key := ip.String()
+	now := time.Now()
+	sf.mu.Lock()
+	entry, ok := sf.cache[key]
+	sf.mu.Unlock()
+	if ok && now.Before(entry.expire) {
+		return entry.allowed, nil
+	}
+
+	if sf.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, sf.timeout)
+		defer cancel()
+	}
+	names, err := sf.resolver.LookupAddr(ctx, ip)
+	if err != nil && !isNotFound(err) {
+		return false, err
+	}
+	allowed := false
+	for _, name := range names {
+		if !sf.names.Match(name) {
+			continue
+		}
+		if allowed, err = sf.confirm(ctx, name, ip); err != nil {
+			return false, err
+		}
+		if allowed {
+			break
+		}
+	}
+	if sf.ttl > 0 {
+		sf.mu.Lock()
+		if len(sf.cache) >= maxPTREntries {
+			for k, v := range sf.cache {
+				if now.After(v.expire) {
+					delete(sf.cache, k)
+				}
+			}
+			if len(sf.cache) >= maxPTREntries {
+				sf.cache = make(map[string]ptrEntry)
+			}
+		}
+		sf.cache[key] = ptrEntry{allowed, now.Add(sf.ttl)}
+		sf.mu.Unlock()
+	}
+	return allowed, nil
+}
+
+// confirm reports whether the name resolves forward to the ip
+func (sf *PTRRuleSet) confirm(ctx context.Context, name string, ip net.IP) (bool, error) {
+	var ips []net.IP
+	var err error
+	if mr, ok := sf.resolver.(MultiNameResolver); ok {
+		_, ips, err = mr.ResolveAll(ctx, name)
+	} else {
+		var addr net.IP
+		if _, addr, err = sf.resolver.Resolve(ctx, name); err == nil {
+			ips = []net.IP{addr}
+		}
+	}
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	for _, v := range ips {
+		if v.Equal(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isNotFound reports whether the err is a dns error of the name or address not found
+func isNotFound(err error) bool {
+	dnsErr := (*net.DNSError)(nil)
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// AllOf returns a RuleSet which permits the request only if all of the rules permit it,
+// the rules are evaluated in order and stop at the first denial, whose context is returned.
+// No rules permits all.
+func AllOf(rules ...RuleSet) RuleSet {
+	return allOf(rules)
+}
+
+type allOf []RuleSet
+
+// Allow implement interface RuleSet
+func (sf allOf) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	var ok bool
+	for _, r := range sf {
+		if ctx, ok = r.Allow(ctx, req); !ok {
+			return ctx, false
+		}
+	}
+	return ctx, true
+}
+
+// AnyOf returns a RuleSet which permits the request if any of the rules permits it,
+// the rules are evaluated in order and stop at the first permission.
+// If all deny, the context of the first denial is returned. No rules denies all.
+func AnyOf(rules ...RuleSet) RuleSet {
+	return anyOf(rules)
+}
+
+type anyOf []RuleSet
+
+// Allow implement interface RuleSet
+func (sf anyOf) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	var denied context.Context
+	for _, r := range sf {
+		rctx, ok := r.Allow(ctx, req)
+		if ok {
+			return rctx, true
+		}
+		if denied == nil {
+			denied = rctx
+		}
+	}
+	if denied == nil {
+		denied = ctx
+	}
+	return denied, false
+}
+
+// TimeWindow is a weekly time window, which starts at the clock time Start of Weekday,
+// such as 7*time.Hour for 07:00, and ends at the clock time End of the same day. The window
+// with End before or equal to Start wraps past the midnight into the next day. The clock
+// times are of the wall clock, so the windows hold on the daylight saving transition days.
+type TimeWindow struct {
+	Weekday time.Weekday
+	Start   time.Duration
+	End     time.Duration
+}
+
+// TimeWindowRuleSet is an implementation of the RuleSet which
+// permits the request only in the weekly time windows.
+type TimeWindowRuleSet struct {
+	windows []TimeWindow
+	loc     *time.Location
+	now     func() time.Time
+}
+
+// NewTimeWindowRuleSet returns a RuleSet which permits the request only when the current time
+// in location loc falls in one of the windows, nil loc means time.Local.
+func NewTimeWindowRuleSet(windows []TimeWindow, loc *time.Location) *TimeWindowRuleSet {
+	if loc == nil {
+		loc = time.Local
+	}
+	return &TimeWindowRuleSet{windows, loc, time.Now}
+}
+
+// Allow implement interface RuleSet
+func (sf *TimeWindowRuleSet) Allow(ctx context.Context, _ *Request) (context.Context, bool) {
+	return ctx, sf.Contains(sf.now())
+}
+
+// Contains reports whether the t falls in one of the windows
+func (sf *TimeWindowRuleSet) Contains(t time.Time) bool {
+	t = t.In(sf.loc)
+	// the wall clock time, not the time elapsed since the midnight, which differs by
+	// an hour on the daylight saving transition days.
+	h, m, s := t.Clock()
+	sinceMidnight := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s)*time.Second
+	yesterday := (t.Weekday() + 6) % 7
+	for _, w := range sf.windows {
+		if w.End > w.Start {
+			if w.Weekday == t.Weekday() && sinceMidnight >= w.Start && sinceMidnight < w.End {
+				return true
+			}
+			continue
+		}
+		// wraps past the midnight
+		if (w.Weekday == t.Weekday() && sinceMidnight >= w.Start) ||
+			(w.Weekday == yesterday && sinceMidnight < w.End) {
+			return true
+		}
+	}
+	return false
+}
+
+// PerUserRuleSet is an implementation of the RuleSet which
+// dispatches to the RuleSet of the authenticated user.
+type PerUserRuleSet struct {
+	rules       map[string]RuleSet
+	defaultRule RuleSet
+}
+
+// NewPerUserRuleSet returns a RuleSet which dispatches to the RuleSet of the authenticated
+// user(see AuthContext.Username), the unknown or unauthenticated users fall through to defaultRule,
+// nil defaultRule denies them.
+func NewPerUserRuleSet(rules map[string]RuleSet, defaultRule RuleSet) *PerUserRuleSet {
+	return &PerUserRuleSet{rules, defaultRule}
+}
+
+// Allow implement interface RuleSet
+func (sf *PerUserRuleSet) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	if username := req.AuthContext.Username(); username != "" {
+		if r, ok := sf.rules[username]; ok {
+			return r.Allow(ctx, req)
+		}
+	}
+	if sf.defaultRule == nil {
+		return ctx, false
+	}
+	return sf.defaultRule.Allow(ctx, req)
+}
+
+// NewAuthRequiredRuleSet returns a RuleSet which requires the authenticated identity (see
+// AuthContext.Username) except for the requests permitted by anonymous, such as the internal
+// mirror open to everyone, nil anonymous denies all the unauthenticated requests.
+// The auth happens before the request is parsed, so the destination conditional auth is
+// two-phase: the server supports both no-auth and user/pass, preferring user/pass by
+// WithAuthMethodPriority, then the request of the no-auth client is checked by this rule.
+// Combine it with the other rules by AllOf.
+func NewAuthRequiredRuleSet(anonymous RuleSet) RuleSet {
+	return authRequiredRuleSet{anonymous}
+}
+
+type authRequiredRuleSet struct {
+	anonymous RuleSet
+}
+
+// Allow implement interface RuleSet
+func (sf authRequiredRuleSet) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	if req.AuthContext.Username() != "" {
+		return ctx, true
+	}
+	if sf.anonymous == nil {
+		return ctx, false
+	}
+	return sf.anonymous.Allow(ctx, req)
+}
+
+// denyReplyCtxKey the context key of the reply on denial
+type denyReplyCtxKey struct{}
+
+type denyReply struct {
+	rep  uint8
+	drop bool
+}
+
+// WithDenyReply returns a copy of ctx, if the RuleSet denies with it,
+// the server replies rep instead of RepRuleFailure, e.g. RepConnectionRefused.
+func WithDenyReply(ctx context.Context, rep uint8) context.Context {
+	return context.WithValue(ctx, denyReplyCtxKey{}, denyReply{rep: rep})
+}
+
+// WithDenyDrop returns a copy of ctx, if the RuleSet denies with it,
+// the server closes the connection silently without any reply.
+func WithDenyDrop(ctx context.Context) context.Context {
+	return context.WithValue(ctx, denyReplyCtxKey{}, denyReply{drop: true})
+}
+
+// DenyReplyFromContext returns the reply on denial carried by ctx,
+// drop reports closing silently. Defaults to RepRuleFailure.
+func DenyReplyFromContext(ctx context.Context) (rep uint8, drop bool) {
+	if dr, ok := ctx.Value(denyReplyCtxKey{}).(denyReply); ok {
+		return dr.rep, dr.drop
+	}
+	return statute.RepRuleFailure, false
+}
+
+type denyReplyRuleSet struct {
+	rule RuleSet
+	rep  uint8
+	drop bool
+}
+
+// NewDenyReplyRuleSet returns a RuleSet which replies rep when the rule denies.
+func NewDenyReplyRuleSet(rule RuleSet, rep uint8) RuleSet {
+	return denyReplyRuleSet{rule: rule, rep: rep}
+}
+
+// NewDenyDropRuleSet returns a RuleSet which closes the connection silently when the rule denies.
+func NewDenyDropRuleSet(rule RuleSet) RuleSet {
+	return denyReplyRuleSet{rule: rule, drop: true}
+}
+
+// Allow implement interface RuleSet
+func (sf denyReplyRuleSet) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	ctx, ok := sf.rule.Allow(ctx, req)
+	if ok {
+		return ctx, true
+	}
+	if sf.drop {
+		return WithDenyDrop(ctx), false
+	}
+	return WithDenyReply(ctx, sf.rep), false
+}
@@ -2,7 +2,9 @@ package socks5
 
 import (
 	"context"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
@@ -45,3 +47,346 @@ func TestPermitCommand(t *testing.T) {
 	_, ok = r.Allow(ctx, &Request{Request: statute.Request{Command: 0x00}})
 	require.False(t, ok)
 }
+
+func TestCIDRRuleSet(t *testing.T) {
+	mustCIDR := func(s string) *net.IPNet {
+		_, n, err := net.ParseCIDR(s)
+		require.NoError(t, err)
+		return n
+	}
+	request := func(ip string) *Request {
+		return &Request{DestAddr: &statute.AddrSpec{IP: net.ParseIP(ip)}}
+	}
+	ctx := context.Background()
+
+	r := NewCIDRRuleSet(nil, []*net.IPNet{mustCIDR("10.0.0.0/8")})
+	_, ok := r.Allow(ctx, request("10.1.2.3"))
+	require.False(t, ok)
+	_, ok = r.Allow(ctx, request("192.168.1.1"))
+	require.True(t, ok)
+
+	r = NewCIDRRuleSet(
+		[]*net.IPNet{mustCIDR("192.168.0.0/16"), mustCIDR("fd00::/8")},
+		[]*net.IPNet{mustCIDR("192.168.1.0/24")},
+	)
+	_, ok = r.Allow(ctx, request("192.168.2.1"))
+	require.True(t, ok)
+	_, ok = r.Allow(ctx, request("fd00::1"))
+	require.True(t, ok)
+	_, ok = r.Allow(ctx, request("192.168.1.1"))
+	require.False(t, ok)
+	_, ok = r.Allow(ctx, request("8.8.8.8"))
+	require.False(t, ok)
+
+	// the unresolved destination is denied
+	_, ok = r.Allow(ctx, &Request{DestAddr: &statute.AddrSpec{FQDN: "example.com"}})
+	require.False(t, ok)
+}
+
+func TestDomainRuleSet(t *testing.T) {
+	request := func(fqdn string) *Request {
+		return &Request{RawDestAddr: &statute.AddrSpec{FQDN: fqdn}}
+	}
+	ctx := context.Background()
+
+	r := NewDomainRuleSet([]string{"Example.com.", "*.internal.example.com"}, false)
+	for _, name := range []string{"example.com", "EXAMPLE.COM", "example.com.", "a.internal.example.com", "a.b.Internal.Example.com."} {
+		_, ok := r.Allow(ctx, request(name))
+		require.True(t, ok, name)
+	}
+	for _, name := range []string{"www.example.com", "internal.example.com", "ainternal.example.com", "example.org"} {
+		_, ok := r.Allow(ctx, request(name))
+		require.False(t, ok, name)
+	}
+
+	// ip literal
+	ipReq := &Request{RawDestAddr: &statute.AddrSpec{IP: net.IPv4(127, 0, 0, 1)}}
+	_, ok := r.Allow(ctx, ipReq)
+	require.False(t, ok)
+	_, ok = NewDomainRuleSet(nil, true).Allow(ctx, ipReq)
+	require.True(t, ok)
+}
+
+type ctxKeyRule struct{}
+
+type markRule struct {
+	name  string
+	allow bool
+	calls *[]string
+}
+
+func (sf markRule) Allow(ctx context.Context, _ *Request) (context.Context, bool) {
+	*sf.calls = append(*sf.calls, sf.name)
+	return context.WithValue(ctx, ctxKeyRule{}, sf.name), sf.allow
+}
+
+func TestAllOfAnyOf(t *testing.T) {
+	var calls []string
+	rule := func(name string, allow bool) RuleSet {
+		return markRule{name, allow, &calls}
+	}
+	ctx := context.Background()
+	req := &Request{}
+
+	rctx, ok := AllOf(rule("a", true), rule("b", false), rule("c", false)).Allow(ctx, req)
+	require.False(t, ok)
+	require.Equal(t, "b", rctx.Value(ctxKeyRule{}))
+	require.Equal(t, []string{"a", "b"}, calls)
+
+	calls = nil
+	rctx, ok = AllOf(rule("a", true), rule("b", true)).Allow(ctx, req)
+	require.True(t, ok)
+	require.Equal(t, "b", rctx.Value(ctxKeyRule{}))
+
+	calls = nil
+	rctx, ok = AnyOf(rule("a", false), rule("b", true), rule("c", true)).Allow(ctx, req)
+	require.True(t, ok)
+	require.Equal(t, "b", rctx.Value(ctxKeyRule{}))
+	require.Equal(t, []string{"a", "b"}, calls)
+
+	calls = nil
+	rctx, ok = AnyOf(rule("a", false), rule("b", false)).Allow(ctx, req)
+	require.False(t, ok)
+	require.Equal(t, "a", rctx.Value(ctxKeyRule{}))
+
+	_, ok = AllOf().Allow(ctx, req)
+	require.True(t, ok)
+	_, ok = AnyOf().Allow(ctx, req)
+	require.False(t, ok)
+}
+
+func TestTimeWindowRuleSet(t *testing.T) {
+	loc := time.FixedZone("test", 8*3600)
+	r := NewTimeWindowRuleSet([]TimeWindow{
+		{Weekday: time.Saturday, Start: 9 * time.Hour, End: 21 * time.Hour},
+		{Weekday: time.Friday, Start: 22 * time.Hour, End: 2 * time.Hour},
+	}, loc)
+
+	at := func(day, hour, min int) time.Time {
+		// 2020-08-01 is Saturday
+		return time.Date(2020, 8, day, hour, min, 0, 0, loc)
+	}
+	require.True(t, r.Contains(at(1, 9, 0)))
+	require.True(t, r.Contains(at(1, 20, 59)))
+	require.False(t, r.Contains(at(1, 21, 0)))
+	require.False(t, r.Contains(at(1, 8, 59)))
+	require.False(t, r.Contains(at(2, 10, 0)))
+	// wraps past the midnight from Friday
+	require.True(t, r.Contains(time.Date(2020, 7, 31, 23, 0, 0, 0, loc)))
+	require.True(t, r.Contains(at(1, 1, 59)))
+	require.False(t, r.Contains(at(1, 2, 0)))
+	// another location
+	require.True(t, r.Contains(time.Date(2020, 8, 1, 1, 0, 0, 0, time.UTC)))
+
+	r.now = func() time.Time { return at(1, 12, 0) }
+	_, ok := r.Allow(context.Background(), &Request{})
+	require.True(t, ok)
+	r.now = func() time.Time { return at(3, 12, 0) }
+	_, ok = r.Allow(context.Background(), &Request{})
+	require.False(t, ok)
+}
+
+func TestTimeWindowRuleSet_DST(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("no time zone database, %v", err)
+	}
+	r := NewTimeWindowRuleSet([]TimeWindow{
+		{Weekday: time.Sunday, Start: 7 * time.Hour, End: 21 * time.Hour},
+	}, loc)
+
+	// the clocks jump forward on 2020-03-08 and fall back on 2020-11-01, both Sunday
+	for _, date := range []time.Time{
+		time.Date(2020, 3, 8, 0, 0, 0, 0, loc),
+		time.Date(2020, 11, 1, 0, 0, 0, 0, loc),
+	} {
+		y, m, d := date.Date()
+		at := func(hour, min int) time.Time {
+			return time.Date(y, m, d, hour, min, 0, 0, loc)
+		}
+		require.False(t, r.Contains(at(6, 30)), date)
+		require.True(t, r.Contains(at(7, 0)), date)
+		require.True(t, r.Contains(at(20, 59)), date)
+		require.False(t, r.Contains(at(21, 30)), date)
+	}
+}
+
+func TestPerUserRuleSet(t *testing.T) {
+	ctx := context.Background()
+	connect := func(username string) *Request {
+		req := &Request{Request: statute.Request{Command: statute.CommandConnect}}
+		if username != "" {
+			req.AuthContext = &AuthContext{
+				Method:  statute.MethodUserPassAuth,
+				Payload: map[string]string{AuthKeyUsername: username},
+			}
+		}
+		return req
+	}
+
+	r := NewPerUserRuleSet(map[string]RuleSet{
+		"alice": NewPermitAll(),
+		"bob":   NewPermitNone(),
+	}, NewPermitConnAndAss())
+
+	_, ok := r.Allow(ctx, connect("alice"))
+	require.True(t, ok)
+	_, ok = r.Allow(ctx, connect("bob"))
+	require.False(t, ok)
+	// unknown and unauthenticated users fall through to the default
+	_, ok = r.Allow(ctx, connect("carol"))
+	require.True(t, ok)
+	_, ok = r.Allow(ctx, connect(""))
+	require.True(t, ok)
+
+	_, ok = NewPerUserRuleSet(nil, nil).Allow(ctx, connect("carol"))
+	require.False(t, ok)
+}
+
+func TestAuthRequiredRuleSet(t *testing.T) {
+	ctx := context.Background()
+	_, mirror, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+	connect := func(username string, ip net.IP) *Request {
+		req := &Request{
+			Request:  statute.Request{Command: statute.CommandConnect},
+			DestAddr: &statute.AddrSpec{IP: ip, Port: 80},
+		}
+		if username != "" {
+			req.AuthContext = &AuthContext{
+				Method:  statute.MethodUserPassAuth,
+				Payload: map[string]string{AuthKeyUsername: username},
+			}
+		} else {
+			req.AuthContext = &AuthContext{Method: statute.MethodNoAuth, Payload: make(map[string]string)}
+		}
+		return req
+	}
+
+	r := NewAuthRequiredRuleSet(NewCIDRRuleSet([]*net.IPNet{mirror}, nil))
+	// the no-auth client only reaches the mirror
+	_, ok := r.Allow(ctx, connect("", net.IPv4(10, 0, 0, 1)))
+	require.True(t, ok)
+	_, ok = r.Allow(ctx, connect("", net.IPv4(192, 0, 2, 1)))
+	require.False(t, ok)
+	_, ok = r.Allow(ctx, connect("alice", net.IPv4(192, 0, 2, 1)))
+	require.True(t, ok)
+
+	_, ok = NewAuthRequiredRuleSet(nil).Allow(ctx, connect("", net.IPv4(10, 0, 0, 1)))
+	require.False(t, ok)
+}
+
+func TestDenyReply(t *testing.T) {
+	ctx := context.Background()
+	req := &Request{Request: statute.Request{Command: statute.CommandConnect}}
+
+	rep, drop := DenyReplyFromContext(ctx)
+	require.Equal(t, statute.RepRuleFailure, rep)
+	require.False(t, drop)
+
+	rep, drop = DenyReplyFromContext(WithDenyReply(ctx, statute.RepConnectionRefused))
+	require.Equal(t, statute.RepConnectionRefused, rep)
+	require.False(t, drop)
+
+	_, drop = DenyReplyFromContext(WithDenyDrop(ctx))
+	require.True(t, drop)
+
+	// allowed, no reply carried
+	rctx, ok := NewDenyReplyRuleSet(NewPermitAll(), statute.RepHostUnreachable).Allow(ctx, req)
+	require.True(t, ok)
+	rep, _ = DenyReplyFromContext(rctx)
+	require.Equal(t, statute.RepRuleFailure, rep)
+
+	// the reply of the first denier is preserved through the composition
+	rctx, ok = AllOf(
+		NewPermitAll(),
+		NewDenyReplyRuleSet(NewPermitNone(), statute.RepHostUnreachable),
+		NewDenyDropRuleSet(NewPermitNone()),
+	).Allow(ctx, req)
+	require.False(t, ok)
+	rep, drop = DenyReplyFromContext(rctx)
+	require.Equal(t, statute.RepHostUnreachable, rep)
+	require.False(t, drop)
+}
+
+type ptrResolver struct {
+	DNSResolver
+	names map[string][]string
+	addrs map[string][]net.IP
+	delay time.Duration
+	calls int
+}
+
+func (sf *ptrResolver) ResolveAll(ctx context.Context, name string) (context.Context, []net.IP, error) {
+	ips, ok := sf.addrs[name]
+	if !ok {
+		return ctx, nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return ctx, ips, nil
+}
+
+func (sf *ptrResolver) LookupAddr(ctx context.Context, ip net.IP) ([]string, error) {
+	sf.calls++
+	if sf.delay > 0 {
+		select {
+		case <-time.After(sf.delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	names, ok := sf.names[ip.String()]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: ip.String(), IsNotFound: true}
+	}
+	return names, nil
+}
+
+func TestPTRRuleSet(t *testing.T) {
+	ctx := context.Background()
+	request := func(ip string) *Request {
+		return &Request{DestAddr: &statute.AddrSpec{IP: net.ParseIP(ip)}}
+	}
+	resolver := &ptrResolver{
+		names: map[string][]string{
+			"1.2.3.4": {"a.b.googleusercontent.com."},
+			"5.6.7.8": {"evil.example.com."},
+			// the spoofed PTR record, the name does not resolve back to the ip
+			"6.6.6.6": {"x.googleusercontent.com."},
+		},
+		addrs: map[string][]net.IP{
+			"a.b.googleusercontent.com.": {net.ParseIP("2001:db8::1"), net.IPv4(1, 2, 3, 4)},
+			"x.googleusercontent.com.":   {net.IPv4(8, 8, 4, 4)},
+		},
+	}
+
+	r := NewPTRRuleSet(resolver, []string{"*.googleusercontent.com"}, time.Second, time.Minute, false)
+	_, ok := r.Allow(ctx, request("1.2.3.4"))
+	require.True(t, ok)
+	_, ok = r.Allow(ctx, request("5.6.7.8"))
+	require.False(t, ok)
+	_, ok = r.Allow(ctx, request("9.9.9.9"))
+	require.False(t, ok)
+	_, ok = r.Allow(ctx, &Request{DestAddr: &statute.AddrSpec{FQDN: "example.com"}})
+	require.False(t, ok)
+	_, ok = r.Allow(ctx, request("6.6.6.6"))
+	require.False(t, ok)
+	require.Equal(t, 4, resolver.calls)
+
+	// cached, include not found
+	_, ok = r.Allow(ctx, request("1.2.3.4"))
+	require.True(t, ok)
+	_, ok = r.Allow(ctx, request("9.9.9.9"))
+	require.False(t, ok)
+	_, ok = r.Allow(ctx, request("6.6.6.6"))
+	require.False(t, ok)
+	require.Equal(t, 4, resolver.calls)
+
+	// timeout
+	resolver.delay = time.Second
+	r = NewPTRRuleSet(resolver, []string{"*.googleusercontent.com"}, 10*time.Millisecond, 0, false)
+	_, ok = r.Allow(ctx, request("1.2.3.4"))
+	require.False(t, ok)
+	r = NewPTRRuleSet(resolver, []string{"*.googleusercontent.com"}, 10*time.Millisecond, 0, true)
+	_, ok = r.Allow(ctx, request("5.6.7.8"))
+	require.True(t, ok)
+}
@@ -2,18 +2,89 @@ package socks5
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/thinkgos/go-socks5/bufferpool"
 	"github.com/thinkgos/go-socks5/statute"
 )
 
+// maxAcceptDelay the max backoff delay on temporary accept errors
+const maxAcceptDelay = time.Second
+
+// maxPoolDelay the max backoff delay waiting for a free worker of the goroutine pool
+const maxPoolDelay = 50 * time.Millisecond
+
+// PoolRejectPolicy the policy of serving the connection when the goroutine pool is saturated
+type PoolRejectPolicy int
+
+// PoolRejectPolicy policies
+const (
+	// PoolFallback serves the connection in a new goroutine
+	PoolFallback PoolRejectPolicy = iota
+	// PoolBlock blocks accepting until a worker is free
+	PoolBlock
+	// PoolReject rejects the connection by closing it without any reply, as the method
+	// negotiation has not started yet
+	PoolReject
+)
+
+// ErrServerClosed is returned by the Server's Serve and ListenAndServe
+// methods after a call to Shutdown or Close.
+var ErrServerClosed = errors.New("socks5: Server closed")
+
+// The categories of the errors returned by ServeConn, which are matchable via errors.Is.
+// ErrConnRejected, ErrAuthFailed and ErrRequestParse are caused by the client,
+// ErrHandleRequest is caused while handling the request, such as the destination unreachable.
+var (
+	ErrConnRejected  = errors.New("socks5: connection rejected")
+	ErrAuthFailed    = errors.New("socks5: authentication failed")
+	ErrRequestParse  = errors.New("socks5: failed to parse request")
+	ErrHandleRequest = errors.New("socks5: failed to handle request")
+)
+
+// ErrClientGone is wrapped by the error of ServeConn when the client disconnected before
+// the success reply written, the dialed upstream connection is closed. It is a normal
+// condition under churn, Serve logs it at info level.
+var ErrClientGone = errors.New("socks5: client disconnected before reply")
+
+// ErrPolicyDenied is wrapped by the error of ServeConn when the request is denied by policy,
+// by the rules or by the resolver returning ResolveDeniedError. It is not a failure of
+// the server, Serve logs it at info level.
+var ErrPolicyDenied = errors.New("socks5: request denied by policy")
+
+// ConnError is the error returned by ServeConn, it's categorized by Kind
+// and wraps the underlying cause, both are matchable via errors.Is and errors.As.
+type ConnError struct {
+	Kind error
+	Err  error
+}
+
+// Error implement interface error, the message of the cause
+func (e *ConnError) Error() string { return e.Err.Error() }
+
+// Unwrap returns the underlying cause
+func (e *ConnError) Unwrap() error { return e.Err }
+
+// Is reports whether the target is the category of the error
+func (e *ConnError) Is(target error) bool { return target == e.Kind }
+
+// IsClientError reports whether the error returned by ServeConn is caused by the client
+func IsClientError(err error) bool {
+	return errors.Is(err, ErrConnRejected) || errors.Is(err, ErrAuthFailed) || errors.Is(err, ErrRequestParse)
+}
+
 // GPool is used to implement custom goroutine pool default use goroutine
 type GPool interface {
 	Submit(f func()) error
@@ -22,6 +93,8 @@ type GPool interface {
 // Server is responsible for accepting connections and handling
 // the details of the SOCKS5 protocol
 type Server struct {
+	// stats must be the first field to keep 64-bit alignment of its atomic counters.
+	stats       connStats
 	authMethods map[uint8]Authenticator
 	// AuthMethods can be provided to implement custom authentication
 	// By default, "no-auth" mode is enabled.
@@ -31,31 +104,162 @@ type Server struct {
 	// by appending a UserPassAuthenticator to AuthMethods. If not provided,
 	// and authCustomMethods is nil, then "no-auth" mode is enabled.
 	credentials CredentialStore
+	// authMethodPriority the order the server selects the auth method in,
+	// nil means the order offered by the client.
+	authMethodPriority []uint8
+	// authMethodSelector selects the auth methods offered to the client by its address,
+	// nil selected falls back to authCustomMethods.
+	authMethodSelector func(remote net.Addr) []Authenticator
+	// requireAuth never selects the no-auth method, nor serves the SOCKS4 clients.
+	requireAuth bool
 	// resolver can be provided to do custom name resolution.
 	// Defaults to DNSResolver if not provided.
 	resolver NameResolver
 	// rules is provided to enable custom logic around permitting
 	// various commands. If not provided, NewPermitAll is used.
 	rules RuleSet
+	// allowedCommands the commands allowed at the protocol level, nil means all.
+	allowedCommands map[uint8]bool
 	// rewriter can be used to transparently rewrite addresses.
 	// This is invoked before the RuleSet is invoked.
 	// Defaults to NoRewrite.
 	rewriter AddressRewriter
 	// bindIP is used for bind or udp associate
 	bindIP net.IP
+	// bindAddrFunc selects the source ip for outbound dials
+	// and the bind or udp associate listen ip, takes precedence over bindIP.
+	bindAddrFunc func(req *Request) net.IP
+	// udpAdvertisedIP the address carried in the udp associate reply instead of the bind address
+	udpAdvertisedIP net.IP
 	// logger can be used to provide a custom log target.
 	// Defaults to ioutil.Discard.
 	logger Logger
+	// eventLogger can be used to provide structured events.
+	// Defaults to the logger if it implements EventLogger.
+	eventLogger EventLogger
+	// metrics can be used to collect the server metrics.
+	// Defaults to NopMetrics.
+	metrics Metrics
 	// Optional function for dialing out
 	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+	// remoteDNS the domain destination of connect is not resolved locally
+	remoteDNS bool
+	// optimisticConnect the connect success is replied before dialing
+	optimisticConnect bool
+	// dialSelector selects the dial function per connect request, nil falls back to dial
+	dialSelector func(ctx context.Context, req *Request) DialFunc
+	// tracer traces the requests
+	tracer RequestTracer
+	// connContext modifies the context of the connection
+	connContext func(ctx context.Context, conn net.Conn) context.Context
+	// accessLogger receives the audit record of each request
+	accessLogger func(entry AccessLogEntry)
+	// addrFamily the address family policy of the resolved destination
+	addrFamily AddrFamily
+	// bindInterfaceFunc selects the interface which the outbound connection of connect binds to
+	bindInterfaceFunc func(req *Request) string
+	// transparentDial the outbound connections of connect originate from the client's source address.
+	transparentDial bool
+	// happyEyeballs races the connection attempts to all the resolved addresses.
+	happyEyeballs bool
+	// dialTimeout bounds each outbound connection establishment if > 0.
+	dialTimeout time.Duration
+	// handshakeTimeout the read deadline covering the method negotiation, authentication and request parsing
+	handshakeTimeout time.Duration
+	// proxyProtocol the connections start with the PROXY protocol header,
+	// which is optional if proxyProtocolLenient
+	proxyProtocol        bool
+	proxyProtocolLenient bool
+	// onAuth is called after every authentication attempt
+	onAuth func(remote string, method uint8, user string, ok bool, err error)
+	// authFailure is called when no auth method offered by the client is supported
+	authFailure func(remote string, offered []byte)
+	// preHandshakeHook is called before any protocol parsing, rejects the connection if returns error
+	preHandshakeHook func(conn net.Conn) error
+	// afterListen is called once the listener of the ListenAndServe family created, before serving
+	afterListen func(l net.Listener) error
+	// maxDomainLen the maximum domain name length of the request, zero means 255
+	maxDomainLen int
+	// maxMethods the maximum number of methods of the method request, zero means 255
+	maxMethods int
+	// maxUsernameLen and maxPasswordLen the maxima of the user/pass request, zero means 255
+	maxUsernameLen int
+	maxPasswordLen int
+	// maxHandshakeBytes the maximum bytes of the handshake until the request parsed, zero means no limit
+	maxHandshakeBytes int
+	// malformedRequestHook is called with the raw bytes of the malformed request
+	malformedRequestHook func(remote string, raw []byte)
+	// addrTypeNotSupportedRep the reply of the unsupported address type, zero means RepAddrTypeNotSupported
+	addrTypeNotSupportedRep uint8
+	// addrTypeNotSupportedDrop closes the connection without reply for the unsupported address type
+	addrTypeNotSupportedDrop bool
+	// middlewares wrap the built-in dispatch of the request, the first is the outermost.
+	middlewares []func(next HandleFunc) HandleFunc
+	// handler the dispatch wrapped by the middlewares, nil means no middleware
+	handler HandleFunc
+	// unixDestination maps the connect destination to a unix socket path
+	unixDestination func(req *Request) string
+	// connPool provides the pooled connections of the connect command
+	connPool ConnPool
+	// replyDelay returns the delay before each protocol reply write
+	replyDelay func() time.Duration
+	// sessionEnd is called with the bytes relayed in each direction once the relay finished
+	sessionEnd func(req *Request, up, down int64, err error)
+	// connTuner tunes the client and the upstream connections before relaying
+	connTuner func(conn net.Conn, side Side)
 	// buffer pool
 	bufferPool bufferpool.BufPool
+	// relayBufferPool the buffer pool of the relay copies, fallback to bufferPool if nil
+	relayBufferPool bufferpool.BufPool
 	// goroutine pool
 	gPool GPool
+	// poolRejectPolicy the policy when the goroutine pool is saturated
+	poolRejectPolicy PoolRejectPolicy
+	// connLimit semaphore bounds the number of concurrent connections
+	maxConns        int
+	connLimit       chan struct{}
+	connLimitReject bool
+	// bindAcceptTimeout the timeout waiting for the inbound connection of bind
+	bindAcceptTimeout time.Duration
+	// bindPeerCheck only accept the inbound connection from the requested peer ip of bind
+	bindPeerCheck bool
+	// udpFragReassembly reassemble the fragmented datagrams instead of dropping them
+	udpFragReassembly bool
+	// udpTimeout closes the udp associate once no datagrams flow in either direction
+	udpTimeout time.Duration
+	// udpMaxLifetime the absolute max lifetime of the udp associate
+	udpMaxLifetime time.Duration
+	// udpSourceCheck the source validation strictness of the udp associate datagrams
+	udpSourceCheck UDPSourceCheck
+	// udpDestRestrict relays the datagrams only to the DST.ADDR and DST.PORT of the associate request
+	udpDestRestrict bool
+	// udpPacketFilter inspects the datagrams of the udp associate in both directions
+	udpPacketFilter func(from net.Addr, dst *statute.AddrSpec, payload []byte) bool
+	// socks4Enabled serve SOCKS4/SOCKS4a clients too
+	socks4Enabled bool
+	// ipRateLimit limits the connection rate per source ip
+	ipRateLimit *ipRateLimiter
+	// globalRateLimit the bandwidth limiter shared by all the relays, both directions
+	globalRateLimit Limiter
+	// userRateLimit maps the authenticated user to the rate limiters of the relay
+	userRateLimit func(authContext *AuthContext) (up, down Limiter)
+	// connIdleTimeout closes the relay once either direction carried no bytes for the duration
+	connIdleTimeout time.Duration
+	// relayReadTimeout the rolling deadline of every read of the relay
+	relayReadTimeout time.Duration
+	// relayWriteTimeout the rolling deadline of every write of the relay
+	relayWriteTimeout time.Duration
 	// user's handle
 	userConnectHandle   func(ctx context.Context, writer io.Writer, request *Request) error
 	userBindHandle      func(ctx context.Context, writer io.Writer, request *Request) error
 	userAssociateHandle func(ctx context.Context, writer io.Writer, request *Request) error
+
+	inShutdown int32 // accessed atomically (non-zero means we're in Shutdown)
+	mu         sync.Mutex
+	ctx        context.Context
+	cancel     context.CancelFunc
+	listeners  map[*net.Listener]struct{}
+	activeConn map[net.Conn]struct{}
 }
 
 // NewServer creates a new Server
@@ -67,9 +271,7 @@ func NewServer(opts ...Option) *Server {
 		resolver:          DNSResolver{},
 		rules:             NewPermitAll(),
 		logger:            NewLogger(log.New(ioutil.Discard, "socks5: ", log.LstdFlags)),
-		dial: func(ctx context.Context, net_, addr string) (net.Conn, error) {
-			return net.Dial(net_, addr)
-		},
+		dial:              defaultDial,
 	}
 
 	for _, opt := range opts {
@@ -89,6 +291,21 @@ func NewServer(opts ...Option) *Server {
 		srv.authMethods[v.GetCode()] = v
 	}
 
+	if srv.eventLogger == nil {
+		srv.eventLogger, _ = srv.logger.(EventLogger)
+	}
+
+	if srv.maxConns > 0 {
+		srv.connLimit = make(chan struct{}, srv.maxConns)
+	}
+
+	if len(srv.middlewares) > 0 {
+		srv.handler = srv.dispatch
+		for i := len(srv.middlewares) - 1; i >= 0; i-- {
+			srv.handler = srv.middlewares[i](srv.handler)
+		}
+	}
+
 	return srv
 }
 
@@ -98,86 +315,547 @@ func (sf *Server) ListenAndServe(network, addr string) error {
 	if err != nil {
 		return err
 	}
+	if err = sf.runAfterListen(l); err != nil {
+		return err
+	}
+	return sf.Serve(l)
+}
+
+// ListenAndServeReusePort is used to create a listener with SO_REUSEPORT and serve on it,
+// so that multiple servers share the port and the kernel balances the accepts across them.
+// It's only supported on linux.
+func (sf *Server) ListenAndServeReusePort(network, addr string) error {
+	l, err := ListenReusePort(network, addr)
+	if err != nil {
+		return err
+	}
+	if err = sf.runAfterListen(l); err != nil {
+		return err
+	}
+	return sf.Serve(l)
+}
+
+// ListenReusePort creates the listener with SO_REUSEPORT, which can be opened multiple
+// times on the same port. It's only supported on linux.
+func ListenReusePort(network, addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: reusePortControl}
+	return lc.Listen(context.Background(), network, addr)
+}
+
+// ListenAndServeTLS is used to create a TLS listener and serve on it,
+// the clients must speak SOCKS5 over TLS. cfg must contain at least one certificate
+// or set GetCertificate.
+func (sf *Server) ListenAndServeTLS(network, addr string, cfg *tls.Config) error {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	if err = sf.runAfterListen(l); err != nil {
+		return err
+	}
+	return sf.Serve(tls.NewListener(l, cfg))
+}
+
+// runAfterListen calls the after listen hook if any, closes l if it fails
+func (sf *Server) runAfterListen(l net.Listener) error {
+	if sf.afterListen == nil {
+		return nil
+	}
+	if err := sf.afterListen(l); err != nil {
+		l.Close()
+		return err
+	}
+	return nil
+}
+
+// ServeFd is used to serve on the already listening socket of the file descriptor,
+// such as the one passed by systemd socket activation or the parent process of a zero-downtime restart.
+// ServeFd takes the ownership of fd, it's closed once the listener is created(the listener duplicates it)
+// or failed, the caller must not use it anymore.
+func (sf *Server) ServeFd(fd uintptr) error {
+	f := os.NewFile(fd, "socks5-listener")
+	if f == nil {
+		return fmt.Errorf("invalid file descriptor %d", fd)
+	}
+	l, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
 	return sf.Serve(l)
 }
 
 // Serve is used to serve connections from a listener
+// Serve always returns a non-nil error. After Shutdown or Close,
+// the returned error is ErrServerClosed.
 func (sf *Server) Serve(l net.Listener) error {
 	defer l.Close()
+	if !sf.trackListener(&l, true) {
+		return ErrServerClosed
+	}
+	defer sf.trackListener(&l, false)
+
+	var tempDelay time.Duration // how long to sleep on accept failure
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if sf.shuttingDown() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if tempDelay > maxAcceptDelay {
+					tempDelay = maxAcceptDelay
+				}
+				sf.warnf("server: accept error: %v; retrying in %v", err, tempDelay)
+				select {
+				case <-time.After(tempDelay):
+				case <-sf.context().Done():
+				}
+				continue
+			}
 			return err
 		}
-		sf.goFunc(func() {
-			if err := sf.ServeConn(conn); err != nil {
-				sf.logger.Errorf("server: %v", err)
+		tempDelay = 0
+		if !sf.acquireConn(conn) {
+			continue
+		}
+		sf.submitConn(conn, func() {
+			defer sf.releaseConn()
+			id := newConnID()
+			if err := sf.serveConn(conn, id); err != nil {
+				if errors.Is(err, ErrClientGone) || errors.Is(err, ErrPolicyDenied) {
+					sf.infof("server: [%s] %v", id, err)
+				} else if IsClientError(err) {
+					sf.warnf("server: [%s] %v", id, err)
+				} else {
+					sf.logger.Errorf("server: [%s] %v", id, err)
+				}
 			}
 		})
 	}
 }
 
+// submitConn submits the serving of the connection to the goroutine pool
+// following the pool reject policy, f must release the connection slot.
+func (sf *Server) submitConn(conn net.Conn, f func()) {
+	if sf.gPool == nil {
+		go f()
+		return
+	}
+	switch sf.poolRejectPolicy {
+	case PoolBlock:
+		var delay time.Duration
+		for sf.gPool.Submit(f) != nil {
+			if delay == 0 {
+				delay = time.Millisecond
+			} else if delay *= 2; delay > maxPoolDelay {
+				delay = maxPoolDelay
+			}
+			select {
+			case <-time.After(delay):
+			case <-sf.context().Done():
+				conn.Close()
+				sf.releaseConn()
+				return
+			}
+		}
+		atomic.AddInt64(&sf.stats.pooled, 1)
+	case PoolReject:
+		if err := sf.gPool.Submit(f); err != nil {
+			// no reply, it would be taken as the method selected by the client
+			conn.Close()
+			sf.releaseConn()
+			sf.warnf("server: connection from %v rejected, %v", conn.RemoteAddr(), err)
+			return
+		}
+		atomic.AddInt64(&sf.stats.pooled, 1)
+	default:
+		if sf.gPool.Submit(f) != nil {
+			atomic.AddInt64(&sf.stats.fallback, 1)
+			go f()
+			return
+		}
+		atomic.AddInt64(&sf.stats.pooled, 1)
+	}
+}
+
+// acquireConn acquires a slot for the connection, when the connection limit
+// is reached, it blocks until a slot frees or rejects the connection.
+// It reports whether the connection should be served.
+func (sf *Server) acquireConn(conn net.Conn) bool {
+	if sf.connLimit == nil {
+		return true
+	}
+	if sf.connLimitReject {
+		select {
+		case sf.connLimit <- struct{}{}:
+			return true
+		default:
+			// no reply, the method negotiation has not started, a reply would be
+			// taken as the method selected by the client.
+			conn.Close()
+			return false
+		}
+	}
+	select {
+	case sf.connLimit <- struct{}{}:
+		return true
+	case <-sf.context().Done():
+		conn.Close()
+		return false
+	}
+}
+
+// releaseConn releases the slot acquired by acquireConn
+func (sf *Server) releaseConn() {
+	if sf.connLimit != nil {
+		<-sf.connLimit
+	}
+}
+
 // ServeConn is used to serve a single connection.
+// The error returned is a *ConnError categorized by the stage failed, except ErrServerClosed.
 func (sf *Server) ServeConn(conn net.Conn) error {
+	return sf.serveConn(conn, newConnID())
+}
+
+// serveConn serves the connection like ServeConn, id is the unique id of the connection.
+func (sf *Server) serveConn(conn net.Conn, id string) error {
 	var authContext *AuthContext
 
+	// rawConn is the accepted connection, conn may carry the client address of the PROXY header
+	rawConn := conn
+	if sf.proxyProtocol {
+		if sf.handshakeTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(sf.handshakeTimeout)) // nolint: errcheck
+		}
+		ppConn, err := readProxyHeader(conn, sf.proxyProtocolLenient)
+		if err != nil {
+			conn.Close()
+			return &ConnError{ErrRequestParse, fmt.Errorf("failed to read PROXY protocol header from %v, %w", conn.RemoteAddr(), err)}
+		}
+		conn = ppConn
+	}
+	if sf.preHandshakeHook != nil {
+		if err := sf.preHandshakeHook(conn); err != nil {
+			conn.Close()
+			return &ConnError{ErrConnRejected, fmt.Errorf("connection from %v rejected, %w", conn.RemoteAddr(), err)}
+		}
+	}
+	if sf.ipRateLimit != nil {
+		if ip, _, ok := splitAddr(conn.RemoteAddr()); ok && ip != nil && !sf.ipRateLimit.allow(ip.String()) {
+			conn.Close()
+			return &ConnError{ErrConnRejected, fmt.Errorf("connection from %v rejected, rate limit exceeded", conn.RemoteAddr())}
+		}
+	}
+	if !sf.trackConn(conn, true) {
+		conn.Close()
+		return ErrServerClosed
+	}
+	defer sf.trackConn(conn, false)
 	defer conn.Close()
+	if sf.connTuner != nil {
+		sf.connTuner(rawConn, SideClient)
+	}
+
+	sf.stats.open()
+	defer atomic.AddInt64(&sf.stats.active, -1)
+	phase := &connPhase{}
+	phase.enter(&sf.stats.authenticating)
+	defer phase.enter(nil)
+
+	// the connection is closed as soon as the server is closed, so that
+	// the long-lived proxy copies can be interrupted.
+	ctx, cancel := context.WithCancel(context.WithValue(sf.context(), phaseCtxKey{}, phase))
+	defer cancel()
+	ctx = context.WithValue(ctx, ConnIDContextKey, id)
+	if sf.connContext != nil {
+		ctx = sf.connContext(ctx, conn)
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	sf.getMetrics().ConnAccepted()
+	sf.event("connection accepted",
+		"conn_id", id,
+		"remote", addrString(conn.RemoteAddr()),
+		"local", addrString(conn.LocalAddr()))
 
 	bufConn := bufio.NewReader(conn)
 
-	mr, err := statute.ParseMethodRequest(bufConn)
+	if sf.handshakeTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(sf.handshakeTimeout)) // nolint: errcheck
+	}
+
+	if sf.socks4Enabled {
+		if ver, err := bufConn.Peek(1); err == nil && ver[0] == statute.VersionSocks4 {
+			if !sf.socks4Allowed(conn.RemoteAddr()) {
+				// SOCKS4 has no authentication, never bypasses the configured methods
+				rep := statute.Socks4Reply{Version: statute.Socks4ReplyVersion, Response: statute.Socks4Rejected}
+				conn.Write(rep.Bytes()) // nolint: errcheck
+				return &ConnError{ErrAuthFailed, errors.New("socks4 client rejected, the no-auth method is not offered")}
+			}
+			return sf.serveSocks4(ctx, conn, bufConn)
+		}
+	}
+
+	// the handshake reads through hsReader, which enforces the handshake bytes limit
+	var hsReader io.Reader = bufConn
+	var hsLimit *handshakeReader
+	if sf.maxHandshakeBytes > 0 {
+		hsLimit = &handshakeReader{bufConn, int64(sf.maxHandshakeBytes)}
+		hsReader = hsLimit
+	}
+
+	mr, err := statute.ParseMethodRequestLimit(hsReader, sf.maxMethods)
 	if err != nil {
-		return err
+		return &ConnError{ErrRequestParse, fmt.Errorf("failed to read method request, %w", sf.handshakeError(conn, err))}
 	}
 	if mr.Ver != statute.VersionSocks5 {
-		return statute.ErrNotSupportVersion
+		return &ConnError{ErrRequestParse, statute.ErrNotSupportVersion}
 	}
 
 	// Authenticate the connection
-	authContext, err = sf.authenticate(conn, bufConn, conn.RemoteAddr().String(), mr.Methods)
+	var authWriter io.Writer = conn
+	if sf.replyDelay != nil {
+		authWriter = &replyDelayWriter{conn, sf}
+	}
+	authContext, err = sf.authenticate(conn, authWriter, hsReader, conn.RemoteAddr().String(), mr.Methods)
 	if err != nil {
-		return fmt.Errorf("failed to authenticate: %w", err)
+		// the method attempted, no acceptable if the negotiation failed
+		method, user := statute.MethodNoAcceptable, ""
+		var ae *authAttemptError
+		if errors.As(err, &ae) {
+			method, user = ae.method, ae.user
+		}
+		if sf.onAuth != nil {
+			sf.onAuth(conn.RemoteAddr().String(), method, user, false, err)
+		}
+		sf.getMetrics().AuthResult(method, false)
+		sf.event("authenticate",
+			"conn_id", id,
+			"remote", addrString(conn.RemoteAddr()),
+			"offered_methods", mr.Methods,
+			"ok", false,
+			"error", err)
+		return &ConnError{ErrAuthFailed, fmt.Errorf("failed to authenticate: %w", sf.handshakeError(conn, err))}
+	}
+
+	if sf.onAuth != nil {
+		sf.onAuth(conn.RemoteAddr().String(), authContext.Method, authContext.Username(), true, nil)
+	}
+	sf.getMetrics().AuthResult(authContext.Method, true)
+	sf.event("authenticate",
+		"conn_id", id,
+		"remote", addrString(conn.RemoteAddr()),
+		"method", authContext.Method,
+		"username", authContext.Username(),
+		"ok", true)
+
+	// The subsequent traffic may be protected by the auth method
+	var reader io.Reader = bufConn
+	var writer io.Writer = conn
+	if authContext.Encapsulator != nil {
+		reader = authContext.Encapsulator.Reader(bufConn)
+		writer = authContext.Encapsulator.Writer(conn)
 	}
 
 	// The client request detail
-	request, err := ParseRequest(bufConn)
+	hsReader = reader
+	if hsLimit != nil {
+		hsLimit.Reader = reader
+		hsReader = hsLimit
+	}
+	var raw *bytes.Buffer
+	if sf.malformedRequestHook != nil {
+		raw = new(bytes.Buffer)
+		hsReader = io.TeeReader(hsReader, raw)
+	}
+	request, err := parseRequest(hsReader, sf.maxDomainLen)
 	if err != nil {
-		if errors.Is(err, statute.ErrUnrecognizedAddrType) {
-			if err := SendReply(conn, statute.RepAddrTypeNotSupported, nil); err != nil {
-				return fmt.Errorf("failed to send reply %w", err)
+		if raw != nil && !isReadError(err) {
+			sf.malformedRequestHook(conn.RemoteAddr().String(), malformedBytes(raw, reader, bufConn))
+		}
+		if errors.Is(err, statute.ErrUnrecognizedAddrType) && !sf.addrTypeNotSupportedDrop {
+			rep := statute.RepAddrTypeNotSupported
+			if sf.addrTypeNotSupportedRep != 0 {
+				rep = sf.addrTypeNotSupportedRep
+			}
+			sf.delayReply()
+			if err := SendReply(writer, rep, nil); err != nil {
+				return &ConnError{ErrRequestParse, fmt.Errorf("failed to send reply %w", err)}
 			}
 		}
-		return fmt.Errorf("failed to read destination address, %w", err)
-	}
-
-	if request.Request.Command != statute.CommandConnect &&
-		request.Request.Command != statute.CommandBind &&
-		request.Request.Command != statute.CommandAssociate {
-		if err := SendReply(conn, statute.RepCommandNotSupported, nil); err != nil {
-			return fmt.Errorf("failed to send reply, %v", err)
+		if errors.Is(err, statute.ErrInvalidCommand) {
+			sf.delayReply()
+			if err := SendReply(writer, statute.RepCommandNotSupported, nil); err != nil {
+				return &ConnError{ErrRequestParse, fmt.Errorf("failed to send reply, %w", err)}
+			}
+			return &ConnError{ErrRequestParse, err}
 		}
-		return fmt.Errorf("unrecognized command[%d]", request.Request.Command)
+		return &ConnError{ErrRequestParse, fmt.Errorf("failed to read destination address, %w", sf.handshakeError(conn, err))}
 	}
+	sf.clearHandshakeDeadline(conn)
+	request.Reader = reader
 
 	request.AuthContext = authContext
+	request.ConnID = id
 	request.LocalAddr = conn.LocalAddr()
 	request.RemoteAddr = conn.RemoteAddr()
+	request.conn, request.bufConn = conn, bufConn
+	phase.enter(&sf.stats.connecting)
 	// Process the client request
-	return sf.handleRequest(conn, request)
+	if err := sf.handleRequest(ctx, writer, request); err != nil {
+		return &ConnError{ErrHandleRequest, err}
+	}
+	return nil
 }
 
 // authenticate is used to handle connection authentication
-func (sf *Server) authenticate(conn io.Writer, bufConn io.Reader,
+func (sf *Server) authenticate(raw net.Conn, conn io.Writer, bufConn io.Reader,
 	userAddr string, methods []byte) (*AuthContext, error) {
+	cators, authMethods := sf.authCustomMethods, sf.authMethods
+	if sf.authMethodSelector != nil && raw != nil {
+		// the methods offered to this client, by its network zone
+		if selected := sf.authMethodSelector(raw.RemoteAddr()); selected != nil {
+			cators, authMethods = selected, make(map[uint8]Authenticator, len(selected))
+			for _, cator := range selected {
+				authMethods[cator.GetCode()] = cator
+			}
+		}
+	}
 	// Select a usable method
-	for _, method := range methods {
-		if cator, found := sf.authMethods[method]; found {
-			return cator.Authenticate(bufConn, conn, userAddr)
+	if cator, found := sf.selectAuthMethod(authMethods, methods); found {
+		var authContext *AuthContext
+		var err error
+		if cc, ok := cator.(ConnAuthenticator); ok && raw != nil {
+			authContext, err = cc.AuthenticateConn(raw, bufConn, conn, userAddr)
+		} else if up, ok := userPassAuthenticator(cator); ok && (sf.maxUsernameLen > 0 || sf.maxPasswordLen > 0) {
+			authContext, err = up.authenticate(bufConn, conn, userAddr, sf.maxUsernameLen, sf.maxPasswordLen)
+		} else {
+			authContext, err = cator.Authenticate(bufConn, conn, userAddr)
 		}
+		var ae *authAttemptError
+		if err != nil && !errors.As(err, &ae) {
+			err = &authAttemptError{cator.GetCode(), "", err}
+		}
+		return authContext, err
 	}
 	// No usable method found
 	conn.Write([]byte{statute.VersionSocks5, statute.MethodNoAcceptable}) // nolint: errcheck
-	return nil, statute.ErrNoSupportedAuth
+	if sf.authFailure != nil {
+		sf.authFailure(userAddr, methods)
+	}
+	supported := make([]byte, 0, len(cators))
+	for _, cator := range cators {
+		supported = append(supported, cator.GetCode())
+	}
+	return nil, fmt.Errorf("%w, client offered methods %v, server supports methods %v",
+		statute.ErrNoSupportedAuth, methods, supported)
+}
+
+// selectAuthMethod selects the authenticator of the offered methods, by the server's
+// priority first, then the remaining methods in the order offered by the client.
+func (sf *Server) selectAuthMethod(authMethods map[uint8]Authenticator, methods []byte) (Authenticator, bool) {
+	// the no-auth method on the wire authenticated by the connection, such as the tls client certificate
+	if _, connAuth := authMethods[statute.MethodNoAuth].(ConnAuthenticator); sf.requireAuth && !connAuth {
+		methods = bytes.Replace(methods, []byte{statute.MethodNoAuth}, nil, -1)
+	}
+	for _, method := range sf.authMethodPriority {
+		if bytes.IndexByte(methods, method) < 0 {
+			continue
+		}
+		if cator, found := authMethods[method]; found {
+			return cator, true
+		}
+	}
+	for _, method := range methods {
+		if cator, found := authMethods[method]; found {
+			return cator, true
+		}
+	}
+	return nil, false
+}
+
+// delayReply waits for the reply delay if any, before a protocol reply is written
+func (sf *Server) delayReply() {
+	if sf.replyDelay != nil {
+		if d := sf.replyDelay(); d > 0 {
+			time.Sleep(d)
+		}
+	}
+}
+
+// replyDelayWriter delays each write, used for the replies of the auth negotiation
+type replyDelayWriter struct {
+	io.Writer
+	sf *Server
+}
+
+func (sf *replyDelayWriter) Write(b []byte) (int, error) {
+	sf.sf.delayReply()
+	return sf.Writer.Write(b)
+}
+
+// isReadError reports whether the err is caused by reading the connection,
+// rather than the malformed bytes.
+func isReadError(err error) bool {
+	var ne net.Error
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, statute.ErrHandshakeTooLarge) || errors.As(err, &ne)
+}
+
+// malformedBytes returns the bytes of the malformed request read, followed by
+// the bytes the client sent but not read yet if the request is not encapsulated.
+func malformedBytes(raw *bytes.Buffer, reader io.Reader, bufConn *bufio.Reader) []byte {
+	b := raw.Bytes()
+	if reader == io.Reader(bufConn) {
+		if pending, err := bufConn.Peek(bufConn.Buffered()); err == nil {
+			b = append(b, pending...)
+		}
+	}
+	return b
+}
+
+// handshakeReader limits the bytes read by the handshake,
+// ErrHandshakeTooLarge is returned once the limit is reached.
+type handshakeReader struct {
+	io.Reader
+	n int64 // the remaining bytes
+}
+
+func (sf *handshakeReader) Read(b []byte) (int, error) {
+	if sf.n <= 0 {
+		return 0, statute.ErrHandshakeTooLarge
+	}
+	if int64(len(b)) > sf.n {
+		b = b[:sf.n]
+	}
+	n, err := sf.Reader.Read(b)
+	sf.n -= int64(n)
+	return n, err
+}
+
+// clearHandshakeDeadline clears the read deadline of the handshake once the request is parsed
+func (sf *Server) clearHandshakeDeadline(conn net.Conn) {
+	if sf.handshakeTimeout > 0 {
+		conn.SetReadDeadline(time.Time{}) // nolint: errcheck
+	}
+}
+
+// handshakeError annotates the error caused by the handshake deadline
+func (sf *Server) handshakeError(conn net.Conn, err error) error {
+	if sf.handshakeTimeout > 0 && isTimeout(err) {
+		return fmt.Errorf("handshake with %v not completed in %v, %w", conn.RemoteAddr(), sf.handshakeTimeout, err)
+	}
+	return err
 }
 
 func (sf *Server) goFunc(f func()) {
@@ -185,3 +863,143 @@ func (sf *Server) goFunc(f func()) {
 		go f()
 	}
 }
+
+// ShutdownError is returned by Shutdown when the context expires before
+// all the connections finished, the unfinished connections have been force closed.
+type ShutdownError struct {
+	// Unfinished the number of the connections still active when the context expired
+	Unfinished int
+	// Err the context's error
+	Err error
+}
+
+// Error implement interface error
+func (e *ShutdownError) Error() string {
+	return fmt.Sprintf("socks5: shutdown with %d connections unfinished, %v", e.Unfinished, e.Err)
+}
+
+// Unwrap returns the context's error
+func (e *ShutdownError) Unwrap() error { return e.Err }
+
+// Shutdown gracefully shuts down the server. Shutdown works by first
+// closing all open listeners, then waiting for the active connections to finish,
+// and then signaling them to stop via the server context. If the provided context
+// expires before the connections finish, the remaining connections are force closed
+// and Shutdown returns a *ShutdownError with their count, which wraps the context's error.
+func (sf *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&sf.inShutdown, 1)
+
+	sf.mu.Lock()
+	sf.closeListenersLocked()
+	sf.mu.Unlock()
+	sf.context() // make sure the server context is initialized
+	defer sf.cancel()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if sf.numActiveConn() == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return &ShutdownError{sf.closeActiveConns(), ctx.Err()}
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close immediately closes all active listeners and all active
+// connections. For a graceful shutdown, use Shutdown.
+func (sf *Server) Close() error {
+	atomic.StoreInt32(&sf.inShutdown, 1)
+	sf.context() // make sure the server context is initialized
+	sf.cancel()
+
+	sf.mu.Lock()
+	sf.closeListenersLocked()
+	sf.mu.Unlock()
+	sf.closeActiveConns()
+	return nil
+}
+
+// closeActiveConns closes all the active connections, returns the number of them.
+func (sf *Server) closeActiveConns() int {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	n := len(sf.activeConn)
+	for c := range sf.activeConn {
+		c.Close()
+		delete(sf.activeConn, c)
+	}
+	return n
+}
+
+// shutdownPollInterval is how often we poll for quiescence during Server.Shutdown.
+const shutdownPollInterval = 50 * time.Millisecond
+
+func (sf *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&sf.inShutdown) != 0
+}
+
+// context returns the server-level context, which is canceled by
+// Shutdown or Close.
+func (sf *Server) context() context.Context {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	if sf.ctx == nil {
+		sf.ctx, sf.cancel = context.WithCancel(context.Background())
+	}
+	return sf.ctx
+}
+
+// trackListener adds or removes a net.Listener to the set of tracked
+// listeners. It reports whether the server is still up (not Shutdown or Closed).
+func (sf *Server) trackListener(ln *net.Listener, add bool) bool {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	if sf.listeners == nil {
+		sf.listeners = make(map[*net.Listener]struct{})
+	}
+	if add {
+		if sf.shuttingDown() {
+			return false
+		}
+		sf.listeners[ln] = struct{}{}
+	} else {
+		delete(sf.listeners, ln)
+	}
+	return true
+}
+
+// trackConn adds or removes a net.Conn to the set of tracked
+// connections. It reports whether the server is still up (not Shutdown or Closed).
+func (sf *Server) trackConn(c net.Conn, add bool) bool {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	if sf.activeConn == nil {
+		sf.activeConn = make(map[net.Conn]struct{})
+	}
+	if add {
+		if sf.shuttingDown() {
+			return false
+		}
+		sf.activeConn[c] = struct{}{}
+	} else {
+		delete(sf.activeConn, c)
+	}
+	return true
+}
+
+func (sf *Server) numActiveConn() int {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	return len(sf.activeConn)
+}
+
+func (sf *Server) closeListenersLocked() {
+	for ln := range sf.listeners {
+		(*ln).Close()
+		delete(sf.listeners, ln)
+	}
+}
@@ -0,0 +1,111 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+)
+
+func TestServer_ServeFd(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn) // nolint: errcheck
+	}()
+
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	f, err := srvLn.(*net.TCPListener).File()
+	require.NoError(t, err)
+	fd, err := syscall.Dup(int(f.Fd()))
+	require.NoError(t, err)
+	f.Close()
+	// the listen queue is held by the fd
+	srvLn.Close()
+
+	srv := NewServer()
+	go srv.ServeFd(uintptr(fd)) // nolint: errcheck
+	defer srv.Close()
+
+	dial, err := proxy.SOCKS5("tcp", srvLn.Addr().String(), nil, proxy.Direct)
+	require.NoError(t, err)
+	conn, err := dial.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	out := make([]byte, 4)
+	_, err = io.ReadFull(conn, out)
+	require.NoError(t, err)
+	require.Equal(t, []byte("ping"), out)
+
+	require.Error(t, NewServer().ServeFd(^uintptr(0)))
+}
+
+func TestServer_ListenAndServeReusePort(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn) // nolint: errcheck
+			}()
+		}
+	}()
+
+	// two listeners on the same port
+	ln1, err := ListenReusePort("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ln2, err := ListenReusePort("tcp", ln1.Addr().String())
+	require.NoError(t, err)
+	ln2.Close()
+	// the plain listener can not share it
+	_, err = net.Listen("tcp", ln1.Addr().String())
+	require.Error(t, err)
+	addr := ln1.Addr().String()
+	ln1.Close()
+
+	srv1, srv2 := NewServer(), NewServer()
+	go srv1.ListenAndServeReusePort("tcp", addr) // nolint: errcheck
+	go srv2.ListenAndServeReusePort("tcp", addr) // nolint: errcheck
+	defer srv1.Close()
+	defer srv2.Close()
+
+	dial, err := proxy.SOCKS5("tcp", addr, nil, proxy.Direct)
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		var conn net.Conn
+		for retry := 0; retry < 50; retry++ {
+			// wait for the servers listening
+			if conn, err = dial.Dial("tcp", l.Addr().String()); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		require.NoError(t, err)
+		_, err = conn.Write([]byte("ping"))
+		require.NoError(t, err)
+		out := make([]byte, 4)
+		_, err = io.ReadFull(conn, out)
+		require.NoError(t, err)
+		require.Equal(t, []byte("ping"), out)
+		conn.Close()
+	}
+}
@@ -2,11 +2,22 @@ package socks5
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"io"
+	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -192,8 +203,9 @@ func TestSOCKS5_Associate(t *testing.T) {
 	})
 	require.NoError(t, err)
 	// Send a ping
-	udpConn.Write(append([]byte{0, 0, 0, statute.ATYPIPv4, 0, 0, 0, 0, 0, 0}, []byte("ping")...)) // nolint: errcheck
+	udpConn.Write(append([]byte{0, 0, 0, statute.ATYPIPv4, 127, 0, 0, 1, byte(lAddr.Port >> 8), byte(lAddr.Port)}, []byte("ping")...)) // nolint: errcheck
 	response := make([]byte, 1024)
+	udpConn.SetDeadline(time.Now().Add(time.Second)) // nolint: errcheck
 	n, _, err := udpConn.ReadFrom(response)
 	require.NoError(t, err)
 	assert.Equal(t, []byte("pong"), response[n-4:n])
@@ -252,6 +264,236 @@ func Test_SocksWithProxy(t *testing.T) {
 	require.Equal(t, []byte("pong"), out)
 }
 
+func TestServer_Shutdown(t *testing.T) {
+	// Create a local listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		conn, err := l.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+		io.Copy(ioutil.Discard, conn) // nolint: errcheck
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	srv := NewServer()
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.Serve(srvLn) }()
+
+	// client
+	dial, err := proxy.SOCKS5("tcp", srvLn.Addr().String(), nil, proxy.Direct)
+	require.NoError(t, err)
+	conn, err := dial.Dial("tcp", lAddr.String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// the in-flight connection is not finished in time
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err = srv.Shutdown(ctx)
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+	var shutdownErr *ShutdownError
+	require.True(t, errors.As(err, &shutdownErr))
+	require.Equal(t, 1, shutdownErr.Unfinished)
+	require.True(t, errors.Is(<-serveErr, ErrServerClosed))
+
+	// the in-flight connection has been force closed
+	conn.SetDeadline(time.Now().Add(time.Second)) // nolint: errcheck
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+
+	// the server no longer accepts new connections
+	require.True(t, errors.Is(srv.Serve(srvLn), ErrServerClosed))
+}
+
+func TestServer_ShutdownDrain(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn) // nolint: errcheck
+	}()
+
+	srv := NewServer()
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+
+	dial, err := proxy.SOCKS5("tcp", srvLn.Addr().String(), nil, proxy.Direct)
+	require.NoError(t, err)
+	conn, err := dial.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+
+	done := make(chan error, 1)
+	go func() { done <- srv.Shutdown(context.Background()) }()
+
+	// the in-flight relay keeps working while draining
+	time.Sleep(100 * time.Millisecond)
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 4))
+	require.NoError(t, err)
+	select {
+	case <-done:
+		t.Fatal("shutdown before the connection finished")
+	default:
+	}
+
+	conn.Close()
+	select {
+	case err = <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("shutdown not finished")
+	}
+}
+
+func TestServer_Close(t *testing.T) {
+	srv := NewServer()
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.Serve(srvLn) }()
+
+	conn, err := net.Dial("tcp", srvLn.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	require.NoError(t, srv.Close())
+	require.True(t, errors.Is(<-serveErr, ErrServerClosed))
+
+	conn.SetDeadline(time.Now().Add(time.Second)) // nolint: errcheck
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+}
+
+func TestServer_ConnIdleTimeout(t *testing.T) {
+	// Create a local listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+		io.Copy(ioutil.Discard, conn) // nolint: errcheck
+	}()
+
+	srv := NewServer(WithConnIdleTimeout(100 * time.Millisecond))
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	// client
+	dial, err := proxy.SOCKS5("tcp", srvLn.Addr().String(), nil, proxy.Direct)
+	require.NoError(t, err)
+	conn, err := dial.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// no bytes flow, the relay is closed
+	conn.SetDeadline(time.Now().Add(time.Second)) // nolint: errcheck
+	_, err = conn.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+}
+
+func TestServer_ConnIdleTimeout_Trickle(t *testing.T) {
+	// Create a local listener, the target never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+		io.Copy(ioutil.Discard, conn) // nolint: errcheck
+	}()
+
+	srv := NewServer(WithConnIdleTimeout(100 * time.Millisecond))
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	// client
+	dial, err := proxy.SOCKS5("tcp", srvLn.Addr().String(), nil, proxy.Direct)
+	require.NoError(t, err)
+	conn, err := dial.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// the client trickles within the timeout, the silent downstream closes the relay anyway
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, err := conn.Write([]byte{'x'}); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	conn.SetReadDeadline(time.Now().Add(time.Second)) // nolint: errcheck
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+	nerr, ok := err.(net.Error)
+	require.False(t, ok && nerr.Timeout(), "the relay is not closed by the idle timeout")
+}
+
+func TestServer_MaxConnections(t *testing.T) {
+	srv := NewServer(WithMaxConnections(1), WithMaxConnectionsReject(true))
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	conn1, err := net.Dial("tcp", srvLn.Addr().String())
+	require.NoError(t, err)
+	defer conn1.Close()
+	require.Eventually(t, func() bool {
+		return srv.ActiveConns() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// over the limit, closed before the method negotiation without any reply
+	conn2, err := net.Dial("tcp", srvLn.Addr().String())
+	require.NoError(t, err)
+	defer conn2.Close()
+	conn2.SetDeadline(time.Now().Add(time.Second)) // nolint: errcheck
+	out, err := ioutil.ReadAll(conn2)
+	require.NoError(t, err)
+	assert.Empty(t, out)
+
+	// the slot frees
+	conn1.Close()
+	require.Eventually(t, func() bool {
+		return srv.ActiveConns() == 0
+	}, time.Second, 10*time.Millisecond)
+
+	dial, err := proxy.SOCKS5("tcp", srvLn.Addr().String(), nil, proxy.Direct)
+	require.NoError(t, err)
+	_, err = dial.Dial("tcp", "127.0.0.1:1")
+	require.Error(t, err)
+	require.NotContains(t, err.Error(), "general SOCKS server failure")
+}
+
 /*****************************    auth        *******************************/
 
 func TestNoAuth_Server(t *testing.T) {
@@ -259,7 +501,7 @@ func TestNoAuth_Server(t *testing.T) {
 	rsp := new(bytes.Buffer)
 	s := NewServer(WithAuthMethods([]Authenticator{&NoAuthAuthenticator{}}))
 
-	ctx, err := s.authenticate(rsp, req, "", []byte{statute.MethodNoAuth})
+	ctx, err := s.authenticate(nil, rsp, req, "", []byte{statute.MethodNoAuth})
 	require.NoError(t, err)
 	assert.Equal(t, statute.MethodNoAuth, ctx.Method)
 	assert.Equal(t, []byte{statute.VersionSocks5, statute.MethodNoAuth}, rsp.Bytes())
@@ -273,7 +515,7 @@ func TestPasswordAuth_Valid_Server(t *testing.T) {
 	}
 	s := NewServer(WithAuthMethods([]Authenticator{cator}))
 
-	ctx, err := s.authenticate(rsp, req, "", []byte{statute.MethodUserPassAuth})
+	ctx, err := s.authenticate(nil, rsp, req, "", []byte{statute.MethodUserPassAuth})
 	require.NoError(t, err)
 	assert.Equal(t, statute.MethodUserPassAuth, ctx.Method)
 
@@ -296,13 +538,102 @@ func TestPasswordAuth_Invalid_Server(t *testing.T) {
 	}
 	s := NewServer(WithAuthMethods([]Authenticator{cator}))
 
-	ctx, err := s.authenticate(rsp, req, "", []byte{statute.MethodNoAuth, statute.MethodUserPassAuth})
+	ctx, err := s.authenticate(nil, rsp, req, "", []byte{statute.MethodNoAuth, statute.MethodUserPassAuth})
 	require.True(t, errors.Is(err, statute.ErrUserAuthFailed))
 	require.Nil(t, ctx)
 
 	assert.Equal(t, []byte{statute.VersionSocks5, statute.MethodUserPassAuth, 1, statute.AuthFailure}, rsp.Bytes())
 }
 
+func TestAuthMethodPriority_Server(t *testing.T) {
+	newServer := func(opts ...Option) *Server {
+		cators := []Authenticator{
+			&NoAuthAuthenticator{},
+			UserPassAuthenticator{StaticCredentials{"foo": "bar"}},
+		}
+		return NewServer(append(opts, WithAuthMethods(cators))...)
+	}
+	offered := []byte{statute.MethodNoAuth, statute.MethodUserPassAuth}
+
+	// client order
+	rsp := new(bytes.Buffer)
+	ctx, err := newServer().authenticate(nil, rsp, bytes.NewBuffer(nil), "", offered)
+	require.NoError(t, err)
+	assert.Equal(t, statute.MethodNoAuth, ctx.Method)
+
+	// server priority, the client can not downgrade to no-auth
+	rsp = new(bytes.Buffer)
+	req := bytes.NewBuffer([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
+	s := newServer(WithAuthMethodPriority([]uint8{statute.MethodUserPassAuth, statute.MethodNoAuth}))
+	ctx, err = s.authenticate(nil, rsp, req, "", offered)
+	require.NoError(t, err)
+	assert.Equal(t, statute.MethodUserPassAuth, ctx.Method)
+
+	// the priority method not offered is skipped
+	rsp = new(bytes.Buffer)
+	ctx, err = s.authenticate(nil, rsp, bytes.NewBuffer(nil), "", []byte{statute.MethodNoAuth})
+	require.NoError(t, err)
+	assert.Equal(t, statute.MethodNoAuth, ctx.Method)
+}
+
+// remoteConn is a connection from the remote address
+type remoteConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (sf remoteConn) RemoteAddr() net.Addr { return sf.remote }
+
+func TestAuthMethodSelector_Server(t *testing.T) {
+	_, lan, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+	s := NewServer(
+		WithCredential(StaticCredentials{"foo": "bar"}),
+		WithAuthMethodSelector(func(remote net.Addr) []Authenticator {
+			if lan.Contains(remote.(*net.TCPAddr).IP) {
+				return []Authenticator{&NoAuthAuthenticator{}}
+			}
+			return nil
+		}),
+	)
+	offered := []byte{statute.MethodNoAuth}
+
+	// no-auth for the lan
+	rsp := new(bytes.Buffer)
+	ctx, err := s.authenticate(remoteConn{remote: &net.TCPAddr{IP: net.IPv4(10, 1, 2, 3)}}, rsp, bytes.NewBuffer(nil), "", offered)
+	require.NoError(t, err)
+	assert.Equal(t, statute.MethodNoAuth, ctx.Method)
+
+	// the server methods for the others
+	rsp = new(bytes.Buffer)
+	ctx, err = s.authenticate(remoteConn{remote: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)}}, rsp, bytes.NewBuffer(nil), "", offered)
+	require.True(t, errors.Is(err, statute.ErrNoSupportedAuth))
+	require.Nil(t, ctx)
+	assert.Equal(t, []byte{statute.VersionSocks5, statute.MethodNoAcceptable}, rsp.Bytes())
+}
+
+func TestRequireAuth_Server(t *testing.T) {
+	cators := []Authenticator{
+		&NoAuthAuthenticator{},
+		UserPassAuthenticator{StaticCredentials{"foo": "bar"}},
+	}
+	s := NewServer(WithAuthMethods(cators), WithRequireAuth(true))
+
+	// only no-auth offered
+	rsp := new(bytes.Buffer)
+	ctx, err := s.authenticate(nil, rsp, bytes.NewBuffer(nil), "", []byte{statute.MethodNoAuth})
+	require.True(t, errors.Is(err, statute.ErrNoSupportedAuth))
+	require.Nil(t, ctx)
+	assert.Equal(t, []byte{statute.VersionSocks5, statute.MethodNoAcceptable}, rsp.Bytes())
+
+	// no-auth listed first is not selected
+	rsp = new(bytes.Buffer)
+	req := bytes.NewBuffer([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
+	ctx, err = s.authenticate(nil, rsp, req, "", []byte{statute.MethodNoAuth, statute.MethodUserPassAuth})
+	require.NoError(t, err)
+	assert.Equal(t, statute.MethodUserPassAuth, ctx.Method)
+}
+
 func TestNoSupportedAuth_Server(t *testing.T) {
 	req := bytes.NewBuffer(nil)
 	rsp := new(bytes.Buffer)
@@ -310,11 +641,978 @@ func TestNoSupportedAuth_Server(t *testing.T) {
 		StaticCredentials{"foo": "bar"},
 	}
 
-	s := NewServer(WithAuthMethods([]Authenticator{cator}))
+	var offered []byte
+	s := NewServer(
+		WithAuthMethods([]Authenticator{cator}),
+		WithAuthFailure(func(remote string, methods []byte) {
+			offered = methods
+		}),
+	)
 
-	ctx, err := s.authenticate(rsp, req, "", []byte{statute.MethodNoAuth})
+	ctx, err := s.authenticate(nil, rsp, req, "", []byte{statute.MethodNoAuth})
 	require.True(t, errors.Is(err, statute.ErrNoSupportedAuth))
+	require.Contains(t, err.Error(), "client offered methods [0], server supports methods [2]")
 	require.Nil(t, ctx)
+	require.Equal(t, []byte{statute.MethodNoAuth}, offered)
 
 	assert.Equal(t, []byte{statute.VersionSocks5, statute.MethodNoAcceptable}, rsp.Bytes())
 }
+
+type tempError struct{}
+
+func (tempError) Error() string   { return "temporary accept error" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+type flakyListener struct {
+	net.Listener
+	temps int
+}
+
+func (sf *flakyListener) Accept() (net.Conn, error) {
+	if sf.temps > 0 {
+		sf.temps--
+		return nil, tempError{}
+	}
+	return nil, errors.New("permanent accept error")
+}
+
+func (sf *flakyListener) Close() error { return nil }
+
+type warnRecorder struct {
+	warns []string
+}
+
+func (sf *warnRecorder) Errorf(string, ...interface{}) {}
+func (sf *warnRecorder) Warnf(format string, args ...interface{}) {
+	sf.warns = append(sf.warns, format)
+}
+
+func TestServer_AcceptBackoff(t *testing.T) {
+	logger := &warnRecorder{}
+	srv := NewServer(WithLogger(logger))
+
+	start := time.Now()
+	err := srv.Serve(&flakyListener{temps: 3})
+	require.EqualError(t, err, "permanent accept error")
+	require.Len(t, logger.warns, 3)
+	// 5ms + 10ms + 20ms
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(35*time.Millisecond))
+}
+
+func TestServer_ConnTuner(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn) // nolint: errcheck
+	}()
+
+	tuned := make(chan Side, 2)
+	srv := NewServer(WithConnTuner(func(conn net.Conn, side Side) {
+		if tc, ok := conn.(*net.TCPConn); ok {
+			tc.SetNoDelay(true) // nolint: errcheck
+		}
+		tuned <- side
+	}))
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	dial, err := proxy.SOCKS5("tcp", srvLn.Addr().String(), nil, proxy.Direct)
+	require.NoError(t, err)
+	conn, err := dial.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.Equal(t, SideClient, <-tuned)
+	require.Equal(t, SideUpstream, <-tuned)
+}
+
+func TestServer_SessionEnd(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	outbound := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		outbound <- conn.RemoteAddr().String()
+		io.ReadFull(conn, make([]byte, 4)) // nolint: errcheck
+		conn.Write([]byte("pong-pong"))    // nolint: errcheck
+	}()
+
+	type session struct {
+		dest     string
+		user     string
+		outbound string
+		up, down int64
+	}
+	sessions := make(chan session, 1)
+	srv := NewServer(
+		WithCredential(StaticCredentials{"foo": "bar"}),
+		WithSessionEnd(func(req *Request, up, down int64, err error) {
+			sessions <- session{req.DestAddr.String(), req.AuthContext.Payload["username"],
+				req.OutboundAddr.String(), up, down}
+		}),
+	)
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	dial, err := proxy.SOCKS5("tcp", srvLn.Addr().String(), &proxy.Auth{User: "foo", Password: "bar"}, proxy.Direct)
+	require.NoError(t, err)
+	conn, err := dial.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 9))
+	require.NoError(t, err)
+	// the target closes first
+	_, err = conn.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+	conn.Close()
+
+	select {
+	case s := <-sessions:
+		require.Equal(t, session{l.Addr().String(), "foo", <-outbound, 4, 9}, s)
+	case <-time.After(time.Second):
+		t.Fatal("session end not called")
+	}
+}
+
+func TestServer_PreHandshakeHook(t *testing.T) {
+	srv := NewServer(WithPreHandshakeHook(func(conn net.Conn) error {
+		return errors.New("banned")
+	}))
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srvLn.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// closed without any reply
+	conn.SetDeadline(time.Now().Add(time.Second)) // nolint: errcheck
+	_, err = conn.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+}
+
+func TestServer_PerIPRateLimit(t *testing.T) {
+	srv := NewServer(WithPerIPRateLimit(0.001, 1))
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	dial, err := proxy.SOCKS5("tcp", srvLn.Addr().String(), nil, proxy.Direct)
+	require.NoError(t, err)
+	// the first connection consumes the only token, and is served until the connect reply
+	_, err = dial.Dial("tcp", "127.0.0.1:1")
+	require.Contains(t, err.Error(), "connection refused")
+	require.Equal(t, 1, srv.ipRateLimit.len())
+
+	// the second connection is closed without any reply
+
+	conn, err := net.Dial("tcp", srvLn.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second)) // nolint: errcheck
+	_, err = conn.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+}
+
+func TestServer_HandshakeTimeout(t *testing.T) {
+	srv := NewServer(WithHandshakeTimeout(100 * time.Millisecond))
+
+	// the client never sends the method request
+	client, server := net.Pipe()
+	defer client.Close()
+	err := srv.ServeConn(server)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not completed in 100ms")
+
+	// stalls after the method request
+	client, server = net.Pipe()
+	defer client.Close()
+	go func() {
+		client.Write([]byte{statute.VersionSocks5, 1, statute.MethodNoAuth}) // nolint: errcheck
+		io.Copy(ioutil.Discard, client)                                      // nolint: errcheck
+	}()
+	err = srv.ServeConn(server)
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrRequestParse))
+	require.Contains(t, err.Error(), "not completed in 100ms")
+
+	// the deadline is cleared once relaying begins
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn) // nolint: errcheck
+	}()
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	dial, err := proxy.SOCKS5("tcp", srvLn.Addr().String(), nil, proxy.Direct)
+	require.NoError(t, err)
+	conn, err := dial.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	out := make([]byte, 4)
+	_, err = io.ReadFull(conn, out)
+	require.NoError(t, err)
+	require.Equal(t, []byte("ping"), out)
+}
+
+func TestServer_ConnError(t *testing.T) {
+	serve := func(srv *Server, input []byte) error {
+		client, server := net.Pipe()
+		defer client.Close()
+		go func() {
+			client.Write(input)             // nolint: errcheck
+			io.Copy(ioutil.Discard, client) // nolint: errcheck
+		}()
+		return srv.ServeConn(server)
+	}
+
+	// not socks5
+	err := serve(NewServer(), []byte{0x01, 1, statute.MethodNoAuth})
+	require.True(t, errors.Is(err, ErrRequestParse))
+	require.True(t, errors.Is(err, statute.ErrNotSupportVersion))
+	require.True(t, IsClientError(err))
+
+	// no acceptable auth method
+	err = serve(NewServer(WithCredential(StaticCredentials{"foo": "bar"})),
+		[]byte{statute.VersionSocks5, 1, statute.MethodNoAuth})
+	require.True(t, errors.Is(err, ErrAuthFailed))
+	require.True(t, errors.Is(err, statute.ErrNoSupportedAuth))
+	require.True(t, IsClientError(err))
+
+	// unrecognized command
+	err = serve(NewServer(), []byte{
+		statute.VersionSocks5, 1, statute.MethodNoAuth,
+		statute.VersionSocks5, 0x09, 0, statute.ATYPIPv4, 127, 0, 0, 1, 0, 80,
+	})
+	require.True(t, errors.Is(err, ErrRequestParse))
+	require.True(t, errors.Is(err, statute.ErrInvalidCommand))
+
+	// the domain too long
+	err = serve(NewServer(WithHandshakeLimits(8, 0)), []byte{
+		statute.VersionSocks5, 1, statute.MethodNoAuth,
+		statute.VersionSocks5, statute.CommandConnect, 0, statute.ATYPDomain,
+		9, 'l', 'o', 'c', 'a', 'l', 'h', 'o', 's', 't', 0, 80,
+	})
+	require.True(t, errors.Is(err, ErrRequestParse))
+	require.True(t, errors.Is(err, statute.ErrDomainTooLong))
+
+	// the handshake too large
+	err = serve(NewServer(WithHandshakeLimits(0, 8)), []byte{
+		statute.VersionSocks5, 1, statute.MethodNoAuth,
+		statute.VersionSocks5, statute.CommandConnect, 0, statute.ATYPIPv4, 127, 0, 0, 1, 0, 80,
+	})
+	require.True(t, errors.Is(err, ErrRequestParse))
+	require.True(t, errors.Is(err, statute.ErrHandshakeTooLarge))
+
+	// the statute limits
+	limits := statute.Limits{MaxMethods: 1, MaxUsernameLen: 2}
+	err = serve(NewServer(WithStatuteLimits(limits)),
+		[]byte{statute.VersionSocks5, 2, statute.MethodNoAuth, statute.MethodUserPassAuth})
+	require.True(t, errors.Is(err, ErrRequestParse))
+	require.True(t, errors.Is(err, statute.ErrTooManyMethods))
+	err = serve(NewServer(WithStatuteLimits(limits), WithCredential(StaticCredentials{"foo": "bar"})), []byte{
+		statute.VersionSocks5, 1, statute.MethodUserPassAuth,
+		statute.UserPassAuthVersion, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r',
+	})
+	require.True(t, errors.Is(err, ErrAuthFailed))
+	require.True(t, errors.Is(err, statute.ErrUsernameTooLong))
+
+	// rejected
+	err = serve(NewServer(WithPreHandshakeHook(func(net.Conn) error { return errors.New("banned") })), nil)
+	require.True(t, errors.Is(err, ErrConnRejected))
+	require.True(t, IsClientError(err))
+
+	// the destination refused
+	err = serve(NewServer(), []byte{
+		statute.VersionSocks5, 1, statute.MethodNoAuth,
+		statute.VersionSocks5, statute.CommandConnect, 0, statute.ATYPIPv4, 127, 0, 0, 1, 0, 1,
+	})
+	require.True(t, errors.Is(err, ErrHandleRequest))
+	require.False(t, IsClientError(err))
+	var connErr *ConnError
+	require.True(t, errors.As(err, &connErr))
+	require.Equal(t, ErrHandleRequest, connErr.Kind)
+	require.Contains(t, err.Error(), "connect to")
+}
+
+// selfSignedTLSConfig returns a tls config with a self-signed certificate of 127.0.0.1
+func selfSignedTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+}
+
+type tlsDialer struct {
+	cfg *tls.Config
+}
+
+func (sf tlsDialer) Dial(network, addr string) (net.Conn, error) {
+	return tls.Dial(network, addr, sf.cfg)
+}
+
+func TestServer_MalformedRequest(t *testing.T) {
+	type malformed struct {
+		remote string
+		raw    []byte
+	}
+	request := []byte{
+		statute.VersionSocks5, 1, statute.MethodNoAuth,
+		statute.VersionSocks5, statute.CommandConnect, 0, 0x02, 1, 2, 3,
+	}
+	serve := func(opts ...Option) (malformed, []byte) {
+		hooked := make(chan malformed, 1)
+		srv := NewServer(append(opts, WithMalformedRequestHook(func(remote string, raw []byte) {
+			hooked <- malformed{remote, append([]byte(nil), raw...)}
+		}))...)
+		client, server := net.Pipe()
+		defer client.Close()
+		go srv.ServeConn(server) // nolint: errcheck
+
+		_, err := client.Write(request)
+		require.NoError(t, err)
+		client.SetDeadline(time.Now().Add(time.Second)) // nolint: errcheck
+		rsp, _ := ioutil.ReadAll(client)
+		return <-hooked, rsp
+	}
+
+	m, rsp := serve()
+	require.Equal(t, "pipe", m.remote)
+	require.Equal(t, request[3:], m.raw)
+	require.Equal(t, []byte{statute.VersionSocks5, statute.MethodNoAuth}, rsp[:2])
+	require.Equal(t, statute.RepAddrTypeNotSupported, rsp[3])
+
+	// custom reply code
+	_, rsp = serve(WithAddrTypeNotSupportedReply(statute.RepServerFailure, false))
+	require.Equal(t, statute.RepServerFailure, rsp[3])
+
+	// silent drop
+	_, rsp = serve(WithAddrTypeNotSupportedReply(0, true))
+	require.Equal(t, []byte{statute.VersionSocks5, statute.MethodNoAuth}, rsp)
+}
+
+func TestServer_ListenAndServeTLS(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn) // nolint: errcheck
+	}()
+
+	// pick a free port
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srvAddr := ln.Addr().String()
+	ln.Close()
+
+	srv := NewServer(WithCredential(StaticCredentials{"foo": "bar"}))
+	go srv.ListenAndServeTLS("tcp", srvAddr, selfSignedTLSConfig(t)) // nolint: errcheck
+	defer srv.Close()
+
+	dial, err := proxy.SOCKS5("tcp", srvAddr, &proxy.Auth{User: "foo", Password: "bar"},
+		tlsDialer{&tls.Config{InsecureSkipVerify: true}}) // nolint: gosec
+	require.NoError(t, err)
+	var conn net.Conn
+	require.Eventually(t, func() bool {
+		conn, err = dial.Dial("tcp", l.Addr().String())
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	out := make([]byte, 4)
+	_, err = io.ReadFull(conn, out)
+	require.NoError(t, err)
+	require.Equal(t, []byte("ping"), out)
+}
+
+// limitPool is a goroutine pool with fixed workers, Submit fails when saturated
+type limitPool chan struct{}
+
+func (sf limitPool) Submit(f func()) error {
+	select {
+	case sf <- struct{}{}:
+		go func() {
+			defer func() { <-sf }()
+			f()
+		}()
+		return nil
+	default:
+		return errors.New("pool saturated")
+	}
+}
+
+func TestServer_PoolRejectPolicy(t *testing.T) {
+	serve := func(policy PoolRejectPolicy) (string, func()) {
+		srv := NewServer(WithGPool(make(limitPool, 1)), WithPoolRejectPolicy(policy))
+		srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		go srv.Serve(srvLn) // nolint: errcheck
+		return srvLn.Addr().String(), func() { srv.Close() }
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		addr, stop := serve(PoolReject)
+		defer stop()
+
+		// occupies the only worker
+		first, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer first.Close()
+		time.Sleep(50 * time.Millisecond)
+
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second)) // nolint: errcheck
+		// closed without any reply
+		out, err := ioutil.ReadAll(conn)
+		require.NoError(t, err)
+		require.Empty(t, out)
+	})
+
+	t.Run("block", func(t *testing.T) {
+		addr, stop := serve(PoolBlock)
+		defer stop()
+
+		first, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		time.Sleep(50 * time.Millisecond)
+
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte{statute.VersionSocks5, 1, statute.MethodNoAuth})
+		require.NoError(t, err)
+		out := make([]byte, 2)
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond)) // nolint: errcheck
+		_, err = io.ReadFull(conn, out)
+		require.Error(t, err)
+
+		// served once the worker frees
+		first.Close()
+		conn.SetReadDeadline(time.Now().Add(time.Second)) // nolint: errcheck
+		_, err = io.ReadFull(conn, out)
+		require.NoError(t, err)
+		require.Equal(t, []byte{statute.VersionSocks5, statute.MethodNoAuth}, out)
+	})
+}
+
+func TestServer_GlobalRateLimit(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn) // nolint: errcheck
+	}()
+
+	srv := NewServer(WithGlobalRateLimit(1<<20, 16*1024))
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	dial, err := proxy.SOCKS5("tcp", srvLn.Addr().String(), nil, proxy.Direct)
+	require.NoError(t, err)
+	conn, err := dial.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// 512k relayed in both directions combined at 1m/s
+	payload := bytes.Repeat([]byte{'x'}, 256*1024)
+	start := time.Now()
+	go conn.Write(payload) // nolint: errcheck
+	_, err = io.ReadFull(conn, make([]byte, len(payload)))
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(400*time.Millisecond))
+}
+
+func TestServer_RelayReadTimeout(t *testing.T) {
+	// Create a local listener, the target never sends
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(ioutil.Discard, conn) // nolint: errcheck
+	}()
+
+	srv := NewServer(WithRelayReadTimeout(100 * time.Millisecond))
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	dial, err := proxy.SOCKS5("tcp", srvLn.Addr().String(), nil, proxy.Direct)
+	require.NoError(t, err)
+	conn, err := dial.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// the read from the target exceeds the deadline, the session is torn down
+	conn.SetDeadline(time.Now().Add(time.Second)) // nolint: errcheck
+	_, err = conn.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+}
+
+func TestServer_HalfClose(t *testing.T) {
+	// the target replies once the request is finished by FIN
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if b, err := ioutil.ReadAll(conn); err == nil && string(b) == "request" {
+					conn.Write([]byte("response")) // nolint: errcheck
+				}
+			}()
+		}
+	}()
+
+	// the splice relay and the buffered relay
+	for _, opts := range [][]Option{nil, {WithConnIdleTimeout(time.Second)}} {
+		srv := NewServer(opts...)
+		srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		go srv.Serve(srvLn) // nolint: errcheck
+
+		dial, err := proxy.SOCKS5("tcp", srvLn.Addr().String(), nil, proxy.Direct)
+		require.NoError(t, err)
+		conn, err := dial.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		_, err = conn.Write([]byte("request"))
+		require.NoError(t, err)
+		require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+
+		conn.SetDeadline(time.Now().Add(time.Second)) // nolint: errcheck
+		b, err := ioutil.ReadAll(conn)
+		require.NoError(t, err)
+		require.Equal(t, "response", string(b))
+		conn.Close()
+		srv.Close()
+	}
+}
+
+func TestServer_ReplyDelay(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn) // nolint: errcheck
+	}()
+
+	var delays int32
+	srv := NewServer(WithReplyDelay(func() time.Duration {
+		atomic.AddInt32(&delays, 1)
+		return 50 * time.Millisecond
+	}))
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	start := time.Now()
+	dial, err := proxy.SOCKS5("tcp", srvLn.Addr().String(), nil, proxy.Direct)
+	require.NoError(t, err)
+	conn, err := dial.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.True(t, time.Since(start) >= 100*time.Millisecond)
+
+	// the method selection reply and the request reply, the relay is not delayed
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 4))
+	require.NoError(t, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(&delays))
+}
+
+func TestServer_UnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socks5")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the unix socket destination
+	l, err := net.Listen("unix", filepath.Join(dir, "echo.sock"))
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn) // nolint: errcheck
+	}()
+
+	srv := NewServer(WithUnixDestination(func(req *Request) string {
+		if req.RawDestAddr.FQDN == "echo.sock" {
+			return filepath.Join(dir, "echo.sock")
+		}
+		return ""
+	}))
+	srvLn, err := net.Listen("unix", filepath.Join(dir, "socks5.sock"))
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	dial, err := proxy.SOCKS5("unix", srvLn.Addr().String(), nil, proxy.Direct)
+	require.NoError(t, err)
+	conn, err := dial.Dial("tcp", "echo.sock:1")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	out := make([]byte, 4)
+	_, err = io.ReadFull(conn, out)
+	require.NoError(t, err)
+	require.Equal(t, []byte("ping"), out)
+
+	// half-close over the unix sockets
+	require.NoError(t, conn.(*net.UnixConn).CloseWrite())
+	conn.SetDeadline(time.Now().Add(time.Second)) // nolint: errcheck
+	_, err = conn.Read(out)
+	require.Equal(t, io.EOF, err)
+}
+
+func TestServer_RequestMiddleware(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn) // nolint: errcheck
+			}()
+		}
+	}()
+
+	var mu sync.Mutex
+	var calls []string
+	record := func(name string) func(next HandleFunc) HandleFunc {
+		return func(next HandleFunc) HandleFunc {
+			return func(ctx context.Context, writer io.Writer, request *Request) error {
+				mu.Lock()
+				calls = append(calls, name)
+				mu.Unlock()
+				return next(ctx, writer, request)
+			}
+		}
+	}
+	srv := NewServer(
+		WithRequestMiddleware(record("outer")),
+		WithRequestMiddleware(record("inner")),
+		WithRequestMiddleware(func(next HandleFunc) HandleFunc {
+			return func(ctx context.Context, writer io.Writer, request *Request) error {
+				if request.DestAddr.Port == 1 {
+					if err := SendReply(writer, statute.RepNetworkUnreachable, nil); err != nil {
+						return err
+					}
+					return errors.New("blocked by middleware")
+				}
+				return next(ctx, writer, request)
+			}
+		}),
+	)
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	dial, err := proxy.SOCKS5("tcp", srvLn.Addr().String(), nil, proxy.Direct)
+	require.NoError(t, err)
+
+	// pass through to the built-in connect
+	conn, err := dial.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	out := make([]byte, 4)
+	_, err = io.ReadFull(conn, out)
+	require.NoError(t, err)
+	require.Equal(t, []byte("ping"), out)
+	conn.Close()
+	mu.Lock()
+	require.Equal(t, []string{"outer", "inner"}, calls)
+	mu.Unlock()
+
+	// short-circuit with its own reply
+	_, err = dial.Dial("tcp", "127.0.0.1:1")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "network unreachable")
+}
+
+func TestServer_WrapDefaultConnectHandler(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn) // nolint: errcheck
+	}()
+
+	var calls int32
+	var srv *Server
+	srv = NewServer(WithConnectHandle(func(ctx context.Context, writer io.Writer, request *Request) error {
+		atomic.AddInt32(&calls, 1)
+		return srv.DefaultConnectHandler(ctx, writer, request)
+	}))
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	dial, err := proxy.SOCKS5("tcp", srvLn.Addr().String(), nil, proxy.Direct)
+	require.NoError(t, err)
+	conn, err := dial.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	out := make([]byte, 4)
+	_, err = io.ReadFull(conn, out)
+	require.NoError(t, err)
+	require.Equal(t, []byte("ping"), out)
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestServer_ClientGoneBeforeReply(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	upstream := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		upstream <- conn
+	}()
+
+	client, server := net.Pipe()
+	go func() {
+		client.Write([]byte{statute.VersionSocks5, 1, statute.MethodNoAuth}) // nolint: errcheck
+		client.Read(make([]byte, 2))                                         // nolint: errcheck
+		req := statute.Request{
+			Version: statute.VersionSocks5,
+			Command: statute.CommandConnect,
+			DstAddr: statute.AddrSpec{IP: net.IPv4(127, 0, 0, 1), Port: l.Addr().(*net.TCPAddr).Port, AddrType: statute.ATYPIPv4},
+		}
+		client.Write(req.Bytes()) // nolint: errcheck
+		// disconnect before the reply
+		client.Close()
+	}()
+	err = NewServer().ServeConn(server)
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrClientGone))
+	require.False(t, IsClientError(err))
+
+	// the dialed upstream connection is closed
+	conn := <-upstream
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second)) // nolint: errcheck
+	_, err = conn.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+}
+
+func TestServer_OnAuth(t *testing.T) {
+	type attempt struct {
+		method uint8
+		user   string
+		ok     bool
+	}
+	var attempts []attempt
+	srv := NewServer(
+		WithCredential(StaticCredentials{"foo": "bar"}),
+		WithOnAuth(func(remote string, method uint8, user string, ok bool, err error) {
+			assert.NotEmpty(t, remote)
+			assert.Equal(t, ok, err == nil)
+			attempts = append(attempts, attempt{method, user, ok})
+		}),
+	)
+	serve := func(input []byte) {
+		client, server := net.Pipe()
+		defer client.Close()
+		go func() {
+			client.Write(input)             // nolint: errcheck
+			io.Copy(ioutil.Discard, client) // nolint: errcheck
+		}()
+		srv.ServeConn(server) // nolint: errcheck
+	}
+
+	// the wrong password
+	serve([]byte{
+		statute.VersionSocks5, 1, statute.MethodUserPassAuth,
+		statute.UserPassAuthVersion, 3, 'f', 'o', 'o', 3, 'b', 'a', 'z',
+	})
+	// no acceptable method
+	serve([]byte{statute.VersionSocks5, 1, statute.MethodNoAuth})
+	// succeeded, then the request rejected
+	serve([]byte{
+		statute.VersionSocks5, 1, statute.MethodUserPassAuth,
+		statute.UserPassAuthVersion, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r',
+		statute.VersionSocks5, 0x09, 0, statute.ATYPIPv4, 127, 0, 0, 1, 0, 80,
+	})
+	require.Equal(t, []attempt{
+		{statute.MethodUserPassAuth, "foo", false},
+		{statute.MethodNoAcceptable, "", false},
+		{statute.MethodUserPassAuth, "foo", true},
+	}, attempts)
+}
+
+func TestServer_OptimisticConnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn) // nolint: errcheck
+	}()
+
+	release := make(chan struct{})
+	srv := NewServer(
+		WithOptimisticConnect(true),
+		WithDial(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			<-release
+			return net.Dial(network, addr)
+		}),
+	)
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	// the success is replied while the dial is pending, the early bytes are relayed later
+	dial, err := proxy.SOCKS5("tcp", srvLn.Addr().String(), nil, proxy.Direct)
+	require.NoError(t, err)
+	conn, err := dial.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	close(release)
+	out := make([]byte, 4)
+	conn.SetDeadline(time.Now().Add(time.Second)) // nolint: errcheck
+	_, err = io.ReadFull(conn, out)
+	require.NoError(t, err)
+	require.Equal(t, []byte("ping"), out)
+
+	// the failed dial closes the connection after the success reply
+	conn, err = dial.Dial("tcp", "127.0.0.1:1")
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second)) // nolint: errcheck
+	_, err = conn.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+}
+
+func TestServer_AfterListen(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	// the failed hook closes the listener
+	hookErr := errors.New("drop privileges failed")
+	srv := NewServer(WithAfterListen(func(l net.Listener) error {
+		assert.Equal(t, addr, l.Addr().String())
+		return hookErr
+	}))
+	require.Equal(t, hookErr, srv.ListenAndServe("tcp", addr))
+	l, err = net.Listen("tcp", addr)
+	require.NoError(t, err)
+	l.Close()
+
+	listened := make(chan struct{})
+	srv = NewServer(WithAfterListen(func(net.Listener) error {
+		close(listened)
+		return nil
+	}))
+	go srv.ListenAndServe("tcp", addr) // nolint: errcheck
+	defer srv.Close()
+	<-listened
+
+	require.Error(t, DropPrivileges("no-such-user.invalid"))
+}
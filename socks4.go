@@ -0,0 +1,126 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/thinkgos/go-socks5/statute"
+)
+
+// serveSocks4 is used to serve a SOCKS4/SOCKS4a connection, it reuses
+// the request handling of SOCKS5 with the replies translated to SOCKS4.
+// Note: SOCKS4 has no authentication, the USERID is only provided
+// in the AuthContext payload with key "userid".
+func (sf *Server) serveSocks4(ctx context.Context, conn net.Conn, bufConn *bufio.Reader) error {
+	req, err := statute.ParseSocks4Request(bufConn)
+	if err != nil {
+		return &ConnError{ErrRequestParse, fmt.Errorf("failed to read socks4 request, %w", sf.handshakeError(conn, err))}
+	}
+	sf.clearHandshakeDeadline(conn)
+
+	writer := &socks4ReplyWriter{conn, 1}
+	switch req.Command {
+	case statute.CommandConnect:
+	case statute.CommandBind:
+		writer.replies = 2
+	default:
+		if err := SendReply(writer, statute.RepCommandNotSupported, nil); err != nil {
+			return &ConnError{ErrRequestParse, fmt.Errorf("failed to send reply, %w", err)}
+		}
+		return &ConnError{ErrRequestParse, fmt.Errorf("unrecognized socks4 command[%d]", req.Command)}
+	}
+
+	id, _ := ConnIDFromContext(ctx)
+	request := &Request{
+		Request: statute.Request{
+			Version: statute.VersionSocks4,
+			Command: req.Command,
+			DstAddr: req.DstAddr,
+		},
+		AuthContext: &AuthContext{
+			Method:  statute.MethodNoAuth,
+			Payload: map[string]string{AuthKeyUserID: req.UserID},
+		},
+		LocalAddr:     conn.LocalAddr(),
+		RemoteAddr:    conn.RemoteAddr(),
+		Reader:        bufConn,
+		RequestedAddr: req.DstAddr,
+		ConnID:        id,
+		conn:          conn,
+		bufConn:       bufConn,
+	}
+	request.RawDestAddr = &request.Request.DstAddr
+	enterPhase(ctx, &sf.stats.connecting)
+	if err := sf.handleRequest(ctx, writer, request); err != nil {
+		return &ConnError{ErrHandleRequest, err}
+	}
+	return nil
+}
+
+// socks4Allowed reports whether the SOCKS4 client, which has no authentication, can be served,
+// that is the plain no-auth method is offered to the client. The no-auth method authenticated
+// by the connection, such as the tls client certificate, is a SOCKS5 handshake, not offered.
+func (sf *Server) socks4Allowed(remote net.Addr) bool {
+	if sf.requireAuth {
+		return false
+	}
+	cator, ok := sf.authMethods[statute.MethodNoAuth]
+	if sf.authMethodSelector != nil {
+		if selected := sf.authMethodSelector(remote); selected != nil {
+			cator, ok = nil, false
+			for _, v := range selected {
+				if v.GetCode() == statute.MethodNoAuth {
+					cator, ok = v, true
+				}
+			}
+		}
+	}
+	_, connAuth := cator.(ConnAuthenticator)
+	return ok && !connAuth
+}
+
+// socks4ReplyWriter translates the SOCKS5 replies written by the request handling
+// into SOCKS4 replies, the subsequent writes pass through.
+type socks4ReplyWriter struct {
+	io.Writer
+	replies int // number of replies remain to translate
+}
+
+// Write implement interface io.Writer
+func (sf *socks4ReplyWriter) Write(b []byte) (int, error) {
+	if sf.replies == 0 {
+		return sf.Writer.Write(b)
+	}
+	sf.replies--
+
+	rep, err := statute.ParseReply(bytes.NewReader(b))
+	if err != nil {
+		return 0, err
+	}
+	rep4 := statute.Socks4Reply{
+		Version:  statute.Socks4ReplyVersion,
+		Response: statute.Socks4Rejected,
+		BndAddr:  rep.BndAddr,
+	}
+	if rep.Response == statute.RepSuccess {
+		rep4.Response = statute.Socks4Granted
+	} else {
+		sf.replies = 0
+	}
+	if _, err = sf.Writer.Write(rep4.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// CloseWrite shuts down the writing side if the underlying writer supports.
+func (sf *socks4ReplyWriter) CloseWrite() error {
+	if cw, ok := sf.Writer.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
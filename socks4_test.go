@@ -0,0 +1,135 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thinkgos/go-socks5/statute"
+)
+
+func TestSOCKS4_Connect(t *testing.T) {
+	// Create a local listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		buf := make([]byte, 4)
+		_, err = io.ReadAtLeast(conn, buf, 4)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("ping"), buf)
+
+		conn.Write([]byte("pong")) // nolint: errcheck
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	srv := NewServer(WithSocks4Enabled(true))
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srvLn.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// socks4a with domain
+	req := statute.Socks4Request{
+		Version: statute.VersionSocks4,
+		Command: statute.CommandConnect,
+		UserID:  "foo",
+		DstAddr: statute.AddrSpec{FQDN: "localhost", Port: lAddr.Port, AddrType: statute.ATYPDomain},
+	}
+	conn.Write(append(req.Bytes(), "ping"...)) // nolint: errcheck
+
+	conn.SetDeadline(time.Now().Add(time.Second)) // nolint: errcheck
+	rep, err := statute.ParseSocks4Reply(conn)
+	require.NoError(t, err)
+	assert.Equal(t, statute.Socks4Granted, rep.Response)
+
+	out := make([]byte, 4)
+	_, err = io.ReadFull(conn, out)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("pong"), out)
+}
+
+func TestSOCKS4_Disabled(t *testing.T) {
+	srv := NewServer(WithRule(NewPermitNone()))
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srvLn.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	req := statute.Socks4Request{
+		Version: statute.VersionSocks4,
+		Command: statute.CommandConnect,
+		DstAddr: statute.AddrSpec{IP: net.IPv4(127, 0, 0, 1), Port: 80, AddrType: statute.ATYPIPv4},
+	}
+	conn.Write(req.Bytes())                       // nolint: errcheck
+	conn.SetDeadline(time.Now().Add(time.Second)) // nolint: errcheck
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+}
+
+func TestSOCKS4_CredentialsOnly(t *testing.T) {
+	srv := NewServer(WithSocks4Enabled(true), WithCredential(StaticCredentials{"foo": "bar"}))
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srvLn.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	req := statute.Socks4Request{
+		Version: statute.VersionSocks4,
+		Command: statute.CommandConnect,
+		DstAddr: statute.AddrSpec{IP: net.IPv4(127, 0, 0, 1), Port: 80, AddrType: statute.ATYPIPv4},
+		UserID:  "foo",
+	}
+	conn.Write(req.Bytes())                       // nolint: errcheck
+	conn.SetDeadline(time.Now().Add(time.Second)) // nolint: errcheck
+	rep, err := statute.ParseSocks4Reply(conn)
+	require.NoError(t, err)
+	assert.Equal(t, statute.Socks4Rejected, rep.Response)
+	// closed
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+}
+
+func TestSOCKS4_RuleFail(t *testing.T) {
+	srv := NewServer(WithSocks4Enabled(true), WithRule(NewPermitNone()))
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srvLn.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	req := statute.Socks4Request{
+		Version: statute.VersionSocks4,
+		Command: statute.CommandConnect,
+		DstAddr: statute.AddrSpec{IP: net.IPv4(127, 0, 0, 1), Port: 80, AddrType: statute.ATYPIPv4},
+	}
+	conn.Write(req.Bytes())                       // nolint: errcheck
+	conn.SetDeadline(time.Now().Add(time.Second)) // nolint: errcheck
+	rep, err := statute.ParseSocks4Reply(conn)
+	require.NoError(t, err)
+	assert.Equal(t, statute.Socks4Rejected, rep.Response)
+}
@@ -0,0 +1,252 @@
+// Package socks5test provides a harness to test the socks5 server and its custom components,
+// such as the rules, resolvers and handlers, over in-memory connections without real ports.
+package socks5test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/proxy"
+
+	"github.com/thinkgos/go-socks5"
+	"github.com/thinkgos/go-socks5/statute"
+)
+
+// Harness serves the connections of its clients by a socks5.Server,
+// over net.Pipe by New, or over a loopback listener by NewListener.
+type Harness struct {
+	// Server the server under test
+	Server *socks5.Server
+	// Auth the username and password the clients authenticate with, nil means no-auth.
+	Auth *proxy.Auth
+	// ClientAddr the client address the server sees on the in-memory connections,
+	// defaults to 127.0.0.1:50000.
+	ClientAddr net.Addr
+
+	ln      net.Listener
+	mu      sync.Mutex
+	clients []net.Conn
+	errs    []error
+	wg      sync.WaitGroup
+}
+
+// New returns a harness which serves each client by srv.ServeConn over net.Pipe
+func New(srv *socks5.Server) *Harness {
+	return &Harness{Server: srv}
+}
+
+// NewListener returns a harness which serves the clients by srv.Serve on a loopback listener,
+// needed by the commands listening on their own, such as bind and udp associate.
+func NewListener(srv *socks5.Server) (*Harness, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	h := &Harness{Server: srv, ln: ln}
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		if err := srv.Serve(ln); err != nil && err != socks5.ErrServerClosed {
+			h.addErr(err)
+		}
+	}()
+	return h, nil
+}
+
+// Addr returns the address of the loopback listener, nil for the in-memory harness.
+func (sf *Harness) Addr() net.Addr {
+	if sf.ln == nil {
+		return nil
+	}
+	return sf.ln.Addr()
+}
+
+// Conn returns a raw client connection to the server, the caller speaks the protocol on it.
+func (sf *Harness) Conn() (net.Conn, error) {
+	var conn net.Conn
+	if sf.ln != nil {
+		var err error
+		if conn, err = net.Dial("tcp", sf.ln.Addr().String()); err != nil {
+			return nil, err
+		}
+	} else {
+		client, server := net.Pipe()
+		clientAddr := sf.ClientAddr
+		if clientAddr == nil {
+			clientAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+		}
+		serverAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}
+		conn = &addrConn{client, clientAddr, serverAddr}
+		sf.wg.Add(1)
+		go func() {
+			defer sf.wg.Done()
+			if err := sf.Server.ServeConn(&addrConn{server, serverAddr, clientAddr}); err != nil {
+				sf.addErr(err)
+			}
+		}()
+	}
+	sf.mu.Lock()
+	sf.clients = append(sf.clients, conn)
+	sf.mu.Unlock()
+	return conn, nil
+}
+
+// Dialer returns a SOCKS5 client dialer which dials through the server, with Auth if any
+func (sf *Harness) Dialer() proxy.Dialer {
+	d, _ := proxy.SOCKS5("tcp", "socks5test", sf.Auth, forwardDialer{sf})
+	return d
+}
+
+// Request negotiates the method, authenticates by Auth if any and sends the request of
+// command cmd to addr, returns the reply and the client connection, which relays to the
+// destination on success. The connection is returned even the reply is a failure.
+func (sf *Harness) Request(cmd byte, addr string) (statute.Reply, net.Conn, error) {
+	dst, err := statute.ParseAddrSpec(addr)
+	if err != nil {
+		return statute.Reply{}, nil, err
+	}
+	conn, err := sf.Conn()
+	if err != nil {
+		return statute.Reply{}, nil, err
+	}
+	if err = sf.handshake(conn); err != nil {
+		conn.Close()
+		return statute.Reply{}, nil, err
+	}
+	req := statute.Request{Version: statute.VersionSocks5, Command: cmd, DstAddr: dst}
+	if _, err = conn.Write(req.Bytes()); err != nil {
+		conn.Close()
+		return statute.Reply{}, nil, err
+	}
+	rep, err := statute.ParseReply(conn)
+	if err != nil {
+		conn.Close()
+		return statute.Reply{}, nil, err
+	}
+	return rep, conn, nil
+}
+
+// handshake negotiates the method, authenticates by Auth if any
+func (sf *Harness) handshake(conn net.Conn) error {
+	method := statute.MethodNoAuth
+	if sf.Auth != nil {
+		method = statute.MethodUserPassAuth
+	}
+	if _, err := conn.Write(statute.NewMethodRequest(statute.VersionSocks5, []byte{method}).Bytes()); err != nil {
+		return err
+	}
+	reply, err := statute.ParseMethodReply(conn)
+	if err != nil {
+		return err
+	}
+	if reply.Method != method {
+		return fmt.Errorf("socks5test: method %d not accepted, server selected %d", method, reply.Method)
+	}
+	if sf.Auth == nil {
+		return nil
+	}
+	req := statute.NewUserPassRequest(statute.UserPassAuthVersion, []byte(sf.Auth.User), []byte(sf.Auth.Password))
+	if _, err = conn.Write(req.Bytes()); err != nil {
+		return err
+	}
+	rsp, err := statute.ParseUserPassReply(conn)
+	if err != nil {
+		return err
+	}
+	if rsp.Status != statute.AuthSuccess {
+		return fmt.Errorf("socks5test: %w", statute.ErrUserAuthFailed)
+	}
+	return nil
+}
+
+// Errors returns the errors the server returned serving the clients so far
+func (sf *Harness) Errors() []error {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	return append([]error(nil), sf.errs...)
+}
+
+func (sf *Harness) addErr(err error) {
+	sf.mu.Lock()
+	sf.errs = append(sf.errs, err)
+	sf.mu.Unlock()
+}
+
+// Close closes the clients and the server, waits for the connections served to finish
+func (sf *Harness) Close() error {
+	sf.mu.Lock()
+	for _, conn := range sf.clients {
+		conn.Close()
+	}
+	sf.clients = nil
+	sf.mu.Unlock()
+	err := sf.Server.Close()
+	sf.wg.Wait()
+	return err
+}
+
+// RequireReply sends the request of command cmd to addr through the harness, fails the test
+// unless the server replies rep, returns the client connection to go on with.
+func RequireReply(t testing.TB, h *Harness, cmd byte, addr string, rep uint8) net.Conn {
+	t.Helper()
+	reply, conn, err := h.Request(cmd, addr)
+	if err != nil {
+		t.Fatalf("socks5test: request %d to %s failed, %v", cmd, addr, err)
+	}
+	if reply.Response != rep {
+		conn.Close()
+		t.Fatalf("socks5test: request %d to %s replied %d, want %d", cmd, addr, reply.Response, rep)
+	}
+	return conn
+}
+
+// PipeDial returns a dial function for socks5.WithDial, whose destinations are in-memory
+// connections served by serve, such as an echo, so the relay is tested without real ports.
+func PipeDial(serve func(conn net.Conn)) socks5.DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		remote, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50001}
+		client, server := net.Pipe()
+		go serve(&addrConn{server, remote, local})
+		return &destConn{addrConn{client, local, remote}}, nil
+	}
+}
+
+// destConn is the in-memory destination connection
+type destConn struct {
+	addrConn
+}
+
+// CloseWrite closes the connection, net.Pipe can not be half closed,
+// so the destination sees EOF once the client finished sending.
+func (sf *destConn) CloseWrite() error { return sf.Close() }
+
+// forwardDialer dials the server for the SOCKS5 client dialer
+type forwardDialer struct {
+	h *Harness
+}
+
+// Dial implement interface proxy.Dialer
+func (sf forwardDialer) Dial(network, addr string) (net.Conn, error) {
+	return sf.h.Conn()
+}
+
+// DialContext implement interface proxy.ContextDialer
+func (sf forwardDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return sf.h.Conn()
+}
+
+// addrConn is the in-memory connection with the tcp addresses
+type addrConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (sf *addrConn) LocalAddr() net.Addr  { return sf.local }
+func (sf *addrConn) RemoteAddr() net.Addr { return sf.remote }
@@ -0,0 +1,83 @@
+package socks5test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+
+	"github.com/thinkgos/go-socks5"
+	"github.com/thinkgos/go-socks5/statute"
+)
+
+// echo serves the in-memory destination
+func echo(conn net.Conn) {
+	defer conn.Close()
+	io.Copy(conn, conn) // nolint: errcheck
+}
+
+func TestHarness(t *testing.T) {
+	_, deny, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+	h := New(socks5.NewServer(
+		socks5.WithCredential(socks5.StaticCredentials{"foo": "bar"}),
+		socks5.WithRule(socks5.NewCIDRRuleSet(nil, []*net.IPNet{deny})),
+		socks5.WithDial(PipeDial(echo)),
+	))
+	h.Auth = &proxy.Auth{User: "foo", Password: "bar"}
+	defer h.Close()
+
+	// the reply of the denied request
+	conn := RequireReply(t, h, statute.CommandConnect, "10.0.0.1:80", statute.RepRuleFailure)
+	conn.Close()
+
+	// relay through the dialer
+	conn, err = h.Dialer().Dial("tcp", "192.0.2.1:80")
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	out := make([]byte, 4)
+	_, err = io.ReadFull(conn, out)
+	require.NoError(t, err)
+	require.Equal(t, []byte("ping"), out)
+
+	// the wrong password
+	h.Auth = &proxy.Auth{User: "foo", Password: "baz"}
+	_, _, err = h.Request(statute.CommandConnect, "192.0.2.1:80")
+	require.Error(t, err)
+}
+
+func TestHarness_ClientAddr(t *testing.T) {
+	remotes := make(chan net.Addr, 1)
+	h := New(socks5.NewServer(socks5.WithConnectHandle(func(ctx context.Context, writer io.Writer, request *socks5.Request) error {
+		remotes <- request.RemoteAddr
+		return socks5.SendReply(writer, statute.RepHostUnreachable, nil)
+	})))
+	h.ClientAddr = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+	defer h.Close()
+
+	conn := RequireReply(t, h, statute.CommandConnect, "192.0.2.2:80", statute.RepHostUnreachable)
+	conn.Close()
+	assert.Equal(t, "192.0.2.1:1234", (<-remotes).String())
+}
+
+func TestHarness_Listener(t *testing.T) {
+	h, err := NewListener(socks5.NewServer(socks5.WithDial(PipeDial(echo))))
+	require.NoError(t, err)
+	defer h.Close()
+	require.NotNil(t, h.Addr())
+
+	conn := RequireReply(t, h, statute.CommandConnect, "192.0.2.1:80", statute.RepSuccess)
+	defer conn.Close()
+	_, err = conn.Write([]byte("pong"))
+	require.NoError(t, err)
+	out := make([]byte, 4)
+	_, err = io.ReadFull(conn, out)
+	require.NoError(t, err)
+	require.Equal(t, []byte("pong"), out)
+}
@@ -0,0 +1,110 @@
+package socks5
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// Stats is a snapshot of the server's connection counters
+type Stats struct {
+	// ActiveConns number of connections currently served
+	ActiveConns int64
+	// Authenticating number of connections in method negotiation,
+	// authentication or request parsing
+	Authenticating int64
+	// Connecting number of connections processing the request,
+	// such as name resolution, rule checking or dialing out
+	Connecting int64
+	// Relaying number of connections transferring data,
+	// the requests dispatched to user's handle are always counted here.
+	Relaying int64
+	// PeakConns the high-water mark of ActiveConns since start
+	PeakConns int64
+	// TotalConns number of connections served since start
+	TotalConns int64
+	// BytesUp and BytesDown the bytes relayed by connect and bind since start,
+	// from the client to the target and the reverse.
+	BytesUp   int64
+	BytesDown int64
+	// PooledConns number of connections served by the goroutine pool since start,
+	// FallbackConns the ones served by a new goroutine as the pool rejected them under
+	// PoolFallback, a rising FallbackConns tells the pool is undersized.
+	// Both are zero without the pool.
+	PooledConns   int64
+	FallbackConns int64
+}
+
+// connStats server's connection counters, accessed atomically
+type connStats struct {
+	active         int64
+	authenticating int64
+	connecting     int64
+	relaying       int64
+	peak           int64
+	total          int64
+	bytesUp        int64
+	bytesDown      int64
+	pooled         int64
+	fallback       int64
+}
+
+// open counts the connection served, and raises the peak if the active count exceeds it
+func (sf *connStats) open() {
+	n := atomic.AddInt64(&sf.active, 1)
+	atomic.AddInt64(&sf.total, 1)
+	for {
+		peak := atomic.LoadInt64(&sf.peak)
+		if n <= peak || atomic.CompareAndSwapInt64(&sf.peak, peak, n) {
+			return
+		}
+	}
+}
+
+// ActiveConns returns the number of connections currently served
+func (sf *Server) ActiveConns() int64 {
+	return atomic.LoadInt64(&sf.stats.active)
+}
+
+// Stats returns a snapshot of the server's connection counters
+func (sf *Server) Stats() Stats {
+	return Stats{
+		ActiveConns:    atomic.LoadInt64(&sf.stats.active),
+		Authenticating: atomic.LoadInt64(&sf.stats.authenticating),
+		Connecting:     atomic.LoadInt64(&sf.stats.connecting),
+		Relaying:       atomic.LoadInt64(&sf.stats.relaying),
+		PeakConns:      atomic.LoadInt64(&sf.stats.peak),
+		TotalConns:     atomic.LoadInt64(&sf.stats.total),
+		BytesUp:        atomic.LoadInt64(&sf.stats.bytesUp),
+		BytesDown:      atomic.LoadInt64(&sf.stats.bytesDown),
+		PooledConns:    atomic.LoadInt64(&sf.stats.pooled),
+		FallbackConns:  atomic.LoadInt64(&sf.stats.fallback),
+	}
+}
+
+// connPhase tracks which phase gauge a connection is counted in
+type connPhase struct {
+	counter *int64
+}
+
+type phaseCtxKey struct{}
+
+// enter moves the connection from the current phase gauge to counter,
+// a nil counter only leaves the current phase.
+func (sf *connPhase) enter(counter *int64) {
+	if sf == nil {
+		return
+	}
+	if sf.counter != nil {
+		atomic.AddInt64(sf.counter, -1)
+	}
+	sf.counter = counter
+	if counter != nil {
+		atomic.AddInt64(counter, 1)
+	}
+}
+
+// enterPhase moves the connection which the ctx belongs to into the phase counter
+func enterPhase(ctx context.Context, counter *int64) {
+	phase, _ := ctx.Value(phaseCtxKey{}).(*connPhase)
+	phase.enter(counter)
+}
@@ -0,0 +1,79 @@
+package socks5
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+)
+
+func TestServer_Stats(t *testing.T) {
+	// Create a local listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+		io.Copy(ioutil.Discard, conn) // nolint: errcheck
+	}()
+
+	srv := NewServer()
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	assert.Equal(t, Stats{}, srv.Stats())
+
+	// client
+	dial, err := proxy.SOCKS5("tcp", srvLn.Addr().String(), nil, proxy.Direct)
+	require.NoError(t, err)
+	conn, err := dial.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return srv.Stats() == Stats{ActiveConns: 1, Relaying: 1, PeakConns: 1, TotalConns: 1}
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(1), srv.ActiveConns())
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	conn.Close()
+	// the peak and the totals are kept
+	require.Eventually(t, func() bool {
+		return srv.Stats() == Stats{PeakConns: 1, TotalConns: 1, BytesUp: 4}
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestServer_Stats_Pool(t *testing.T) {
+	srv := NewServer(WithGPool(make(limitPool, 1)))
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	// occupies the only worker
+	first, err := net.Dial("tcp", srvLn.Addr().String())
+	require.NoError(t, err)
+	defer first.Close()
+	require.Eventually(t, func() bool {
+		return srv.Stats().PooledConns == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// the saturated pool falls back to a new goroutine
+	conn, err := net.Dial("tcp", srvLn.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Eventually(t, func() bool {
+		stats := srv.Stats()
+		return stats.PooledConns == 1 && stats.FallbackConns == 1
+	}, time.Second, 10*time.Millisecond)
+}
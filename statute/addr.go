@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"strings"
 )
 
 // AddrSpec is used to return the target AddrSpec
@@ -11,6 +12,9 @@ import (
 type AddrSpec struct {
 	FQDN string
 	IP   net.IP
+	// Zone the IPv6 scoped addressing zone, such as "eth0" of fe80::1%eth0,
+	// which is not carried on the wire.
+	Zone string
 	Port int
 	// private stuff set when Request parsed
 	AddrType byte
@@ -20,7 +24,7 @@ type AddrSpec struct {
 // address, fallback to FQDN
 func (sf *AddrSpec) String() string {
 	if len(sf.IP) != 0 {
-		return net.JoinHostPort(sf.IP.String(), strconv.Itoa(sf.Port))
+		return net.JoinHostPort(sf.ipString(), strconv.Itoa(sf.Port))
 	}
 	return net.JoinHostPort(sf.FQDN, strconv.Itoa(sf.Port))
 }
@@ -31,9 +35,44 @@ func (sf *AddrSpec) String() string {
 // Note: do not used to dial, Please use String
 func (sf AddrSpec) Address() string {
 	if sf.FQDN != "" {
-		return fmt.Sprintf("%s (%s):%d", sf.FQDN, sf.IP, sf.Port)
+		return fmt.Sprintf("%s (%s):%d", sf.FQDN, sf.ipString(), sf.Port)
 	}
-	return fmt.Sprintf("%s:%d", sf.IP, sf.Port)
+	return fmt.Sprintf("%s:%d", sf.ipString(), sf.Port)
+}
+
+// ipString returns the ip with the zone if any
+func (sf *AddrSpec) ipString() string {
+	if sf.Zone != "" {
+		return sf.IP.String() + "%" + sf.Zone
+	}
+	return sf.IP.String()
+}
+
+// NormalizeIPv4Mapped converts the IPv4-mapped IPv6 address such as ::ffff:1.2.3.4
+// to its IPv4 form, so the IPv4 rules and the address family selection treat it as IPv4.
+func (sf *AddrSpec) NormalizeIPv4Mapped() {
+	if sf.Zone != "" {
+		return
+	}
+	if ip4 := sf.IP.To4(); ip4 != nil {
+		sf.IP = ip4
+		if sf.AddrType == ATYPIPv6 {
+			sf.AddrType = ATYPIPv4
+		}
+	}
+}
+
+// ParseIPZone parse the ip literal with an optional IPv6 zone, such as "fe80::1%eth0",
+// returns nil ip if s is not an ip literal.
+func ParseIPZone(s string) (ip net.IP, zone string) {
+	if i := strings.LastIndexByte(s, '%'); i > 0 {
+		s, zone = s[:i], s[i+1:]
+	}
+	ip = net.ParseIP(s)
+	if ip == nil || (zone != "" && ip.To4() != nil) {
+		return nil, ""
+	}
+	return ip, zone
 }
 
 // ParseAddrSpec parse addr(host:port) to the AddrSpec address
@@ -49,11 +88,11 @@ func ParseAddrSpec(addr string) (as AddrSpec, err error) {
 		return
 	}
 
-	ip := net.ParseIP(host)
+	ip, zone := ParseIPZone(host)
 	if ip4 := ip.To4(); ip4 != nil {
 		as.AddrType, as.IP = ATYPIPv4, ip
 	} else if ip6 := ip.To16(); ip6 != nil {
-		as.AddrType, as.IP = ATYPIPv6, ip
+		as.AddrType, as.IP, as.Zone = ATYPIPv6, ip, zone
 	} else {
 		as.AddrType, as.FQDN = ATYPDomain, host
 	}
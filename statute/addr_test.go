@@ -29,6 +29,35 @@ func TestAddrSpecAddr(t *testing.T) {
 		Port: 8080,
 	}
 	assert.Equal(t, "localhost:8080", addr3.String())
+
+	addr4 := AddrSpec{
+		IP:   net.ParseIP("fe80::1"),
+		Zone: "eth0",
+		Port: 8080,
+	}
+	assert.Equal(t, "[fe80::1%eth0]:8080", addr4.String())
+	assert.Equal(t, "fe80::1%eth0:8080", addr4.Address())
+
+	// round-trip
+	addr5, err := ParseAddrSpec(addr4.String())
+	assert.NoError(t, err)
+	assert.Equal(t, addr4.String(), addr5.String())
+}
+
+func TestParseIPZone(t *testing.T) {
+	ip, zone := ParseIPZone("fe80::1%eth0")
+	assert.Equal(t, net.ParseIP("fe80::1"), ip)
+	assert.Equal(t, "eth0", zone)
+
+	ip, zone = ParseIPZone("127.0.0.1")
+	assert.Equal(t, net.IPv4(127, 0, 0, 1), ip)
+	assert.Empty(t, zone)
+
+	// the zone of IPv4 is invalid
+	ip, _ = ParseIPZone("127.0.0.1%eth0")
+	assert.Nil(t, ip)
+	ip, _ = ParseIPZone("localhost")
+	assert.Nil(t, ip)
 }
 
 func TestParseAddrSpec(t *testing.T) {
@@ -58,6 +87,17 @@ func TestParseAddrSpec(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"IPv6 zone",
+			"[fe80::1%eth0]:8080",
+			AddrSpec{
+				IP:       net.ParseIP("fe80::1"),
+				Zone:     "eth0",
+				Port:     8080,
+				AddrType: ATYPIPv6,
+			},
+			false,
+		},
 		{
 			"FQDN",
 			"localhost:8080",
@@ -94,3 +134,15 @@ func TestParseAddrSpec(t *testing.T) {
 		})
 	}
 }
+
+func TestAddrSpec_NormalizeIPv4Mapped(t *testing.T) {
+	addr := AddrSpec{IP: net.ParseIP("::ffff:1.2.3.4"), Port: 80, AddrType: ATYPIPv6}
+	addr.NormalizeIPv4Mapped()
+	assert.Equal(t, net.IP{1, 2, 3, 4}, addr.IP)
+	assert.Equal(t, ATYPIPv4, addr.AddrType)
+
+	addr = AddrSpec{IP: net.ParseIP("2001:db8::1"), Port: 80, AddrType: ATYPIPv6}
+	addr.NormalizeIPv4Mapped()
+	assert.Equal(t, net.ParseIP("2001:db8::1"), addr.IP)
+	assert.Equal(t, ATYPIPv6, addr.AddrType)
+}
@@ -39,35 +39,51 @@ func NewUserPassRequest(ver byte, user, pass []byte) UserPassRequest {
 
 // ParseUserPassRequest parse user's password request.
 func ParseUserPassRequest(r io.Reader) (nup UserPassRequest, err error) {
+	return ParseUserPassRequestLimit(r, 0, 0)
+}
+
+// ParseUserPassRequestLimit parse user's password request like ParseUserPassRequest,
+// the username longer than maxUserLen or the password longer than maxPassLen is rejected
+// with ErrUsernameTooLong or ErrPasswordTooLong before it is read, <= 0 means the protocol maximum 255.
+func ParseUserPassRequestLimit(r io.Reader, maxUserLen, maxPassLen int) (nup UserPassRequest, err error) {
 	tmp := []byte{0, 0}
 
 	// Get the version and username length
-	if _, err = io.ReadAtLeast(r, tmp, 2); err != nil {
+	if err = readFull(r, tmp, "user/pass version and username length"); err != nil {
 		return
 	}
 	nup.Ver, nup.Ulen = tmp[0], tmp[1]
 
 	// Ensure the UserPass version
 	if nup.Ver != UserPassAuthVersion {
-		err = fmt.Errorf("unsupported auth version: %v", nup.Ver)
+		err = fmt.Errorf("%w, unsupported auth version[%d]", ErrNotSupportVersion, nup.Ver)
+		return
+	}
+
+	if maxUserLen > 0 && int(nup.Ulen) > maxUserLen {
+		err = fmt.Errorf("%w, %d bytes exceeds %d", ErrUsernameTooLong, nup.Ulen, maxUserLen)
 		return
 	}
 
 	// Get the user name
 	nup.User = make([]byte, nup.Ulen)
-	if _, err = io.ReadAtLeast(r, nup.User, int(nup.Ulen)); err != nil {
+	if err = readFull(r, nup.User, "username"); err != nil {
 		return
 	}
 
 	// Get the password length
-	if _, err = r.Read(tmp[:1]); err != nil {
+	if err = readFull(r, tmp[:1], "password length"); err != nil {
 		return
 	}
 	nup.Plen = tmp[0]
+	if maxPassLen > 0 && int(nup.Plen) > maxPassLen {
+		err = fmt.Errorf("%w, %d bytes exceeds %d", ErrPasswordTooLong, nup.Plen, maxPassLen)
+		return
+	}
 
 	// Get the password
 	nup.Pass = make([]byte, nup.Plen)
-	_, err = io.ReadAtLeast(r, nup.Pass, int(nup.Plen))
+	err = readFull(r, nup.Pass, "password")
 	return nup, err
 }
 
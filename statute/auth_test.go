@@ -2,6 +2,7 @@ package statute
 
 import (
 	"bytes"
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -19,6 +20,17 @@ func TestUserPassRequest(t *testing.T) {
 	assert.Equal(t, userpass, upr)
 }
 
+func TestParseUserPassRequestLimit(t *testing.T) {
+	b := []byte{UserPassAuthVersion, 4, 'u', 's', 'e', 'r', 8, 'p', 'a', 's', 's', 'w', 'o', 'r', 'd'}
+
+	_, err := ParseUserPassRequestLimit(bytes.NewReader(b), 4, 8)
+	require.NoError(t, err)
+	_, err = ParseUserPassRequestLimit(bytes.NewReader(b), 3, 8)
+	require.True(t, errors.Is(err, ErrUsernameTooLong))
+	_, err = ParseUserPassRequestLimit(bytes.NewReader(b), 4, 7)
+	require.True(t, errors.Is(err, ErrPasswordTooLong))
+}
+
 func TestUserPassReply(t *testing.T) {
 	reader := bytes.NewReader([]byte{UserPassAuthVersion, AuthSuccess})
 
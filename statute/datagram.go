@@ -39,7 +39,7 @@ func NewDatagram(destAddr string, data []byte) (p Datagram, err error) {
 // ParseDatagram parse to datagram from bytes
 func ParseDatagram(b []byte) (da Datagram, err error) {
 	if len(b) < 4+net.IPv4len+2 { // no enough data
-		err = errors.New("datagram to short")
+		err = fmt.Errorf("%w of datagram, %d bytes", ErrShortRead, len(b))
 		return
 	}
 	// ignore RSV
@@ -55,23 +55,24 @@ func ParseDatagram(b []byte) (da Datagram, err error) {
 	case ATYPIPv6:
 		headLen += net.IPv6len + 2
 		if len(b) <= headLen {
-			err = errors.New("datagram to short")
+			err = fmt.Errorf("%w of datagram, %d bytes", ErrShortRead, len(b))
 			return
 		}
 
 		da.DstAddr.IP = b[4 : 4+net.IPv6len]
 		da.DstAddr.Port = int(binary.BigEndian.Uint16(b[headLen-2:]))
+		da.DstAddr.NormalizeIPv4Mapped()
 	case ATYPDomain:
 		addrLen := int(b[4])
 		headLen += 1 + addrLen + 2
 		if len(b) <= headLen {
-			err = errors.New("datagram to short")
+			err = fmt.Errorf("%w of datagram, %d bytes", ErrShortRead, len(b))
 			return
 		}
 		da.DstAddr.FQDN = string(b[5 : 5+addrLen])
 		da.DstAddr.Port = int(binary.BigEndian.Uint16(b[5+addrLen:]))
 	default:
-		err = ErrUnrecognizedAddrType
+		err = fmt.Errorf("%w[%d]", ErrUnrecognizedAddrType, da.DstAddr.AddrType)
 		return
 	}
 	da.Data = b[headLen:]
@@ -0,0 +1,92 @@
+//go:build go1.18
+// +build go1.18
+
+package statute
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// mustBeTyped fails if the err is none of the typed errors
+func mustBeTyped(t *testing.T, err error, typed ...error) {
+	for _, e := range typed {
+		if errors.Is(err, e) {
+			return
+		}
+	}
+	t.Fatalf("untyped error %v", err)
+}
+
+func FuzzParseMethodRequest(f *testing.F) {
+	f.Add([]byte{VersionSocks5, 2, MethodNoAuth, MethodUserPassAuth}, 1)
+	f.Add([]byte{VersionSocks5, 0}, 0)
+	f.Fuzz(func(t *testing.T, b []byte, maxMethods int) {
+		mr, err := ParseMethodRequestLimit(bytes.NewReader(b), maxMethods)
+		if err != nil {
+			mustBeTyped(t, err, ErrShortRead, ErrTooManyMethods)
+			return
+		}
+		if maxMethods > 0 && len(mr.Methods) > maxMethods {
+			t.Fatalf("%d methods exceeds the limit %d", len(mr.Methods), maxMethods)
+		}
+		if !bytes.Equal(mr.Bytes(), b[:2+len(mr.Methods)]) {
+			t.Fatalf("round trip %v, want %v", mr.Bytes(), b)
+		}
+	})
+}
+
+func FuzzParseUserPassRequest(f *testing.F) {
+	f.Add([]byte{UserPassAuthVersion, 4, 'u', 's', 'e', 'r', 8, 'p', 'a', 's', 's', 'w', 'o', 'r', 'd'}, 4, 4)
+	f.Add([]byte{UserPassAuthVersion, 0, 0}, 0, 0)
+	f.Fuzz(func(t *testing.T, b []byte, maxUserLen, maxPassLen int) {
+		nup, err := ParseUserPassRequestLimit(bytes.NewReader(b), maxUserLen, maxPassLen)
+		if err != nil {
+			mustBeTyped(t, err, ErrShortRead, ErrUsernameTooLong, ErrPasswordTooLong, ErrNotSupportVersion)
+			return
+		}
+		if maxUserLen > 0 && len(nup.User) > maxUserLen {
+			t.Fatalf("username %d bytes exceeds the limit %d", len(nup.User), maxUserLen)
+		}
+		if maxPassLen > 0 && len(nup.Pass) > maxPassLen {
+			t.Fatalf("password %d bytes exceeds the limit %d", len(nup.Pass), maxPassLen)
+		}
+		if !bytes.Equal(nup.Bytes(), b[:3+len(nup.User)+len(nup.Pass)]) {
+			t.Fatalf("round trip %v, want %v", nup.Bytes(), b)
+		}
+	})
+}
+
+func FuzzParseRequest(f *testing.F) {
+	f.Add([]byte{VersionSocks5, CommandConnect, 0, ATYPIPv4, 127, 0, 0, 1, 0x1f, 0x90}, 0)
+	f.Add([]byte{VersionSocks5, CommandConnect, 0, ATYPDomain, 9, 'l', 'o', 'c', 'a', 'l', 'h', 'o', 's', 't', 0x1f, 0x90}, 8)
+	f.Add([]byte{VersionSocks5, CommandConnect, 0, ATYPIPv6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1f, 0x90}, 0)
+	f.Fuzz(func(t *testing.T, b []byte, maxDomainLen int) {
+		req, err := ParseRequestLimit(bytes.NewReader(b), maxDomainLen)
+		if err != nil {
+			if errors.Is(err, ErrDomainTooLong) && maxDomainLen <= 0 {
+				t.Fatalf("unexpected %v without limit", err)
+			}
+			mustBeTyped(t, err, ErrShortRead, ErrNotSupportVersion, ErrInvalidCommand, ErrUnrecognizedAddrType, ErrDomainTooLong)
+			return
+		}
+		if maxDomainLen > 0 && len(req.DstAddr.FQDN) > maxDomainLen {
+			t.Fatalf("domain %d bytes exceeds the limit %d", len(req.DstAddr.FQDN), maxDomainLen)
+		}
+		req.Bytes()
+	})
+}
+
+func FuzzParseDatagram(f *testing.F) {
+	f.Add([]byte{0, 0, 0, ATYPIPv4, 127, 0, 0, 1, 0x1f, 0x90, 'p', 'i', 'n', 'g'})
+	f.Add([]byte{0, 0, 0, ATYPDomain, 9, 'l', 'o', 'c', 'a', 'l', 'h', 'o', 's', 't', 0x1f, 0x90, 'p'})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		da, err := ParseDatagram(b)
+		if err != nil {
+			mustBeTyped(t, err, ErrShortRead, ErrUnrecognizedAddrType)
+			return
+		}
+		da.Bytes()
+	})
+}
@@ -0,0 +1,64 @@
+package statute
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// GSSAPIMessage is the GSS-API negotiation and encapsulation message packet,
+// see rfc1961
+// The GSS-API message is formed as follows:
+// 	+------+------+------+.......................+
+// 	+ ver  | mtyp | len  |       token           |
+// 	+------+------+------+.......................+
+// 	+ 0x01 | 0x01 | 0x02 | up to 2^16 - 1 octets |
+// 	+------+------+------+.......................+
+// Note: the abort message only has the ver and mtyp field.
+type GSSAPIMessage struct {
+	Ver   byte
+	MTyp  byte
+	Token []byte
+}
+
+// NewGSSAPIMessage new GSS-API message with message type and token
+func NewGSSAPIMessage(mtyp byte, token []byte) (GSSAPIMessage, error) {
+	if len(token) > math.MaxUint16 {
+		return GSSAPIMessage{}, fmt.Errorf("gssapi token too long: %d", len(token))
+	}
+	return GSSAPIMessage{GSSAPIVersion, mtyp, token}, nil
+}
+
+// ParseGSSAPIMessage parse GSS-API message.
+func ParseGSSAPIMessage(r io.Reader) (msg GSSAPIMessage, err error) {
+	tmp := []byte{0, 0}
+	if _, err = io.ReadFull(r, tmp); err != nil {
+		return
+	}
+	msg.Ver, msg.MTyp = tmp[0], tmp[1]
+	if msg.Ver != GSSAPIVersion {
+		err = fmt.Errorf("unsupported gssapi version: %v", msg.Ver)
+		return
+	}
+	if msg.MTyp == GSSAPITypeAbort {
+		return
+	}
+	if _, err = io.ReadFull(r, tmp); err != nil {
+		return
+	}
+	msg.Token = make([]byte, binary.BigEndian.Uint16(tmp))
+	_, err = io.ReadFull(r, msg.Token)
+	return
+}
+
+// Bytes GSS-API message to bytes
+func (sf GSSAPIMessage) Bytes() []byte {
+	if sf.MTyp == GSSAPITypeAbort {
+		return []byte{sf.Ver, sf.MTyp}
+	}
+	b := make([]byte, 0, 4+len(sf.Token))
+	b = append(b, sf.Ver, sf.MTyp, byte(len(sf.Token)>>8), byte(len(sf.Token)))
+	b = append(b, sf.Token...)
+	return b
+}
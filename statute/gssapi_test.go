@@ -0,0 +1,36 @@
+package statute
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGSSAPIMessage(t *testing.T) {
+	want := []byte{GSSAPIVersion, GSSAPITypeInit, 0, 3, 1, 2, 3}
+
+	msg, err := NewGSSAPIMessage(GSSAPITypeInit, []byte{1, 2, 3})
+	require.NoError(t, err)
+	assert.Equal(t, want, msg.Bytes())
+
+	msg1, err := ParseGSSAPIMessage(bytes.NewReader(want))
+	require.NoError(t, err)
+	assert.Equal(t, msg, msg1)
+
+	abort := []byte{GSSAPIVersion, GSSAPITypeAbort}
+	msg, err = NewGSSAPIMessage(GSSAPITypeAbort, nil)
+	require.NoError(t, err)
+	assert.Equal(t, abort, msg.Bytes())
+
+	msg1, err = ParseGSSAPIMessage(bytes.NewReader(abort))
+	require.NoError(t, err)
+	assert.Equal(t, msg, msg1)
+
+	_, err = NewGSSAPIMessage(GSSAPITypeInit, make([]byte, 65536))
+	require.Error(t, err)
+
+	_, err = ParseGSSAPIMessage(bytes.NewReader([]byte{0x02, GSSAPITypeInit, 0, 0}))
+	require.Error(t, err)
+}
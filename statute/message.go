@@ -27,50 +27,66 @@ type Request struct {
 
 // ParseRequest to request from io.Reader
 func ParseRequest(r io.Reader) (req Request, err error) {
+	return ParseRequestLimit(r, 0)
+}
+
+// ParseRequestLimit to request from io.Reader like ParseRequest, the domain name longer than
+// maxDomainLen is rejected with ErrDomainTooLong before it is read, maxDomainLen <= 0 means
+// the protocol maximum 255.
+// The malformed request is reported by the error matchable with errors.Is, ErrShortRead for
+// the truncated request, ErrNotSupportVersion, ErrUnrecognizedAddrType, and ErrInvalidCommand
+// which is returned after the whole request read, so the request is complete for the reply.
+func ParseRequestLimit(r io.Reader, maxDomainLen int) (req Request, err error) {
 	// Read the version and command
 	tmp := []byte{0, 0}
-	if _, err = io.ReadFull(r, tmp); err != nil {
-		return req, fmt.Errorf("failed to get request version and command, %v", err)
+	if err = readFull(r, tmp, "request version and command"); err != nil {
+		return req, err
 	}
 	req.Version, req.Command = tmp[0], tmp[1]
 	if req.Version != VersionSocks5 {
-		return req, fmt.Errorf("unrecognized SOCKS version[%d]", req.Version)
+		return req, fmt.Errorf("%w[%d]", ErrNotSupportVersion, req.Version)
 	}
 
 	// Read reserved and address type
-	if _, err = io.ReadFull(r, tmp); err != nil {
-		return req, fmt.Errorf("failed to get request RSV and address type, %v", err)
+	if err = readFull(r, tmp, "request RSV and address type"); err != nil {
+		return req, err
 	}
 	req.Reserved, req.DstAddr.AddrType = tmp[0], tmp[1]
 
 	switch req.DstAddr.AddrType {
 	case ATYPIPv4:
 		addr := make([]byte, net.IPv4len+2)
-		if _, err = io.ReadFull(r, addr); err != nil {
-			return req, fmt.Errorf("failed to get request, %v", err)
+		if err = readFull(r, addr, "request IPv4 address"); err != nil {
+			return req, err
 		}
 		req.DstAddr.IP = net.IPv4(addr[0], addr[1], addr[2], addr[3])
 		req.DstAddr.Port = int(binary.BigEndian.Uint16(addr[net.IPv4len:]))
 	case ATYPIPv6:
 		addr := make([]byte, net.IPv6len+2)
-		if _, err = io.ReadFull(r, addr); err != nil {
-			return req, fmt.Errorf("failed to get request, %v", err)
+		if err = readFull(r, addr, "request IPv6 address"); err != nil {
+			return req, err
 		}
 		req.DstAddr.IP = addr[:net.IPv6len]
 		req.DstAddr.Port = int(binary.BigEndian.Uint16(addr[net.IPv6len:]))
 	case ATYPDomain:
-		if _, err = io.ReadFull(r, tmp[:1]); err != nil {
-			return req, fmt.Errorf("failed to get request, %v", err)
+		if err = readFull(r, tmp[:1], "request domain length"); err != nil {
+			return req, err
 		}
 		domainLen := int(tmp[0])
+		if maxDomainLen > 0 && domainLen > maxDomainLen {
+			return req, fmt.Errorf("%w, %d bytes exceeds %d", ErrDomainTooLong, domainLen, maxDomainLen)
+		}
 		addr := make([]byte, domainLen+2)
-		if _, err = io.ReadFull(r, addr); err != nil {
-			return req, fmt.Errorf("failed to get request, %v", err)
+		if err = readFull(r, addr, "request domain"); err != nil {
+			return req, err
 		}
 		req.DstAddr.FQDN = string(addr[:domainLen])
 		req.DstAddr.Port = int(binary.BigEndian.Uint16(addr[domainLen:]))
 	default:
-		return req, ErrUnrecognizedAddrType
+		return req, fmt.Errorf("%w[%d]", ErrUnrecognizedAddrType, req.DstAddr.AddrType)
+	}
+	if req.Command != CommandConnect && req.Command != CommandBind && req.Command != CommandAssociate {
+		return req, fmt.Errorf("%w[%d]", ErrInvalidCommand, req.Command)
 	}
 	return req, nil
 }
@@ -126,10 +142,14 @@ func (sf Reply) Bytes() (b []byte) {
 	length := 6
 	if sf.BndAddr.AddrType == ATYPIPv4 {
 		length += net.IPv4len
-		addr = sf.BndAddr.IP.To4()
+		if addr = sf.BndAddr.IP.To4(); addr == nil {
+			addr = net.IPv4zero.To4()
+		}
 	} else if sf.BndAddr.AddrType == ATYPIPv6 {
 		length += net.IPv6len
-		addr = sf.BndAddr.IP.To16()
+		if addr = sf.BndAddr.IP.To16(); addr == nil {
+			addr = net.IPv6zero
+		}
 	} else { // ATYPDomain
 		length += 1 + len(sf.BndAddr.FQDN)
 		addr = []byte(sf.BndAddr.FQDN)
@@ -150,41 +170,41 @@ func ParseReply(r io.Reader) (rep Reply, err error) {
 	// Read the version and command
 	tmp := []byte{0, 0}
 	if _, err = io.ReadFull(r, tmp); err != nil {
-		return rep, fmt.Errorf("failed to get reply version and command, %v", err)
+		return rep, fmt.Errorf("failed to get reply version and command, %w", err)
 	}
 	rep.Version, rep.Response = tmp[0], tmp[1]
 	if rep.Version != VersionSocks5 {
-		return rep, fmt.Errorf("unrecognized SOCKS version[%d]", rep.Version)
+		return rep, fmt.Errorf("%w[%d]", ErrNotSupportVersion, rep.Version)
 	}
 	// Read reserved and address type
 	if _, err = io.ReadFull(r, tmp); err != nil {
-		return rep, fmt.Errorf("failed to get reply RSV and address type, %v", err)
+		return rep, fmt.Errorf("failed to get reply RSV and address type, %w", err)
 	}
 	rep.Reserved, rep.BndAddr.AddrType = tmp[0], tmp[1]
 
 	switch rep.BndAddr.AddrType {
 	case ATYPDomain:
 		if _, err = io.ReadFull(r, tmp[:1]); err != nil {
-			return rep, fmt.Errorf("failed to get reply, %v", err)
+			return rep, fmt.Errorf("failed to get reply, %w", err)
 		}
 		domainLen := int(tmp[0])
 		addr := make([]byte, domainLen+2)
 		if _, err = io.ReadFull(r, addr); err != nil {
-			return rep, fmt.Errorf("failed to get reply, %v", err)
+			return rep, fmt.Errorf("failed to get reply, %w", err)
 		}
 		rep.BndAddr.FQDN = string(addr[:domainLen])
 		rep.BndAddr.Port = int(binary.BigEndian.Uint16(addr[domainLen:]))
 	case ATYPIPv4:
 		addr := make([]byte, net.IPv4len+2)
 		if _, err = io.ReadFull(r, addr); err != nil {
-			return rep, fmt.Errorf("failed to get reply, %v", err)
+			return rep, fmt.Errorf("failed to get reply, %w", err)
 		}
 		rep.BndAddr.IP = net.IPv4(addr[0], addr[1], addr[2], addr[3])
 		rep.BndAddr.Port = int(binary.BigEndian.Uint16(addr[net.IPv4len:]))
 	case ATYPIPv6:
 		addr := make([]byte, net.IPv6len+2)
 		if _, err = io.ReadFull(r, addr); err != nil {
-			return rep, fmt.Errorf("failed to get reply, %v", err)
+			return rep, fmt.Errorf("failed to get reply, %w", err)
 		}
 		rep.BndAddr.IP = addr[:net.IPv6len]
 		rep.BndAddr.Port = int(binary.BigEndian.Uint16(addr[net.IPv6len:]))
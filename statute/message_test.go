@@ -2,6 +2,7 @@ package statute
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"net"
 	"reflect"
@@ -70,6 +71,53 @@ func TestParseRequest(t *testing.T) {
 	}
 }
 
+func TestParseRequestLimit(t *testing.T) {
+	b := []byte{VersionSocks5, CommandConnect, 0, ATYPDomain, 9, 'l', 'o', 'c', 'a', 'l', 'h', 'o', 's', 't', 0x1f, 0x90}
+
+	req, err := ParseRequestLimit(bytes.NewReader(b), 9)
+	if err != nil {
+		t.Fatalf("ParseRequestLimit() error = %v", err)
+	}
+	if req.DstAddr.FQDN != "localhost" {
+		t.Errorf("ParseRequestLimit() FQDN = %v, want localhost", req.DstAddr.FQDN)
+	}
+
+	_, err = ParseRequestLimit(bytes.NewReader(b), 8)
+	if !errors.Is(err, ErrDomainTooLong) {
+		t.Errorf("ParseRequestLimit() error = %v, want %v", err, ErrDomainTooLong)
+	}
+}
+
+func TestParseRequest_Malformed(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		want error
+	}{
+		{"empty", nil, ErrShortRead},
+		{"truncated header", []byte{VersionSocks5, CommandConnect, 0}, ErrShortRead},
+		{"truncated address", []byte{VersionSocks5, CommandConnect, 0, ATYPIPv4, 127, 0}, ErrShortRead},
+		{"truncated domain", []byte{VersionSocks5, CommandConnect, 0, ATYPDomain, 9, 'l', 'o'}, ErrShortRead},
+		{"invalid version", []byte{0x04, CommandConnect, 0, ATYPIPv4, 127, 0, 0, 1, 0, 80}, ErrNotSupportVersion},
+		{"invalid command", []byte{VersionSocks5, 0x09, 0, ATYPIPv4, 127, 0, 0, 1, 0, 80}, ErrInvalidCommand},
+		{"invalid address type", []byte{VersionSocks5, CommandConnect, 0, 0x02, 127, 0, 0, 1, 0, 80}, ErrUnrecognizedAddrType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseRequest(bytes.NewReader(tt.b))
+			if !errors.Is(err, tt.want) {
+				t.Errorf("ParseRequest() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	// the short read is still the underlying eof
+	_, err := ParseRequest(bytes.NewReader([]byte{VersionSocks5}))
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("ParseRequest() error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
 func TestRequest_Bytes(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -190,6 +238,14 @@ func TestReply_Bytes(t *testing.T) {
 			},
 			[]byte{VersionSocks5, CommandConnect, 0, ATYPDomain, 9, 'l', 'o', 'c', 'a', 'l', 'h', 'o', 's', 't', 0x1f, 0x90},
 		},
+		{
+			"SOCKS5 IPV6 without ip",
+			Reply{
+				VersionSocks5, CommandConnect, 0,
+				AddrSpec{Port: 8080, AddrType: ATYPIPv6},
+			},
+			[]byte{VersionSocks5, CommandConnect, 0, ATYPIPv6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x1f, 0x90},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
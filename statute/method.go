@@ -1,6 +1,7 @@
 package statute
 
 import (
+	"fmt"
 	"io"
 )
 
@@ -28,20 +29,28 @@ func NewMethodRequest(ver byte, medthods []byte) MethodRequest {
 
 // ParseMethodRequest parse method request.
 func ParseMethodRequest(r io.Reader) (mr MethodRequest, err error) {
-	// Read the version byte
-	tmp := []byte{0}
-	if _, err = r.Read(tmp); err != nil {
+	return ParseMethodRequestLimit(r, 0)
+}
+
+// ParseMethodRequestLimit parse method request like ParseMethodRequest, the request with
+// more than maxMethods methods is rejected with ErrTooManyMethods before they are read,
+// maxMethods <= 0 means the protocol maximum 255.
+func ParseMethodRequestLimit(r io.Reader, maxMethods int) (mr MethodRequest, err error) {
+	// Read the version and number method
+	tmp := []byte{0, 0}
+	if err = readFull(r, tmp, "method request version and number of methods"); err != nil {
 		return
 	}
 	mr.Ver = tmp[0]
 
-	// Read number method
-	if _, err = r.Read(tmp); err != nil {
+	if maxMethods > 0 && int(tmp[1]) > maxMethods {
+		mr.NMethods = tmp[1]
+		err = fmt.Errorf("%w, %d methods exceeds %d", ErrTooManyMethods, tmp[1], maxMethods)
 		return
 	}
-	mr.NMethods, mr.Methods = tmp[0], make([]byte, tmp[0])
+	mr.NMethods, mr.Methods = tmp[1], make([]byte, tmp[1])
 	// read methods
-	_, err = io.ReadAtLeast(r, mr.Methods, int(mr.NMethods))
+	err = readFull(r, mr.Methods, "methods")
 	return
 }
 
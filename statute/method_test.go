@@ -2,6 +2,7 @@ package statute
 
 import (
 	"bytes"
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -23,3 +24,11 @@ func TestMethodReply(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, MethodReply{VersionSocks5, RepSuccess}, mr)
 }
+
+func TestParseMethodRequestLimit(t *testing.T) {
+	b := []byte{VersionSocks5, 2, MethodNoAuth, MethodUserPassAuth}
+	_, err := ParseMethodRequestLimit(bytes.NewReader(b), 2)
+	require.NoError(t, err)
+	_, err = ParseMethodRequestLimit(bytes.NewReader(b), 1)
+	require.True(t, errors.Is(err, ErrTooManyMethods))
+}
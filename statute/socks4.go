@@ -0,0 +1,142 @@
+package statute
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// VersionSocks4 socks4 protocol version
+const VersionSocks4 = byte(0x04)
+
+// socks4 reply status
+const (
+	Socks4ReplyVersion     = byte(0x00)
+	Socks4Granted          = byte(90)
+	Socks4Rejected         = byte(91)
+	Socks4IdentUnreachable = byte(92)
+	Socks4IdentMismatch    = byte(93)
+)
+
+// socks4 max length of user id and domain, both are null-terminated
+const socks4MaxFieldLen = 255
+
+// Socks4Request represents the SOCKS4/SOCKS4a request
+// The SOCKS4 request is formed as follows:
+//	+----+----+---------+--------+----------+------+
+//	| VN | CD | DSTPORT |  DSTIP |  USERID  | NULL |
+//	+----+----+---------+--------+----------+------+
+//	| 1  |  1 |    2    |    4   | Variable |  1   |
+//	+----+----+---------+--------+----------+------+
+// SOCKS4a: if DSTIP is 0.0.0.x(x != 0), the domain name
+// which is null-terminated followed the USERID NULL.
+type Socks4Request struct {
+	Version byte
+	Command byte
+	UserID  string
+	DstAddr AddrSpec
+}
+
+// ParseSocks4Request parse to socks4 request from bufio.Reader
+func ParseSocks4Request(r *bufio.Reader) (req Socks4Request, err error) {
+	tmp := make([]byte, 8)
+	if _, err = io.ReadFull(r, tmp); err != nil {
+		return req, fmt.Errorf("failed to get socks4 request, %v", err)
+	}
+	req.Version, req.Command = tmp[0], tmp[1]
+	if req.Version != VersionSocks4 {
+		return req, fmt.Errorf("unrecognized SOCKS version[%d]", req.Version)
+	}
+	req.DstAddr.Port = int(binary.BigEndian.Uint16(tmp[2:]))
+	req.DstAddr.IP = net.IPv4(tmp[4], tmp[5], tmp[6], tmp[7])
+	req.DstAddr.AddrType = ATYPIPv4
+
+	if req.UserID, err = readNullString(r); err != nil {
+		return req, fmt.Errorf("failed to get socks4 user id, %v", err)
+	}
+	// socks4a
+	if tmp[4] == 0 && tmp[5] == 0 && tmp[6] == 0 && tmp[7] != 0 {
+		if req.DstAddr.FQDN, err = readNullString(r); err != nil {
+			return req, fmt.Errorf("failed to get socks4a domain, %v", err)
+		}
+		req.DstAddr.IP = nil
+		req.DstAddr.AddrType = ATYPDomain
+	}
+	return req, nil
+}
+
+// Bytes returns a slice of socks4 request
+func (h Socks4Request) Bytes() []byte {
+	ip := net.IPv4(0, 0, 0, 1).To4()
+	if h.DstAddr.FQDN == "" {
+		ip = h.DstAddr.IP.To4()
+	}
+	b := make([]byte, 0, 10+len(h.UserID)+len(h.DstAddr.FQDN))
+	b = append(b, h.Version, h.Command, byte(h.DstAddr.Port>>8), byte(h.DstAddr.Port))
+	b = append(b, ip...)
+	b = append(b, h.UserID...)
+	b = append(b, 0)
+	if h.DstAddr.FQDN != "" {
+		b = append(b, h.DstAddr.FQDN...)
+		b = append(b, 0)
+	}
+	return b
+}
+
+// Socks4Reply represents the SOCKS4 reply
+// The SOCKS4 reply is formed as follows:
+//	+----+----+---------+--------+
+//	| VN | CD | DSTPORT |  DSTIP |
+//	+----+----+---------+--------+
+//	| 1  |  1 |    2    |    4   |
+//	+----+----+---------+--------+
+type Socks4Reply struct {
+	Version  byte
+	Response byte
+	BndAddr  AddrSpec
+}
+
+// Bytes returns a slice of socks4 reply
+func (sf Socks4Reply) Bytes() []byte {
+	ip := sf.BndAddr.IP.To4()
+	if ip == nil {
+		ip = net.IPv4zero.To4()
+	}
+	b := make([]byte, 0, 8)
+	b = append(b, sf.Version, sf.Response, byte(sf.BndAddr.Port>>8), byte(sf.BndAddr.Port))
+	return append(b, ip...)
+}
+
+// ParseSocks4Reply parse to socks4 reply from io.Reader
+func ParseSocks4Reply(r io.Reader) (rep Socks4Reply, err error) {
+	tmp := make([]byte, 8)
+	if _, err = io.ReadFull(r, tmp); err != nil {
+		return rep, fmt.Errorf("failed to get socks4 reply, %v", err)
+	}
+	rep.Version, rep.Response = tmp[0], tmp[1]
+	rep.BndAddr.Port = int(binary.BigEndian.Uint16(tmp[2:]))
+	rep.BndAddr.IP = net.IPv4(tmp[4], tmp[5], tmp[6], tmp[7])
+	rep.BndAddr.AddrType = ATYPIPv4
+	return rep, nil
+}
+
+// readNullString read a null-terminated string, limit to socks4MaxFieldLen
+func readNullString(r *bufio.Reader) (string, error) {
+	b := make([]byte, 0, 16)
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if c == 0 {
+			return string(b), nil
+		}
+		if len(b) >= socks4MaxFieldLen {
+			return "", errors.New("field too long")
+		}
+		b = append(b, c)
+	}
+}
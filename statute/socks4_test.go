@@ -0,0 +1,80 @@
+package statute
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSocks4Request(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []byte
+		want    Socks4Request
+		wantErr bool
+	}{
+		{
+			"SOCKS4",
+			[]byte{VersionSocks4, CommandConnect, 0x1f, 0x90, 127, 0, 0, 1, 'f', 'o', 'o', 0},
+			Socks4Request{
+				VersionSocks4, CommandConnect, "foo",
+				AddrSpec{IP: net.IPv4(127, 0, 0, 1), Port: 8080, AddrType: ATYPIPv4},
+			},
+			false,
+		},
+		{
+			"SOCKS4a",
+			[]byte{VersionSocks4, CommandConnect, 0x1f, 0x90, 0, 0, 0, 1, 0, 'l', 'o', 'c', 'a', 'l', 'h', 'o', 's', 't', 0},
+			Socks4Request{
+				VersionSocks4, CommandConnect, "",
+				AddrSpec{FQDN: "localhost", Port: 8080, AddrType: ATYPDomain},
+			},
+			false,
+		},
+		{
+			"invalid version",
+			[]byte{VersionSocks5, CommandConnect, 0x1f, 0x90, 127, 0, 0, 1, 0},
+			Socks4Request{Version: VersionSocks5, Command: CommandConnect},
+			true,
+		},
+		{
+			"miss user id null",
+			[]byte{VersionSocks4, CommandConnect, 0x1f, 0x90, 127, 0, 0, 1, 'f', 'o', 'o'},
+			Socks4Request{},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseSocks4Request(bufio.NewReader(bytes.NewReader(tt.input)))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseSocks4Request() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil {
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("ParseSocks4Request() got = %+v, want %+v", got, tt.want)
+				}
+				assert.Equal(t, tt.input, got.Bytes())
+			}
+		})
+	}
+}
+
+func TestSocks4Reply(t *testing.T) {
+	want := []byte{Socks4ReplyVersion, Socks4Granted, 0x1f, 0x90, 127, 0, 0, 1}
+	reply := Socks4Reply{
+		Socks4ReplyVersion, Socks4Granted,
+		AddrSpec{IP: net.IPv4(127, 0, 0, 1), Port: 8080, AddrType: ATYPIPv4},
+	}
+	assert.Equal(t, want, reply.Bytes())
+
+	got, err := ParseSocks4Reply(bytes.NewReader(want))
+	require.NoError(t, err)
+	assert.Equal(t, reply, got)
+}
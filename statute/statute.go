@@ -2,6 +2,8 @@ package statute
 
 import (
 	"errors"
+	"fmt"
+	"io"
 )
 
 // VersionSocks5 socks protocol version
@@ -17,7 +19,7 @@ const (
 // method defined
 const (
 	MethodNoAuth       = byte(0x00)
-	MethodGSSAPI       = byte(0x01) // TODO: not support now
+	MethodGSSAPI       = byte(0x01)
 	MethodUserPassAuth = byte(0x02)
 	MethodNoAcceptable = byte(0xff)
 )
@@ -52,9 +54,68 @@ const (
 	AuthFailure = byte(0x01)
 )
 
+// gssapi defined, see rfc1961
+const (
+	// gssapi version
+	GSSAPIVersion = byte(0x01)
+	// gssapi message type
+	GSSAPITypeInit          = byte(0x01) // context establishment
+	GSSAPITypeProtection    = byte(0x02) // per-message protection negotiation
+	GSSAPITypeEncapsulation = byte(0x03) // encapsulated user data
+	GSSAPITypeAbort         = byte(0xff)
+	// gssapi per-message protection level
+	GSSAPIProtectionIntegrity       = byte(0x01)
+	GSSAPIProtectionConfidentiality = byte(0x02)
+	GSSAPIProtectionSelective       = byte(0x03)
+)
+
 // error defined
 var (
 	ErrUnrecognizedAddrType = errors.New("unrecognized address type")
 	ErrNotSupportVersion    = errors.New("not support version")
+	ErrInvalidCommand       = errors.New("invalid command")
+	ErrShortRead            = errors.New("short read")
 	ErrNotSupportMethod     = errors.New("not support method")
+	ErrDomainTooLong        = errors.New("domain name too long")
+	ErrHandshakeTooLarge    = errors.New("handshake too large")
+	ErrTooManyMethods       = errors.New("too many methods")
+	ErrUsernameTooLong      = errors.New("username too long")
+	ErrPasswordTooLong      = errors.New("password too long")
 )
+
+// Limits the maxima of the handshake message fields, which tighten the parsers
+// below the protocol maxima, zero means the protocol maximum 255.
+type Limits struct {
+	// MaxMethods the maximum number of methods of the method request
+	MaxMethods int
+	// MaxUsernameLen the maximum username length of the user/pass request
+	MaxUsernameLen int
+	// MaxPasswordLen the maximum password length of the user/pass request
+	MaxPasswordLen int
+	// MaxDomainLen the maximum domain name length of the request
+	MaxDomainLen int
+}
+
+// shortReadError the message truncated while reading the field, which is matchable
+// both as ErrShortRead and as the underlying io.EOF or io.ErrUnexpectedEOF.
+type shortReadError struct {
+	field string
+	err   error
+}
+
+func (e *shortReadError) Error() string { return "short read of " + e.field + ", " + e.err.Error() }
+
+func (e *shortReadError) Is(target error) bool { return target == ErrShortRead }
+
+func (e *shortReadError) Unwrap() error { return e.err }
+
+// readFull reads exactly len(b) bytes of the field, the truncated message is an ErrShortRead.
+func readFull(r io.Reader, b []byte, field string) error {
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return &shortReadError{field, err}
+		}
+		return fmt.Errorf("failed to read %s, %w", field, err)
+	}
+	return nil
+}
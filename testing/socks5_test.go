@@ -1,7 +1,10 @@
 package testing
 
 import (
+	"context"
+	"errors"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
@@ -124,3 +127,60 @@ func Test_socks5_Associate(t *testing.T) {
 	require.Equal(t, []byte("pong"), out)
 	time.Sleep(time.Second * 1)
 }
+
+func Test_Socks5_DialContext(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn) // nolint: errcheck
+	}()
+
+	srv := socks5.NewServer()
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	client := ccsocks5.NewClient(srvLn.Addr().String())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := client.DialContext(ctx, "tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	out := make([]byte, 4)
+	_, err = io.ReadFull(conn, out)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("ping"), out)
+}
+
+func Test_Socks5_DialContext_Timeout(t *testing.T) {
+	// the proxy accepts but never replies
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer silent.Close()
+	go func() {
+		conn, err := silent.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(ioutil.Discard, conn) // nolint: errcheck
+	}()
+
+	client := ccsocks5.NewClient(silent.Addr().String())
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = client.DialContext(ctx, "tcp", "127.0.0.1:80")
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+	require.Less(t, int64(time.Since(start)), int64(time.Second))
+}
@@ -0,0 +1,21 @@
+package socks5
+
+import (
+	"context"
+)
+
+// RequestTracer is used to trace the requests, see otelsocks5 for OpenTelemetry,
+// the implementation must be safe for concurrent use.
+type RequestTracer interface {
+	// StartRequest is called when the request handling starts, the context returned,
+	// which may carry the span, is passed to the rest of the request handling.
+	// The ctx carries the values set by WithConnContext, e.g. the propagated trace context.
+	StartRequest(ctx context.Context, req *Request) (context.Context, RequestSpan)
+}
+
+// RequestSpan is the span of a request started by the RequestTracer
+type RequestSpan interface {
+	// End is called when the request handling finished, replied reports whether
+	// a reply has been sent to the client with the reply code, err is the failure if any.
+	End(req *Request, replied bool, reply uint8, err error)
+}
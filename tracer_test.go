@@ -0,0 +1,85 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+
+	"github.com/thinkgos/go-socks5/statute"
+)
+
+type traceParentKey struct{}
+
+type mockSpan struct {
+	parent  interface{}
+	dest    string
+	replied bool
+	reply   uint8
+	err     error
+	ended   chan *mockSpan
+}
+
+func (sf *mockSpan) End(req *Request, replied bool, reply uint8, err error) {
+	sf.dest, sf.replied, sf.reply, sf.err = req.DestAddr.String(), replied, reply, err
+	sf.ended <- sf
+}
+
+type mockTracer chan *mockSpan
+
+func (sf mockTracer) StartRequest(ctx context.Context, req *Request) (context.Context, RequestSpan) {
+	return ctx, &mockSpan{parent: ctx.Value(traceParentKey{}), ended: sf}
+}
+
+func TestRequestTracer(t *testing.T) {
+	spans := make(mockTracer, 1)
+	srv := NewServer(
+		WithRequestTracer(spans),
+		WithConnContext(func(ctx context.Context, conn net.Conn) context.Context {
+			// the preamble carries the trace parent
+			b := make([]byte, 4)
+			if _, err := conn.Read(b); err != nil {
+				return ctx
+			}
+			return context.WithValue(ctx, traceParentKey{}, string(b))
+		}),
+	)
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	dial, err := proxy.SOCKS5("tcp", srvLn.Addr().String(), nil, preambleDialer("span"))
+	require.NoError(t, err)
+	_, err = dial.Dial("tcp", "127.0.0.1:1")
+	require.Error(t, err)
+
+	select {
+	case span := <-spans:
+		require.Equal(t, "span", span.parent)
+		require.Equal(t, "127.0.0.1:1", span.dest)
+		require.True(t, span.replied)
+		require.Equal(t, statute.RepConnectionRefused, span.reply)
+		require.Error(t, span.err)
+	case <-time.After(time.Second):
+		t.Fatal("span not ended")
+	}
+}
+
+// preambleDialer writes the preamble once connected
+type preambleDialer string
+
+func (sf preambleDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write([]byte(sf)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,119 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/proxy"
+
+	"github.com/thinkgos/go-socks5/statute"
+)
+
+// upstreamError is the failure of the upstream proxy,
+// rep is the reply sent to the client.
+type upstreamError struct {
+	rep uint8
+	err error
+}
+
+func (sf *upstreamError) Error() string {
+	return fmt.Sprintf("upstream proxy failed(reply: %d), %v", sf.rep, sf.err)
+}
+
+func (sf *upstreamError) Unwrap() error { return sf.err }
+
+// upstreamSocks5Dial returns a dial function which connects the address through the
+// upstream socks5 proxy, the connection to the upstream proxy is dialed by base.
+func upstreamSocks5Dial(proxyAddr string, auth *proxy.Auth,
+	base func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		switch network {
+		case "tcp", "tcp4", "tcp6":
+		default:
+			return nil, fmt.Errorf("upstream proxy: network %s not supported", network)
+		}
+
+		conn, err := base(ctx, "tcp", proxyAddr)
+		if err != nil {
+			return nil, err
+		}
+
+		// the handshake is interrupted when ctx is done
+		done, stopped := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(stopped)
+			select {
+			case <-ctx.Done():
+				conn.SetDeadline(time.Now()) // nolint: errcheck
+			case <-done:
+			}
+		}()
+		err = upstreamSocks5Handshake(conn, auth, addr)
+		close(done)
+		<-stopped
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{}) // nolint: errcheck
+		return conn, nil
+	}
+}
+
+// upstreamSocks5Handshake negotiate with the upstream socks5 proxy and connect to the address.
+func upstreamSocks5Handshake(conn net.Conn, auth *proxy.Auth, addr string) error {
+	method := statute.MethodNoAuth
+	if auth != nil {
+		method = statute.MethodUserPassAuth
+	}
+	if _, err := conn.Write(statute.NewMethodRequest(statute.VersionSocks5, []byte{method}).Bytes()); err != nil {
+		return err
+	}
+	mr, err := statute.ParseMethodReply(conn)
+	if err != nil {
+		return err
+	}
+	if mr.Ver != statute.VersionSocks5 {
+		return &upstreamError{statute.RepServerFailure, statute.ErrNotSupportVersion}
+	}
+	if mr.Method != method {
+		return &upstreamError{statute.RepServerFailure, statute.ErrNotSupportMethod}
+	}
+
+	if method == statute.MethodUserPassAuth {
+		up := statute.NewUserPassRequest(statute.UserPassAuthVersion, []byte(auth.User), []byte(auth.Password))
+		if _, err = conn.Write(up.Bytes()); err != nil {
+			return err
+		}
+		upr, err := statute.ParseUserPassReply(conn)
+		if err != nil {
+			return err
+		}
+		if upr.Ver != statute.UserPassAuthVersion || upr.Status != statute.AuthSuccess {
+			return &upstreamError{statute.RepServerFailure, statute.ErrUserAuthFailed}
+		}
+	}
+
+	dst, err := statute.ParseAddrSpec(addr)
+	if err != nil {
+		return err
+	}
+	req := statute.Request{
+		Version: statute.VersionSocks5,
+		Command: statute.CommandConnect,
+		DstAddr: dst,
+	}
+	if _, err = conn.Write(req.Bytes()); err != nil {
+		return err
+	}
+	rep, err := statute.ParseReply(conn)
+	if err != nil {
+		return err
+	}
+	if rep.Response != statute.RepSuccess {
+		return &upstreamError{rep.Response, fmt.Errorf("connect to %s failed", addr)}
+	}
+	return nil
+}
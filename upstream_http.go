@@ -0,0 +1,141 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/thinkgos/go-socks5/statute"
+)
+
+// upstreamHTTPDial returns a dial function which tunnels the address through the upstream
+// http proxy by the CONNECT method, the connection to the upstream proxy is dialed by base.
+func upstreamHTTPDial(proxyURL string,
+	base func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	u, err := url.Parse(proxyURL)
+	if err == nil && u.Scheme != "http" && u.Scheme != "https" {
+		err = fmt.Errorf("scheme %q not supported", u.Scheme)
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if err != nil {
+			return nil, &upstreamError{statute.RepServerFailure, fmt.Errorf("invalid upstream http proxy %q, %v", proxyURL, err)}
+		}
+		switch network {
+		case "tcp", "tcp4", "tcp6":
+		default:
+			return nil, fmt.Errorf("upstream proxy: network %s not supported", network)
+		}
+
+		proxyAddr := u.Host
+		if u.Port() == "" {
+			port := "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+			proxyAddr = net.JoinHostPort(u.Hostname(), port)
+		}
+		conn, err := base(ctx, "tcp", proxyAddr)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme == "https" {
+			conn = tls.Client(conn, &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12})
+		}
+
+		// the handshake is interrupted when ctx is done
+		done, stopped := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(stopped)
+			select {
+			case <-ctx.Done():
+				conn.SetDeadline(time.Now()) // nolint: errcheck
+			case <-done:
+			}
+		}()
+		tunnel, err := upstreamHTTPConnect(conn, u.User, addr)
+		close(done)
+		<-stopped
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{}) // nolint: errcheck
+		return tunnel, nil
+	}
+}
+
+// upstreamHTTPConnect sends the CONNECT request of the address to the upstream http proxy,
+// with the basic Proxy-Authorization if user provided, and reads the response.
+func upstreamHTTPConnect(conn net.Conn, user *url.Userinfo, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user != nil {
+		password, _ := user.Password()
+		cred := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+cred)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &upstreamError{httpStatusReply(resp.StatusCode), fmt.Errorf("connect to %s failed, %s", addr, resp.Status)}
+	}
+	if br.Buffered() > 0 {
+		// the destination spoke first, its bytes are read ahead with the response
+		return &bufferedConn{conn, br}, nil
+	}
+	return conn, nil
+}
+
+// httpStatusReply maps the status code of the CONNECT response to the reply code
+func httpStatusReply(code int) uint8 {
+	switch code {
+	case http.StatusForbidden, http.StatusProxyAuthRequired:
+		return statute.RepRuleFailure
+	case http.StatusNotFound, http.StatusBadGateway:
+		return statute.RepHostUnreachable
+	case http.StatusServiceUnavailable:
+		return statute.RepConnectionRefused
+	case http.StatusGatewayTimeout:
+		return statute.RepTTLExpired
+	case http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return statute.RepCommandNotSupported
+	default:
+		return statute.RepServerFailure
+	}
+}
+
+// bufferedConn is a net.Conn which reads the buffered bytes first
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (sf *bufferedConn) Read(b []byte) (int, error) {
+	return sf.r.Read(b)
+}
+
+// CloseWrite forwards to the underlying connection if supported
+func (sf *bufferedConn) CloseWrite() error {
+	if cw, ok := sf.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package socks5
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+
+	"github.com/thinkgos/go-socks5/statute"
+)
+
+// httpConnectProxy serves a http CONNECT proxy which requires the basic proxy authorization
+func httpConnectProxy(t *testing.T, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			br := bufio.NewReader(conn)
+			req, err := http.ReadRequest(br)
+			if !assert.NoError(t, err) {
+				return
+			}
+			if user, password, ok := (&http.Request{Header: http.Header{
+				"Authorization": req.Header["Proxy-Authorization"],
+			}}).BasicAuth(); !ok || user != "foo" || password != "bar" {
+				conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")) // nolint: errcheck
+				return
+			}
+			if req.Method != http.MethodConnect || req.Host == "127.0.0.1:1" {
+				conn.Write([]byte("HTTP/1.1 403 Forbidden\r\n\r\n")) // nolint: errcheck
+				return
+			}
+			target, err := net.Dial("tcp", req.Host)
+			if err != nil {
+				conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n")) // nolint: errcheck
+				return
+			}
+			defer target.Close()
+			conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")) // nolint: errcheck
+
+			go io.Copy(target, br) // nolint: errcheck
+			io.Copy(conn, target)  // nolint: errcheck
+		}()
+	}
+}
+
+func TestUpstreamHTTPProxy(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn) // nolint: errcheck
+	}()
+
+	proxyLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer proxyLn.Close()
+	go httpConnectProxy(t, proxyLn)
+
+	srv := NewServer(WithUpstreamHTTPProxy("http://foo:bar@" + proxyLn.Addr().String()))
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	dial, err := proxy.SOCKS5("tcp", srvLn.Addr().String(), nil, proxy.Direct)
+	require.NoError(t, err)
+	conn, err := dial.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	out := make([]byte, 4)
+	conn.SetDeadline(time.Now().Add(time.Second)) // nolint: errcheck
+	_, err = io.ReadFull(conn, out)
+	require.NoError(t, err)
+	require.Equal(t, []byte("ping"), out)
+
+	// the non-200 response is mapped to the reply
+	_, err = dial.Dial("tcp", "127.0.0.1:1")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not allowed by ruleset")
+}
+
+func TestHTTPStatusReply(t *testing.T) {
+	require.Equal(t, statute.RepRuleFailure, httpStatusReply(http.StatusProxyAuthRequired))
+	require.Equal(t, statute.RepHostUnreachable, httpStatusReply(http.StatusBadGateway))
+	require.Equal(t, statute.RepTTLExpired, httpStatusReply(http.StatusGatewayTimeout))
+	require.Equal(t, statute.RepServerFailure, httpStatusReply(http.StatusTeapot))
+}
@@ -0,0 +1,126 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+)
+
+func TestUpstreamSocks5(t *testing.T) {
+	// Create a local listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		buf := make([]byte, 4)
+		_, err = io.ReadAtLeast(conn, buf, 4)
+		require.NoError(t, err)
+		require.Equal(t, []byte("ping"), buf)
+
+		conn.Write([]byte("pong")) // nolint: errcheck
+	}()
+
+	// the upstream proxy with UserPass auth.
+	upstream := NewServer(WithAuthMethods([]Authenticator{UserPassAuthenticator{StaticCredentials{"foo": "bar"}}}))
+	upstreamLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go upstream.Serve(upstreamLn) // nolint: errcheck
+	defer upstream.Close()
+
+	srv := NewServer(WithUpstreamSocks5(upstreamLn.Addr().String(), &proxy.Auth{User: "foo", Password: "bar"}))
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	// client
+	dial, err := proxy.SOCKS5("tcp", srvLn.Addr().String(), nil, proxy.Direct)
+	require.NoError(t, err)
+	conn, err := dial.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	conn.Write([]byte("ping")) // nolint: errcheck
+	out := make([]byte, 4)
+	conn.SetDeadline(time.Now().Add(time.Second)) // nolint: errcheck
+	_, err = io.ReadFull(conn, out)
+	require.NoError(t, err)
+	require.Equal(t, []byte("pong"), out)
+}
+
+func TestUpstreamSocks5_RuleFail(t *testing.T) {
+	upstream := NewServer(WithRule(NewPermitNone()))
+	upstreamLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go upstream.Serve(upstreamLn) // nolint: errcheck
+	defer upstream.Close()
+
+	srv := NewServer(WithUpstreamSocks5(upstreamLn.Addr().String(), nil))
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	// the upstream reply is passed to the client
+	dial, err := proxy.SOCKS5("tcp", srvLn.Addr().String(), nil, proxy.Direct)
+	require.NoError(t, err)
+	_, err = dial.Dial("tcp", "127.0.0.1:80")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "connection not allowed by ruleset")
+}
+
+func TestUpstreamSocks5_RemoteDNS(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn) // nolint: errcheck
+	}()
+
+	// the name is only resolvable by the upstream
+	upstream := NewServer(WithResolver(multiResolver{net.IPv4(127, 0, 0, 1)}))
+	upstreamLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go upstream.Serve(upstreamLn) // nolint: errcheck
+	defer upstream.Close()
+
+	local := &countResolver{}
+	srv := NewServer(
+		WithResolver(local),
+		WithRemoteDNS(true),
+		WithUpstreamSocks5(upstreamLn.Addr().String(), nil),
+	)
+	srvLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(srvLn) // nolint: errcheck
+	defer srv.Close()
+
+	dial, err := proxy.SOCKS5("tcp", srvLn.Addr().String(), nil, proxy.Direct)
+	require.NoError(t, err)
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	conn, err := dial.Dial("tcp", net.JoinHostPort("internal.example", port))
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	out := make([]byte, 4)
+	conn.SetDeadline(time.Now().Add(time.Second)) // nolint: errcheck
+	_, err = io.ReadFull(conn, out)
+	require.NoError(t, err)
+	require.Equal(t, []byte("ping"), out)
+	require.Zero(t, local.count)
+}